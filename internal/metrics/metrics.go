@@ -0,0 +1,204 @@
+// Package metrics keeps track of operational metrics of the IRMA server, and writes them in the
+// Prometheus text exposition format. Metrics are registered in a global registry when they are
+// created, which is normally done in a package level var declaration.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CounterVec is a family of counters, partitioned by the values of its labels.
+type CounterVec struct {
+	*family
+}
+
+// HistogramVec is a family of histograms, partitioned by the values of its labels.
+type HistogramVec struct {
+	*family
+}
+
+type family struct {
+	sync.Mutex
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64 // bucket upper bounds (histograms only)
+	series  map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64  // counter value, or sum of observations for histograms
+	count       uint64   // number of observations (histograms only)
+	buckets     []uint64 // cumulative bucket counts (histograms only)
+}
+
+var registry = struct {
+	sync.Mutex
+	families []*family
+}{}
+
+// DefaultDurationBuckets are histogram buckets suitable for session durations, in seconds.
+var DefaultDurationBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600}
+
+// NewCounterVec creates and registers a new counter family with the specified label names.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{register(name, help, "counter", nil, labels)}
+}
+
+// NewHistogramVec creates and registers a new histogram family with the specified (increasing)
+// bucket upper bounds and label names.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{register(name, help, "histogram", buckets, labels)}
+}
+
+func register(name, help, typ string, buckets []float64, labels []string) *family {
+	f := &family{name: name, help: help, typ: typ, labels: labels, buckets: buckets, series: map[string]*series{}}
+	registry.Lock()
+	defer registry.Unlock()
+	registry.families = append(registry.families, f)
+	return f
+}
+
+// Inc increments the counter having the specified label values.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds the specified amount to the counter having the specified label values.
+func (c *CounterVec) Add(amount float64, labelValues ...string) {
+	c.Lock()
+	defer c.Unlock()
+	c.get(labelValues).value += amount
+}
+
+// Observe adds an observation to the histogram having the specified label values.
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.Lock()
+	defer h.Unlock()
+	s := h.get(labelValues)
+	if s.buckets == nil {
+		s.buckets = make([]uint64, len(h.buckets))
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.buckets[i]++
+		}
+	}
+	s.value += value
+	s.count++
+}
+
+// get returns the series with the specified label values, creating it if necessary.
+// The caller must hold the lock of the family.
+func (f *family) get(labelValues []string) *series {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", f.name, len(f.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string{}, labelValues...)}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Write writes all registered metrics to w in the Prometheus text exposition format.
+func Write(w io.Writer) error {
+	registry.Lock()
+	families := append([]*family{}, registry.families...)
+	registry.Unlock()
+
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+	for _, f := range families {
+		if err := f.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler returns a http.Handler that serves all registered metrics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_ = Write(w)
+	})
+}
+
+func (f *family) write(w io.Writer) error {
+	f.Lock()
+	defer f.Unlock()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# HELP %s %s\n", f.name, escape(f.help, false))
+	fmt.Fprintf(&b, "# TYPE %s %s\n", f.name, f.typ)
+
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := f.series[key]
+		if f.typ == "counter" {
+			fmt.Fprintf(&b, "%s%s %s\n", f.name, f.labelString(s.labelValues, ""), formatFloat(s.value))
+			continue
+		}
+		for i, bound := range f.buckets {
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", f.name, f.labelString(s.labelValues, formatFloat(bound)), s.buckets[i])
+		}
+		fmt.Fprintf(&b, "%s_bucket%s %d\n", f.name, f.labelString(s.labelValues, "+Inf"), s.count)
+		fmt.Fprintf(&b, "%s_sum%s %s\n", f.name, f.labelString(s.labelValues, ""), formatFloat(s.value))
+		fmt.Fprintf(&b, "%s_count%s %d\n", f.name, f.labelString(s.labelValues, ""), s.count)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// labelString renders the label names and values of a series, including the le label of
+// histogram buckets if le is not empty.
+func (f *family) labelString(values []string, le string) string {
+	pairs := make([]string, 0, len(values)+1)
+	for i, name := range f.labels {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, escape(values[i], true)))
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf(`le="%s"`, le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escape(s string, quotes bool) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	if quotes {
+		s = strings.Replace(s, `"`, `\"`, -1)
+	}
+	return s
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+}
@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrite(t *testing.T) {
+	counter := NewCounterVec("test_counter_total", "A test counter.", "label")
+	histogram := NewHistogramVec("test_histogram_seconds", "A test histogram.", []float64{1, 10})
+
+	counter.Inc("b")
+	counter.Add(2, `a"`)
+	histogram.Observe(0.5)
+	histogram.Observe(5)
+	histogram.Observe(50)
+
+	var b bytes.Buffer
+	require.NoError(t, Write(&b))
+	output := b.String()
+
+	require.Contains(t, output, strings.Join([]string{
+		"# HELP test_counter_total A test counter.",
+		"# TYPE test_counter_total counter",
+		`test_counter_total{label="a\""} 2`,
+		`test_counter_total{label="b"} 1`,
+	}, "\n"))
+	require.Contains(t, output, strings.Join([]string{
+		"# HELP test_histogram_seconds A test histogram.",
+		"# TYPE test_histogram_seconds histogram",
+		`test_histogram_seconds_bucket{le="1"} 1`,
+		`test_histogram_seconds_bucket{le="10"} 2`,
+		`test_histogram_seconds_bucket{le="+Inf"} 3`,
+		"test_histogram_seconds_sum 55.5",
+		"test_histogram_seconds_count 3",
+	}, "\n"))
+}
+
+func TestLabelCount(t *testing.T) {
+	counter := NewCounterVec("test_labels_total", "", "one", "two")
+	require.Panics(t, func() { counter.Inc("only one") })
+}
@@ -6,17 +6,17 @@ package servercore
 
 import (
 	"encoding/json"
-	"io/ioutil"
+	"fmt"
 	"net/http"
-	"path/filepath"
 	"regexp"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-errors/errors"
+	"github.com/gorilla/websocket"
 	"github.com/jasonlvhit/gocron"
 	"github.com/privacybydesign/gabi"
-	"github.com/privacybydesign/gabi/big"
 	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/fs"
 	"github.com/privacybydesign/irmago/server"
@@ -25,34 +25,123 @@ import (
 
 type Server struct {
 	conf          *server.Configuration
-	sessions      sessionStore
+	tenant        string
+	sessions      *sessionStore
 	scheduler     *gocron.Scheduler
 	stopScheduler chan bool
+	draining      *int32        // accessed atomically; shared with the servers of tenants
+	stopped       chan struct{} // closed when the server stops; shared with the servers of tenants
+
+	restoredHandlers RestoredHandlers // guarded by the lock of sessions
 }
 
+// ErrDraining is returned by StartSession when the server is being drained.
+var ErrDraining = errors.New("server is shutting down")
+
+// ErrUnknownSession is returned by WaitStatus and SubscribeStatusWebSocket for unknown sessions.
+var ErrUnknownSession = errors.New("unknown session")
+
+// ErrWebSocketUpgrade is returned by SubscribeStatusWebSocket if the request could not be upgraded
+// to a WebSocket connection, in which case the error response has already been written.
+var ErrWebSocketUpgrade = errors.New("websocket upgrade failed")
+
 func New(conf *server.Configuration) (*Server, error) {
 	s := &Server{
 		conf:      conf,
 		scheduler: gocron.NewScheduler(),
-		sessions: &memorySessionStore{
-			requestor: make(map[string]*session),
-			client:    make(map[string]*session),
-			conf:      conf,
-		},
+		draining:  new(int32),
+		stopped:   make(chan struct{}),
+	}
+	if err := s.verifyConfiguration(s.conf); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if s.sessions, err = newSessionStore(s.conf); err != nil {
+		return nil, server.LogError(err)
 	}
+	s.sessions.register(s)
 	s.scheduler.Every(10).Seconds().Do(func() {
 		s.sessions.deleteExpired()
 	})
+	if s.conf.CustomSessionStore != nil {
+		// Other servers may share the store, so check for status updates made by them
+		s.scheduler.Every(1).Seconds().Do(func() {
+			s.sessions.refreshListened()
+		})
+	}
 	s.stopScheduler = s.scheduler.Start()
 
-	return s, s.verifyConfiguration(s.conf)
+	return s, nil
 }
 
+// NewTenant returns a server for the named tenant, which shares the parsed schemes, session store
+// and draining state of s, but otherwise uses the specified configuration (notably its URL and
+// issuer private keys). Sessions of a tenant are known only to the server of that tenant, except
+// at the IRMA app endpoints, which the server of any tenant can handle. Sessions of the tenant
+// that are restored from the session store are handled using the returned server.
+func (s *Server) NewTenant(name string, conf *server.Configuration) (*Server, error) {
+	if name == "" {
+		return nil, errors.New("tenant name must not be empty")
+	}
+	conf.IrmaConfiguration = s.conf.IrmaConfiguration
+	if conf.Logger == nil {
+		conf.Logger = s.conf.Logger
+	}
+	t := &Server{
+		conf:     conf,
+		tenant:   name,
+		sessions: s.sessions,
+		draining: s.draining,
+		stopped:  s.stopped,
+	}
+	if err := t.verifyTimeouts(); err != nil {
+		return nil, err
+	}
+	if err := t.readPrivateKeys(); err != nil {
+		return nil, err
+	}
+	if err := t.verifyURL(); err != nil {
+		return nil, err
+	}
+	s.sessions.register(t)
+	return t, nil
+}
+
+// Stop the server. The servers of tenants share the session store of the server from which they
+// were created, which stops it.
 func (s *Server) Stop() {
+	if s.tenant != "" {
+		return
+	}
 	s.stopScheduler <- true
+	close(s.stopped) // closes status WebSockets, which the HTTP server does not close as they are hijacked
 	s.sessions.stop()
 }
 
+// Drain makes the server refuse new sessions, and waits until all running sessions have finished
+// or until the deadline has passed. It returns whether all sessions have finished.
+// Note that Drain does not stop the server; call Stop() afterwards.
+func (s *Server) Drain(deadline time.Time) bool {
+	atomic.StoreInt32(s.draining, 1)
+	for {
+		count := s.sessions.unfinished()
+		if count == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			s.conf.Logger.WithField("sessions", count).Warn("Drain deadline passed before all sessions finished")
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Draining returns whether the server is being drained, i.e. refuses new sessions.
+func (s *Server) Draining() bool {
+	return atomic.LoadInt32(s.draining) == 1
+}
+
 func (s *Server) verifyConfiguration(configuration *server.Configuration) error {
 	if s.conf.Logger == nil {
 		s.conf.Logger = server.NewLogger(s.conf.Verbose, s.conf.Quiet, s.conf.LogJSON)
@@ -96,6 +185,13 @@ func (s *Server) verifyConfiguration(configuration *server.Configuration) error
 	}
 
 	if !s.conf.DisableSchemesUpdate {
+		s.conf.IrmaConfiguration.SchemeUpdated = func(id irma.SchemeManagerIdentifier, err error) {
+			outcome := "success"
+			if err != nil {
+				outcome = "failure"
+			}
+			metricSchemeUpdates.Inc(id.String(), outcome)
+		}
 		if s.conf.SchemesUpdateInterval == 0 {
 			s.conf.SchemesUpdateInterval = 60
 		}
@@ -104,25 +200,81 @@ func (s *Server) verifyConfiguration(configuration *server.Configuration) error
 		s.conf.SchemesUpdateInterval = 0
 	}
 
+	if err := s.verifyTimeouts(); err != nil {
+		return err
+	}
+
+	if err := s.readPrivateKeys(); err != nil {
+		return err
+	}
+	if err := s.verifyURL(); err != nil {
+		return err
+	}
+
+	if s.conf.Email != "" {
+		// Very basic sanity checks
+		if !strings.Contains(s.conf.Email, "@") || strings.Contains(s.conf.Email, "\n") {
+			return server.LogError(errors.New("Invalid email address specified"))
+		}
+		t := irma.NewHTTPTransport("https://metrics.privacybydesign.foundation/history")
+		t.SetHeader("User-Agent", "irmaserver")
+		var x string
+		_ = t.Post("email", &x, s.conf.Email)
+	}
+
+	return nil
+}
+
+func (s *Server) verifyTimeouts() error {
+	timeouts := []struct {
+		name       string
+		value, max *int
+	}{
+		{"client_timeout", &s.conf.ClientTimeout, &s.conf.MaxClientTimeout},
+		{"session_lifetime", &s.conf.SessionLifetime, &s.conf.MaxSessionLifetime},
+		{"result_lifetime", &s.conf.ResultLifetime, &s.conf.MaxResultLifetime},
+	}
+	for _, t := range timeouts {
+		if *t.value < 0 || *t.max < 0 {
+			return server.LogError(errors.Errorf("%s and max_%s must not be negative", t.name, t.name))
+		}
+		if *t.value == 0 {
+			*t.value = defaultSessionTimeout
+		}
+		if *t.max == 0 {
+			*t.max = defaultMaxSessionTimeout
+			if *t.value > *t.max {
+				*t.max = *t.value
+			}
+		}
+		if *t.value > *t.max {
+			return server.LogError(errors.Errorf("%s must not be larger than max_%s", t.name, t.name))
+		}
+	}
+
+	if s.conf.LongPollTimeout < 0 {
+		return server.LogError(errors.New("long_poll_timeout must not be negative"))
+	}
+	if s.conf.LongPollTimeout == 0 {
+		s.conf.LongPollTimeout = defaultLongPollTimeout
+	}
+	return nil
+}
+
+func (s *Server) readPrivateKeys() error {
 	if s.conf.IssuerPrivateKeys == nil {
 		s.conf.IssuerPrivateKeys = make(map[irma.IssuerIdentifier]*gabi.PrivateKey)
 	}
 	if s.conf.IssuerPrivateKeysPath != "" {
-		files, err := ioutil.ReadDir(s.conf.IssuerPrivateKeysPath)
+		files, skipped, err := s.privateKeyFiles()
 		if err != nil {
 			return server.LogError(err)
 		}
-		for _, file := range files {
-			filename := file.Name()
-			if filepath.Ext(filename) != ".xml" || filename[0] == '.' || strings.Count(filename, ".") != 2 {
-				s.conf.Logger.WithField("file", filename).Infof("Skipping non-private key file encountered in private keys path")
-				continue
-			}
-			issid := irma.NewIssuerIdentifier(strings.TrimSuffix(filename, filepath.Ext(filename))) // strip .xml
-			if _, ok := s.conf.IrmaConfiguration.Issuers[issid]; !ok {
-				return server.LogError(errors.Errorf("Private key %s belongs to an unknown issuer", filename))
-			}
-			sk, err := gabi.NewPrivateKeyFromFile(filepath.Join(s.conf.IssuerPrivateKeysPath, filename))
+		for _, filename := range skipped {
+			s.conf.Logger.WithField("file", filename).Infof("Skipping non-private key file encountered in private keys path")
+		}
+		for _, filename := range files {
+			issid, sk, err := s.readPrivateKey(filename)
 			if err != nil {
 				return server.LogError(err)
 			}
@@ -130,18 +282,14 @@ func (s *Server) verifyConfiguration(configuration *server.Configuration) error
 		}
 	}
 	for issid, sk := range s.conf.IssuerPrivateKeys {
-		pk, err := s.conf.IrmaConfiguration.PublicKey(issid, int(sk.Counter))
-		if err != nil {
+		if err := s.checkPrivateKey(issid, sk); err != nil {
 			return server.LogError(err)
 		}
-		if pk == nil {
-			return server.LogError(errors.Errorf("Missing public key belonging to private key %s-%d", issid.String(), sk.Counter))
-		}
-		if new(big.Int).Mul(sk.P, sk.Q).Cmp(pk.N) != 0 {
-			return server.LogError(errors.Errorf("Private key %s-%d does not belong to corresponding public key", issid.String(), sk.Counter))
-		}
 	}
+	return nil
+}
 
+func (s *Server) verifyURL() error {
 	if s.conf.URL != "" {
 		if !strings.HasSuffix(s.conf.URL, "/") {
 			s.conf.URL = s.conf.URL + "/"
@@ -159,19 +307,67 @@ func (s *Server) verifyConfiguration(configuration *server.Configuration) error
 	} else {
 		s.conf.Logger.Warn("No url parameter specified in configuration; unless an url is elsewhere prepended in the QR, the IRMA client will not be able to connect")
 	}
+	return nil
+}
 
-	if s.conf.Email != "" {
-		// Very basic sanity checks
-		if !strings.Contains(s.conf.Email, "@") || strings.Contains(s.conf.Email, "\n") {
-			return server.LogError(errors.New("Invalid email address specified"))
+// Readiness reports whether the server is ready to handle sessions, i.e. whether all schemes
+// are parsed and valid and whether all issuer private keys can be loaded.
+func (s *Server) Readiness() *server.Readiness {
+	conf := s.conf.IrmaConfiguration
+	r := &server.Readiness{
+		Ready:   true,
+		Schemes: map[string]*server.ComponentStatus{},
+		Issuers: map[string]*server.ComponentStatus{},
+	}
+
+	if !conf.IsInitialized() || len(conf.SchemeManagers)+len(conf.DisabledSchemeManagers) == 0 {
+		r.Ready = false
+	}
+	for id, scheme := range conf.SchemeManagers {
+		r.Schemes[id.String()] = &server.ComponentStatus{
+			Ready:  scheme.Status == irma.SchemeManagerStatusValid,
+			Status: string(scheme.Status),
 		}
-		t := irma.NewHTTPTransport("https://metrics.privacybydesign.foundation/history")
-		t.SetHeader("User-Agent", "irmaserver")
-		var x string
-		_ = t.Post("email", &x, s.conf.Email)
+	}
+	for id, mgrerr := range conf.DisabledSchemeManagers {
+		status := &server.ComponentStatus{Status: string(mgrerr.Status)}
+		if mgrerr.Err != nil {
+			status.Error = mgrerr.Err.Error()
+		}
+		r.Schemes[id.String()] = status
 	}
 
-	return nil
+	for issid, sk := range s.conf.IssuerPrivateKeys {
+		status := &server.ComponentStatus{Ready: true}
+		if err := s.checkPrivateKey(issid, sk); err != nil {
+			status = &server.ComponentStatus{Error: err.Error()}
+		}
+		r.Issuers[issid.String()] = status
+	}
+	// Check that the private keys on disk can still be loaded, e.g. for when the server restarts
+	if s.conf.IssuerPrivateKeysPath != "" {
+		files, _, err := s.privateKeyFiles()
+		if err != nil {
+			r.Issuers[s.conf.IssuerPrivateKeysPath] = &server.ComponentStatus{Error: err.Error()}
+		}
+		for _, filename := range files {
+			issid, sk, err := s.readPrivateKey(filename)
+			if err == nil {
+				err = s.checkPrivateKey(issid, sk)
+			}
+			if err != nil {
+				r.Issuers[issid.String()] = &server.ComponentStatus{Error: err.Error()}
+			}
+		}
+	}
+
+	for _, status := range r.Schemes {
+		r.Ready = r.Ready && status.Ready
+	}
+	for _, status := range r.Issuers {
+		r.Ready = r.Ready && status.Ready
+	}
+	return r
 }
 
 func (s *Server) validateRequest(request irma.SessionRequest) error {
@@ -181,7 +377,69 @@ func (s *Server) validateRequest(request irma.SessionRequest) error {
 	return request.Disclosure().Disclose.Validate(s.conf.IrmaConfiguration)
 }
 
-func (s *Server) StartSession(req interface{}) (*irma.Qr, string, error) {
+// NextSessionStarter starts the follow-up session of a session that has finished successfully,
+// returning its session pointer and token, or a nil session pointer if there is none. It is
+// called before the session becomes DONE, with the session unlocked, so that it may call
+// functions of the server concerning the session.
+type NextSessionStarter func(result *server.SessionResult) (*irma.Qr, string, error)
+
+// CredentialsComputer computes the credentials to issue in a dynamic issuance session, from the
+// session result containing the attributes disclosed in the session. Like NextSessionStarter,
+// it is called with the session unlocked, so that it may call functions of the server concerning
+// the session.
+type CredentialsComputer func(result *server.SessionResult, request *irma.IssuanceRequest) ([]*irma.CredentialRequest, error)
+
+// ResultHandler handles the result of a session once it has finished. It is not called by the
+// Server, but by its user after HandleProtocolMessage() has returned the finished session result.
+type ResultHandler func(result *server.SessionResult)
+
+// SessionHandlers contains the functions through which the starter of a session takes part in
+// it. Each of them is optional.
+type SessionHandlers struct {
+	// Handles the session result once the session has finished
+	Result ResultHandler
+	// Starts the follow-up session into which the client continues after the session, if it supports this
+	Next NextSessionStarter
+	// Computes the credentials to issue in dynamic issuance sessions
+	Credentials CredentialsComputer
+	// Called in its own goroutine when the session finishes, whatever its status: unlike Result,
+	// also when the session times out or is cancelled by the requestor
+	Finished ResultHandler
+}
+
+// RestoredHandlers returns the handlers of a session of the specified requestor that was not
+// started by this server but restored from the session store: after a restart of the server, or
+// because it was started by another server sharing the session store.
+type RestoredHandlers func(requestor string) SessionHandlers
+
+// SetRestoredHandlers sets the function providing the handlers of the restored sessions of the
+// tenant of the server. Without it, restored sessions have no handlers.
+func (s *Server) SetRestoredHandlers(f RestoredHandlers) {
+	s.sessions.setRestoredHandlers(s, f)
+}
+
+// SessionResultHandler returns the result handler of the specified session of any tenant, if any.
+func (s *Server) SessionResultHandler(token string) ResultHandler {
+	session := s.sessions.get(token)
+	if session == nil {
+		return nil
+	}
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.handlers.Result
+}
+
+// StartSession starts a new session. The requestor parameter, which may be empty, names the
+// requestor on behalf of which the session is started.
+func (s *Server) StartSession(req interface{}, requestor string) (*irma.Qr, string, error) {
+	return s.StartSessionWithHandlers(req, requestor, SessionHandlers{})
+}
+
+// StartSessionWithHandlers is like StartSession, additionally specifying the handlers of the session.
+func (s *Server) StartSessionWithHandlers(req interface{}, requestor string, handlers SessionHandlers) (*irma.Qr, string, error) {
+	if s.Draining() {
+		return nil, "", ErrDraining
+	}
 	rrequest, err := server.ParseSessionRequest(req)
 	if err != nil {
 		return nil, "", err
@@ -190,6 +448,14 @@ func (s *Server) StartSession(req interface{}) (*irma.Qr, string, error) {
 	request := rrequest.SessionRequest()
 	action := request.Action()
 
+	base := rrequest.Base()
+	if base.ClientTimeout < 0 || base.SessionLifetime < 0 || base.ResultLifetime < 0 {
+		return nil, "", errors.New("session timeout and lifetimes must not be negative")
+	}
+	if base.ClientTimeout > s.conf.MaxClientTimeout || base.SessionLifetime > s.conf.MaxSessionLifetime || base.ResultLifetime > s.conf.MaxResultLifetime {
+		s.conf.Logger.Warn("Session timeout or lifetime in session request exceeds server maximum, using the maximum instead")
+	}
+
 	if err := s.validateRequest(request); err != nil {
 		return nil, "", err
 	}
@@ -198,32 +464,74 @@ func (s *Server) StartSession(req interface{}) (*irma.Qr, string, error) {
 		if err := s.validateIssuanceRequest(request.(*irma.IssuanceRequest)); err != nil {
 			return nil, "", err
 		}
+		if request.(*irma.IssuanceRequest).Dynamic && handlers.Credentials == nil {
+			return nil, "", errors.New("dynamic issuance requires a handler computing the credentials")
+		}
 	}
 
-	session := s.newSession(action, rrequest)
+	if hook := s.conf.Hooks.StartSession; hook != nil {
+		if err := hook(rrequest, requestor); err != nil {
+			return nil, "", hookError(err)
+		}
+	}
+
+	session, err := s.newSession(action, rrequest, requestor, handlers)
+	if err != nil {
+		return nil, "", err
+	}
+	metricSessionsStarted.Inc(string(action), requestor)
 	s.conf.Logger.WithFields(logrus.Fields{"action": action, "session": session.token}).Infof("Session started")
 	if s.conf.Logger.IsLevelEnabled(logrus.DebugLevel) {
 		s.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Info("Session request: ", server.ToJson(rrequest))
 	} else {
 		s.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Info("Session request (purged of attribute values): ", server.ToJson(purgeRequest(rrequest)))
 	}
-	return &irma.Qr{
-		Type: action,
-		URL:  s.conf.URL + "session/" + session.clientToken,
-	}, session.token, nil
+	return session.pointer(), session.token, nil
 }
 
-func (s *Server) GetSessionResult(token string) *server.SessionResult {
+// getSession returns the session of the requestor token, if it belongs to the tenant of the server.
+func (s *Server) getSession(token string) *session {
 	session := s.sessions.get(token)
+	if session == nil || session.tenant != s.tenant {
+		return nil
+	}
+	return session
+}
+
+// tenantSessions returns the sessions belonging to the tenant of the server.
+func (s *Server) tenantSessions() []*session {
+	var sessions []*session
+	for _, session := range s.sessions.list() {
+		if session.tenant == s.tenant {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
+
+// SessionPointer returns the session pointer of the specified session, to be passed to the IRMA
+// app, or nil if the session is unknown.
+func (s *Server) SessionPointer(token string) *irma.Qr {
+	session := s.getSession(token)
+	if session == nil {
+		return nil
+	}
+	return session.pointer()
+}
+
+func (s *Server) GetSessionResult(token string) *server.SessionResult {
+	session := s.getSession(token)
 	if session == nil {
 		s.conf.Logger.Warn("Session result requested of unknown session ", token)
 		return nil
 	}
+	session.Lock()
+	defer session.Unlock()
 	return session.result
 }
 
 func (s *Server) GetRequest(token string) irma.RequestorRequest {
-	session := s.sessions.get(token)
+	session := s.getSession(token)
 	if session == nil {
 		s.conf.Logger.Warn("Session request requested of unknown session ", token)
 		return nil
@@ -232,16 +540,64 @@ func (s *Server) GetRequest(token string) irma.RequestorRequest {
 }
 
 func (s *Server) CancelSession(token string) error {
-	session := s.sessions.get(token)
+	session := s.getSession(token)
 	if session == nil {
 		return server.LogError(errors.Errorf("can't cancel unknown session %s", token))
 	}
+	session.Lock()
+	defer session.Unlock()
 	session.handleDelete()
 	return nil
 }
 
+// Sessions returns information about all sessions currently held by the server.
+func (s *Server) Sessions() []*server.SessionInfo {
+	sessions := s.tenantSessions()
+	infos := make([]*server.SessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		session.Lock()
+		infos = append(infos, session.info(false))
+		session.Unlock()
+	}
+	return infos
+}
+
+// SessionInfo returns information about the specified session, including its request from which
+// all attribute values are removed.
+func (s *Server) SessionInfo(token string) *server.SessionInfo {
+	session := s.getSession(token)
+	if session == nil {
+		return nil
+	}
+	session.Lock()
+	defer session.Unlock()
+	return session.info(true)
+}
+
+// UnfinishedSessions returns the number of sessions of the specified requestor that have not yet
+// finished. The sessions are counted as their status changes, so this does not need to lock them.
+func (s *Server) UnfinishedSessions(requestor string) int {
+	return s.sessions.unfinishedOf(s.tenant, requestor)
+}
+
+// CancelRequestorSessions cancels all unfinished sessions of the specified requestor, returning
+// the number of cancelled sessions.
+func (s *Server) CancelRequestorSessions(requestor string) int {
+	count := 0
+	for _, session := range s.tenantSessions() {
+		session.Lock()
+		if session.requestor == requestor && !session.status.Finished() {
+			session.handleDelete()
+			count++
+		}
+		session.Unlock()
+	}
+	s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor, "count": count}).Info("Cancelled sessions of requestor")
+	return count
+}
+
 func ParsePath(path string) (string, string, error) {
-	pattern := regexp.MustCompile("session/(\\w+)/?(|commitments|proofs|status|statusevents)$")
+	pattern := regexp.MustCompile("session/(\\w+)/?(|commitments|proofs|status|statusevents|statussocket)$")
 	matches := pattern.FindStringSubmatch(path)
 	if len(matches) != 3 {
 		return "", "", server.LogWarning(errors.Errorf("Invalid URL: %s", path))
@@ -256,7 +612,7 @@ func (s *Server) SubscribeServerSentEvents(w http.ResponseWriter, r *http.Reques
 
 	var session *session
 	if requestor {
-		session = s.sessions.get(token)
+		session = s.getSession(token)
 	} else {
 		session = s.sessions.clientGet(token)
 	}
@@ -285,6 +641,100 @@ func (s *Server) SubscribeServerSentEvents(w http.ResponseWriter, r *http.Reques
 	return nil
 }
 
+// statusSession returns the session of the requestor or client token.
+func (s *Server) statusSession(token string, requestor bool) *session {
+	if requestor {
+		return s.getSession(token)
+	}
+	return s.sessions.clientGet(token)
+}
+
+// WaitStatus waits until the status of the session differs from the specified status, or until
+// the long-poll timeout of the server configuration has passed, and returns the status of the
+// session. It returns immediately if the session has already finished.
+func (s *Server) WaitStatus(token string, requestor bool, status server.Status) (server.Status, error) {
+	session := s.statusSession(token, requestor)
+	if session == nil {
+		return "", ErrUnknownSession
+	}
+
+	session.Lock()
+	current := session.status
+	if current != status || current.Finished() {
+		session.Unlock()
+		return current, nil
+	}
+	listener := session.addStatusListener()
+	session.Unlock()
+	defer func() {
+		session.Lock()
+		session.removeStatusListener(listener)
+		session.Unlock()
+	}()
+
+	select {
+	case current = <-listener:
+	case <-time.After(time.Duration(s.conf.LongPollTimeout) * time.Second):
+	}
+	return current, nil
+}
+
+// SubscribeStatusWebSocket upgrades the HTTP request to a WebSocket connection over which the
+// session status is sent, as a JSON string, once immediately and then whenever it changes.
+// The connection is closed after the session has finished, or when the server stops.
+// If the session is unknown, ErrUnknownSession is returned and nothing is written to w;
+// if upgrading the connection fails, the error response has already been written to w.
+func (s *Server) SubscribeStatusWebSocket(w http.ResponseWriter, r *http.Request, token string, requestor bool) error {
+	session := s.statusSession(token, requestor)
+	if session == nil {
+		return ErrUnknownSession
+	}
+	ws, err := webSocketUpgrader(s.conf).Upgrade(w, r, nil)
+	if err != nil {
+		return ErrWebSocketUpgrade
+	}
+	closed := readWebSocket(ws)
+	s.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Debug("New WebSocket status subscriber")
+
+	session.Lock()
+	status := session.status
+	listener := session.addStatusListener()
+	session.Unlock()
+	defer func() {
+		session.Lock()
+		session.removeStatusListener(listener)
+		session.Unlock()
+	}()
+
+	// Ping the client regularly so that reverse proxies do not close the idle connection
+	keepAlive := time.NewTicker(webSocketKeepAliveTimeout)
+	defer keepAlive.Stop()
+
+	// We send JSON like the other APIs, so quote
+	err = writeWebSocket(ws, websocket.TextMessage, []byte(fmt.Sprintf(`"%s"`, status)))
+	for err == nil && !status.Finished() {
+		select {
+		case status = <-listener:
+			err = writeWebSocket(ws, websocket.TextMessage, []byte(fmt.Sprintf(`"%s"`, status)))
+		case <-keepAlive.C:
+			err = writeWebSocket(ws, websocket.PingMessage, nil)
+		case <-closed:
+			_ = ws.Close()
+			return nil
+		case <-s.stopped:
+			closeWebSocket(ws, websocket.CloseGoingAway)
+			return nil
+		}
+	}
+	if err != nil {
+		s.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Debug("WebSocket status subscriber disconnected: ", err)
+		closeWebSocket(ws, websocket.CloseGoingAway)
+		return nil
+	}
+	closeWebSocket(ws, websocket.CloseNormalClosure)
+	return nil
+}
+
 func (s *Server) HandleProtocolMessage(
 	path string,
 	method string,
@@ -337,13 +787,22 @@ func (s *Server) handleProtocolMessage(
 	}
 	session.Lock()
 	defer session.Unlock()
+	if method != http.MethodGet || noun != "status" {
+		// E.g. retried proofs or commitments must wait for the session to finish to get the cached response
+		session.awaitIdle()
+	}
 
 	// However we return, if the session status has been updated
-	// then we should inform the user by returning a SessionResult
+	// then we should inform the user by returning a SessionResult.
+	// Only write the session to the store if it changed, as e.g. status polls don't change it
 	defer func() {
 		if session.status != session.prevStatus {
 			session.prevStatus = session.status
 			result = session.result
+			session.dirty = true
+		}
+		if session.dirty {
+			s.sessions.update(session)
 		}
 	}()
 
@@ -372,7 +831,7 @@ func (s *Server) handleProtocolMessage(
 				return
 			}
 			status, output = server.JsonResponse(session.handleGetRequest(min, max))
-			session.responseCache = responseCache{message: message, response: output, status: status, sessionStatus: server.StatusConnected}
+			session.cacheResponse(message, output, status, server.StatusConnected)
 			return
 		}
 		status, output = server.JsonResponse(nil, session.fail(server.ErrorInvalidRequest, ""))
@@ -384,6 +843,11 @@ func (s *Server) handleProtocolMessage(
 			status, output = server.JsonResponse(nil, err)
 			return
 		}
+		if noun == "statussocket" {
+			err := server.RemoteError(server.ErrorInvalidRequest, "WebSockets not supported by this server")
+			status, output = server.JsonResponse(nil, err)
+			return
+		}
 
 		if method == http.MethodGet && noun == "status" {
 			status, output = server.JsonResponse(session.handleGetStatus())
@@ -406,8 +870,8 @@ func (s *Server) handleProtocolMessage(
 				status, output = server.JsonResponse(nil, session.fail(server.ErrorMalformedInput, err.Error()))
 				return
 			}
-			status, output = server.JsonResponse(session.handlePostCommitments(commitments))
-			session.responseCache = responseCache{message: message, response: output, status: status, sessionStatus: server.StatusDone}
+			status, output = session.finalResponse(session.handlePostCommitments(commitments))
+			session.cacheResponse(message, output, status, server.StatusDone)
 			return
 		}
 
@@ -421,8 +885,9 @@ func (s *Server) handleProtocolMessage(
 				status, output = server.JsonResponse(nil, session.fail(server.ErrorMalformedInput, err.Error()))
 				return
 			}
-			status, output = server.JsonResponse(session.handlePostDisclosure(disclosure))
-			session.responseCache = responseCache{message: message, response: output, status: status, sessionStatus: server.StatusDone}
+			_, rerr := session.handlePostDisclosure(disclosure)
+			status, output = session.finalResponse(nil, rerr)
+			session.cacheResponse(message, output, status, server.StatusDone)
 			return
 		}
 
@@ -436,8 +901,9 @@ func (s *Server) handleProtocolMessage(
 				status, output = server.JsonResponse(nil, session.fail(server.ErrorMalformedInput, err.Error()))
 				return
 			}
-			status, output = server.JsonResponse(session.handlePostSignature(signature))
-			session.responseCache = responseCache{message: message, response: output, status: status, sessionStatus: server.StatusDone}
+			_, rerr := session.handlePostSignature(signature)
+			status, output = session.finalResponse(nil, rerr)
+			session.cacheResponse(message, output, status, server.StatusDone)
 			return
 		}
 
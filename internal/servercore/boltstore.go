@@ -0,0 +1,99 @@
+package servercore
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/server"
+	"go.etcd.io/bbolt"
+)
+
+// boltSessionStore is a server.SessionStore that keeps sessions in memory like memorySessionStore,
+// but additionally writes each session to a bbolt database whenever it changes. Upon startup, all
+// sessions present in the database are loaded, so that running sessions survive a restart of the
+// server. As only one process at a time can open a bbolt database, the store cannot be shared by
+// several servers.
+type boltSessionStore struct {
+	*memorySessionStore
+	db *bbolt.DB
+}
+
+const boltSessionsBucket = "sessions" // Key: requestor token, value: *server.SessionData
+
+func newBoltSessionStore(conf *server.Configuration) (*boltSessionStore, error) {
+	if conf.SessionStorePath == "" {
+		return nil, errors.New("session_store_path is required when using the bolt session store")
+	}
+	db, err := bbolt.Open(conf.SessionStorePath, 0600, &bbolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "failed to open session store", 0)
+	}
+	s := &boltSessionStore{
+		memorySessionStore: newMemorySessionStore(),
+		db:                 db,
+	}
+	if err = s.load(); err != nil {
+		_ = db.Close()
+		return nil, errors.WrapPrefix(err, "failed to load sessions from session store", 0)
+	}
+	return s, nil
+}
+
+// load reads all sessions from the database into memory.
+func (s *boltSessionStore) load() error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(boltSessionsBucket))
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			data := &server.SessionData{}
+			if err := json.Unmarshal(v, data); err != nil {
+				return err
+			}
+			return s.memorySessionStore.Add(data)
+		})
+	})
+}
+
+func (s *boltSessionStore) Add(session *server.SessionData) error {
+	if err := s.put(session); err != nil {
+		return err
+	}
+	return s.memorySessionStore.Add(session)
+}
+
+func (s *boltSessionStore) Update(session *server.SessionData) error {
+	if existing, _ := s.memorySessionStore.Get(session.Token); existing == nil {
+		return nil
+	}
+	if err := s.put(session); err != nil {
+		return err
+	}
+	return s.memorySessionStore.Update(session)
+}
+
+func (s *boltSessionStore) put(session *server.SessionData) error {
+	bts, err := json.Marshal(session)
+	if err != nil {
+		return errors.WrapPrefix(err, "failed to serialize session", 0)
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(boltSessionsBucket)).Put([]byte(session.Token), bts)
+	})
+}
+
+func (s *boltSessionStore) Delete(token string) error {
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(boltSessionsBucket)).Delete([]byte(token))
+	})
+	if err != nil {
+		return err
+	}
+	return s.memorySessionStore.Delete(token)
+}
+
+func (s *boltSessionStore) Close() error {
+	return s.db.Close()
+}
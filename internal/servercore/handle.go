@@ -1,6 +1,9 @@
 package servercore
 
 import (
+	"time"
+
+	"github.com/go-errors/errors"
 	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/server"
@@ -30,6 +33,12 @@ func (session *session) handleGetRequest(min, max *irma.ProtocolVersion) (irma.S
 
 	logger := session.conf.Logger.WithFields(logrus.Fields{"session": session.token})
 
+	if hook := session.conf.Hooks.SessionRequest; hook != nil {
+		if err := hook(session.token, session.request); err != nil {
+			return nil, session.failWith(hookError(err))
+		}
+	}
+
 	// Handle legacy clients that do not support condiscon, by attempting to convert the condiscon
 	// session request to the legacy session request format
 	legacy, legacyErr := session.request.Legacy()
@@ -70,8 +79,14 @@ func (session *session) handlePostSignature(signature *irma.SignedMessage) (*irm
 	session.result.Signature = signature
 	session.result.Disclosed, session.result.ProofStatus, err = signature.Verify(
 		session.conf.IrmaConfiguration, session.request.(*irma.SignatureRequest))
+	session.recordProofStatus()
 	if err == nil {
-		session.setStatus(server.StatusDone)
+		if rerr = session.checkDisclosure(); rerr != nil {
+			return nil, rerr
+		}
+		if rerr = session.finish(); rerr != nil {
+			return nil, rerr
+		}
 	} else {
 		if err == irma.ErrorMissingPublicKey {
 			rerr = session.fail(server.ErrorUnknownPublicKey, err.Error())
@@ -92,8 +107,14 @@ func (session *session) handlePostDisclosure(disclosure *irma.Disclosure) (*irma
 	var rerr *irma.RemoteError
 	session.result.Disclosed, session.result.ProofStatus, err = disclosure.Verify(
 		session.conf.IrmaConfiguration, session.request.(*irma.DisclosureRequest))
+	session.recordProofStatus()
 	if err == nil {
-		session.setStatus(server.StatusDone)
+		if rerr = session.checkDisclosure(); rerr != nil {
+			return nil, rerr
+		}
+		if rerr = session.finish(); rerr != nil {
+			return nil, rerr
+		}
 	} else {
 		if err == irma.ErrorMissingPublicKey {
 			rerr = session.fail(server.ErrorUnknownPublicKey, err.Error())
@@ -104,6 +125,18 @@ func (session *session) handlePostDisclosure(disclosure *irma.Disclosure) (*irma
 	return &session.result.ProofStatus, rerr
 }
 
+// checkDisclosure lets the disclosure hook, if any, veto the verified disclosure of the session.
+func (session *session) checkDisclosure() *irma.RemoteError {
+	hook := session.conf.Hooks.Disclosure
+	if hook == nil || session.result.ProofStatus != irma.ProofStatusValid {
+		return nil
+	}
+	if err := hook(session.result); err != nil {
+		return session.failWith(hookError(err))
+	}
+	return nil
+}
+
 func (session *session) handlePostCommitments(commitments *irma.IssueCommitmentMessage) ([]*gabi.IssueSignatureMessage, *irma.RemoteError) {
 	if session.status != server.StatusConnected {
 		return nil, server.RemoteError(server.ErrorUnexpectedRequest, "Session not yet started or already finished")
@@ -145,6 +178,7 @@ func (session *session) handlePostCommitments(commitments *irma.IssueCommitmentM
 	// Verify all proofs and check disclosed attributes, if any, against request
 	session.result.Disclosed, session.result.ProofStatus, err = commitments.Disclosure().VerifyAgainstDisjunctions(
 		session.conf.IrmaConfiguration, request.Disclose, request.GetContext(), request.GetNonce(nil), pubkeys, false)
+	session.recordProofStatus()
 	if err != nil {
 		if err == irma.ErrorMissingPublicKey {
 			return nil, session.fail(server.ErrorUnknownPublicKey, "")
@@ -158,6 +192,11 @@ func (session *session) handlePostCommitments(commitments *irma.IssueCommitmentM
 	if session.result.ProofStatus != irma.ProofStatusValid {
 		return nil, session.fail(server.ErrorInvalidProofs, "")
 	}
+	if request.Dynamic {
+		if rerr := session.computeCredentials(request); rerr != nil {
+			return nil, rerr
+		}
+	}
 
 	// Compute CL signatures
 	var sigs []*gabi.IssueSignatureMessage
@@ -181,6 +220,114 @@ func (session *session) handlePostCommitments(commitments *irma.IssueCommitmentM
 		sigs = append(sigs, sig)
 	}
 
-	session.setStatus(server.StatusDone)
+	if rerr := session.finish(); rerr != nil {
+		return nil, rerr
+	}
 	return sigs, nil
 }
+
+// computeCredentials replaces the credentials of the dynamic issuance request by those computed
+// from the attributes disclosed in the session. As computing them may take a while, the session
+// is unlocked meanwhile, like when starting the follow-up session.
+func (session *session) computeCredentials(request *irma.IssuanceRequest) *irma.RemoteError {
+	if session.handlers.Credentials == nil {
+		// The session was restored from the session store without its handlers
+		_ = server.LogError(errors.Errorf("No handler to compute dynamic credentials of session %s", session.token))
+		return session.fail(server.ErrorIssuanceFailed, "failed to compute credentials")
+	}
+	var (
+		creds []*irma.CredentialRequest
+		err   error
+	)
+	result := *session.result
+	session.unlocked(func() {
+		creds, err = session.handlers.Credentials(&result, request)
+	})
+	if session.status != server.StatusConnected {
+		return server.RemoteError(server.ErrorUnexpectedRequest, "Session cancelled while computing credentials")
+	}
+	if err != nil {
+		_ = server.LogError(errors.WrapPrefix(err, "Failed to compute dynamic credentials", 0))
+		return session.fail(server.ErrorIssuanceFailed, "failed to compute credentials")
+	}
+	if err = request.CheckDynamicCredentials(creds); err != nil {
+		return session.fail(server.ErrorIssuanceFailed, err.Error())
+	}
+	for _, cred := range creds {
+		if cred.Validity.Before(irma.Timestamp(time.Now())) {
+			return session.fail(server.ErrorIssuanceFailed, "cannot issue expired credentials")
+		}
+	}
+	request.Credentials = creds
+	return nil
+}
+
+// finalResponse returns the response to the proofs or commitments with which the client finishes
+// the session: before protocol version 2.6 the proof status or the issuance signatures, and
+// from 2.6 onwards a ServerSessionResponse, including the follow-up session if there is one.
+func (session *session) finalResponse(sigs []*gabi.IssueSignatureMessage, rerr *irma.RemoteError) (int, []byte) {
+	if rerr != nil {
+		return server.JsonResponse(nil, rerr)
+	}
+	if session.version.Below(2, 6) {
+		if session.action == irma.ActionIssuing {
+			return server.JsonResponse(sigs, nil)
+		}
+		return server.JsonResponse(session.result.ProofStatus, nil)
+	}
+	return server.JsonResponse(&irma.ServerSessionResponse{
+		ProofStatus:     session.result.ProofStatus,
+		IssueSignatures: sigs,
+		NextSession:     session.next,
+		Credentials:     session.dynamicCredentials(),
+	}, nil)
+}
+
+// dynamicCredentials returns the credentials issued in dynamic issuance sessions.
+func (session *session) dynamicCredentials() []*irma.CredentialRequest {
+	if ir, ok := session.request.(*irma.IssuanceRequest); ok && ir.Dynamic {
+		return ir.Credentials
+	}
+	return nil
+}
+
+// finish starts the follow-up session, if any, and then marks the session as done, so that
+// once it is done its result includes the follow-up session.
+func (session *session) finish() *irma.RemoteError {
+	session.next = session.nextSession()
+	if session.status != server.StatusConnected {
+		return server.RemoteError(server.ErrorUnexpectedRequest, "Session cancelled while finishing")
+	}
+	session.setStatus(server.StatusDone)
+	return nil
+}
+
+// nextSession starts the follow-up session if the session has one and is finishing successfully,
+// returning its session pointer. As starting it may take a while, the session is unlocked
+// meanwhile; the handler is passed the session result as it will be once the session is done.
+func (session *session) nextSession() *irma.Qr {
+	if session.handlers.Next == nil || session.result.ProofStatus != irma.ProofStatusValid || session.version.Below(2, 6) {
+		return nil
+	}
+	logger := session.conf.Logger.WithFields(logrus.Fields{"session": session.token})
+	result := *session.result
+	result.Status = server.StatusDone
+	var (
+		qr    *irma.Qr
+		token string
+		err   error
+	)
+	session.unlocked(func() {
+		qr, token, err = session.handlers.Next(&result)
+	})
+	if err != nil {
+		logger.Error(errors.WrapPrefix(err, "Failed to start follow-up session", 0))
+		return nil
+	}
+	if qr == nil || session.status != server.StatusConnected {
+		return nil
+	}
+	logger.WithFields(logrus.Fields{"next": token}).Info("Continuing into follow-up session")
+	session.result.NextSession = token
+	return qr
+}
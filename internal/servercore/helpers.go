@@ -4,13 +4,17 @@ import (
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/go-errors/errors"
 	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
 	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/server"
 	"github.com/sirupsen/logrus"
@@ -19,6 +23,8 @@ import (
 
 // Session helpers
 
+// markAlive records that the session is active. This is written to the session store only along
+// with the next change of the session, which the callers of markAlive make.
 func (session *session) markAlive() {
 	session.lastActive = time.Now()
 	session.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Debugf("Session marked active, expiry delayed")
@@ -27,9 +33,20 @@ func (session *session) markAlive() {
 func (session *session) setStatus(status server.Status) {
 	session.conf.Logger.WithFields(logrus.Fields{"session": session.token, "prevStatus": session.prevStatus, "status": status}).
 		Info("Session status updated")
+	finished := status.Finished() && !session.status.Finished()
+	if finished {
+		metricSessionsFinished.Inc(string(session.action), session.requestor, string(status))
+		metricSessionDuration.Observe(time.Since(session.created).Seconds(), string(session.action), string(status))
+	}
 	session.status = status
 	session.result.Status = status
 	session.sessions.update(session)
+	session.sessions.statusChanged(session)
+	session.onUpdate()
+	if handler := session.handlers.Finished; finished && handler != nil {
+		result := *session.result
+		go handler(&result)
+	}
 }
 
 func (session *session) onUpdate() {
@@ -39,15 +56,65 @@ func (session *session) onUpdate() {
 		// We send JSON like the other APIs, so quote
 		session.evtSource.SendEventMessage(fmt.Sprintf(`"%s"`, session.status), "", "")
 	}
+	for _, listener := range session.listeners {
+		// Replace any status the listener has not yet received, so that it always gets the latest
+		select {
+		case <-listener:
+		default:
+		}
+		listener <- session.status
+	}
+}
+
+// addStatusListener returns a channel on which the status of the session is sent whenever it
+// changes. The caller must hold the session lock.
+func (session *session) addStatusListener() chan server.Status {
+	listener := make(chan server.Status, 1)
+	session.listeners = append(session.listeners, listener)
+	return listener
+}
+
+// removeStatusListener stops the channel from receiving status updates. The caller must hold
+// the session lock.
+func (session *session) removeStatusListener(listener chan server.Status) {
+	for i, l := range session.listeners {
+		if l == listener {
+			session.listeners = append(session.listeners[:i], session.listeners[i+1:]...)
+			return
+		}
+	}
 }
 
 func (session *session) fail(err server.Error, message string) *irma.RemoteError {
-	rerr := server.RemoteError(err, message)
+	return session.failWith(server.RemoteError(err, message))
+}
+
+// failWith cancels the session with the specified error.
+func (session *session) failWith(rerr *irma.RemoteError) *irma.RemoteError {
+	if !session.status.Finished() {
+		metricSessionsFailed.Inc(string(session.action), session.requestor, rerr.ErrorName)
+	}
 	session.setStatus(server.StatusCancelled)
 	session.result = &server.SessionResult{Err: rerr, Token: session.token, Status: server.StatusCancelled, Type: session.action}
 	return rerr
 }
 
+// hookError converts the error returned by a hook to the error to be passed on.
+func hookError(err error) *irma.RemoteError {
+	if rerr, ok := err.(*irma.RemoteError); ok {
+		return rerr
+	}
+	return server.RemoteError(server.ErrorRejected, err.Error())
+}
+
+// recordProofStatus counts the proof status of the session result in the metrics if the proofs
+// were not valid.
+func (session *session) recordProofStatus() {
+	if status := session.result.ProofStatus; status != "" && status != irma.ProofStatusValid {
+		metricProofFailures.Inc(string(status))
+	}
+}
+
 const retryTimeLimit = 10 * time.Second
 
 // checkCache returns a previously cached response, for replaying against multiple requests from
@@ -60,6 +127,7 @@ func (session *session) checkCache(message []byte, expectedStatus server.Status)
 		if session.responseCache.sessionStatus != expectedStatus {
 			// don't replay a cache value that was set in a previous session state
 			session.responseCache = responseCache{}
+			session.dirty = true
 			return 0, nil
 		}
 		if sha256.Sum256(session.responseCache.message) != sha256.Sum256(message) ||
@@ -72,6 +140,12 @@ func (session *session) checkCache(message []byte, expectedStatus server.Status)
 	return 0, nil
 }
 
+// cacheResponse caches the response to the message, for replaying by checkCache().
+func (session *session) cacheResponse(message, response []byte, status int, sessionStatus server.Status) {
+	session.responseCache = responseCache{message: message, response: response, status: status, sessionStatus: sessionStatus}
+	session.dirty = true
+}
+
 // Issuance helpers
 
 func (s *Server) validateIssuanceRequest(request *irma.IssuanceRequest) error {
@@ -147,6 +221,74 @@ func (session *session) eventSource() eventsource.EventSource {
 	return session.evtSource
 }
 
+// info returns information about the session for server administrators, including its request
+// without attribute values if withRequest is true. The caller must hold the session lock.
+func (session *session) info(withRequest bool) *server.SessionInfo {
+	info := &server.SessionInfo{
+		Token:           session.token,
+		Tenant:          session.tenant,
+		Requestor:       session.requestor,
+		Type:            session.action,
+		Status:          session.status,
+		Created:         session.created,
+		Age:             int64(time.Since(session.created).Seconds()),
+		ProtocolVersion: session.version,
+	}
+	if withRequest {
+		info.Request = purgeRequest(session.rrequest)
+	}
+	return info
+}
+
+// Issuer private keys
+
+// privateKeyFiles lists the private key files in the issuer private keys path, as well as the
+// files in it that were skipped because they are not private keys.
+func (s *Server) privateKeyFiles() (files []string, skipped []string, err error) {
+	infos, err := ioutil.ReadDir(s.conf.IssuerPrivateKeysPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, info := range infos {
+		filename := info.Name()
+		if filepath.Ext(filename) != ".xml" || filename[0] == '.' || strings.Count(filename, ".") != 2 {
+			skipped = append(skipped, filename)
+			continue
+		}
+		files = append(files, filename)
+	}
+	return
+}
+
+// readPrivateKey reads the private key from the specified file in the issuer private keys path.
+// The issuer identifier is returned also if reading the key fails.
+func (s *Server) readPrivateKey(filename string) (irma.IssuerIdentifier, *gabi.PrivateKey, error) {
+	issid := irma.NewIssuerIdentifier(strings.TrimSuffix(filename, filepath.Ext(filename))) // strip .xml
+	if _, ok := s.conf.IrmaConfiguration.Issuers[issid]; !ok {
+		return issid, nil, errors.Errorf("Private key %s belongs to an unknown issuer", filename)
+	}
+	sk, err := gabi.NewPrivateKeyFromFile(filepath.Join(s.conf.IssuerPrivateKeysPath, filename))
+	if err != nil {
+		return issid, nil, err
+	}
+	return issid, sk, nil
+}
+
+// checkPrivateKey checks that the private key belongs to a known public key of the issuer.
+func (s *Server) checkPrivateKey(issid irma.IssuerIdentifier, sk *gabi.PrivateKey) error {
+	pk, err := s.conf.IrmaConfiguration.PublicKey(issid, int(sk.Counter))
+	if err != nil {
+		return err
+	}
+	if pk == nil {
+		return errors.Errorf("Missing public key belonging to private key %s-%d", issid.String(), sk.Counter)
+	}
+	if new(big.Int).Mul(sk.P, sk.Q).Cmp(pk.N) != 0 {
+		return errors.Errorf("Private key %s-%d does not belong to corresponding public key", issid.String(), sk.Counter)
+	}
+	return nil
+}
+
 // Other
 
 func (session *session) chooseProtocolVersion(minClient, maxClient *irma.ProtocolVersion) (*irma.ProtocolVersion, error) {
@@ -155,15 +297,20 @@ func (session *session) chooseProtocolVersion(minClient, maxClient *irma.Protoco
 	if !session.legacyCompatible {
 		minServer = &irma.ProtocolVersion{2, 5}
 	}
+	// Dynamic issuance requires the client to accept the credentials computed by the issuer
+	if ir, ok := session.request.(*irma.IssuanceRequest); ok && ir.Dynamic {
+		minServer = irma.NewVersion(2, 7)
+	}
 
 	if minClient.AboveVersion(maxProtocolVersion) || maxClient.BelowVersion(minServer) || maxClient.BelowVersion(minClient) {
 		return nil, server.LogWarning(errors.Errorf("Protocol version negotiation failed, min=%s max=%s minServer=%s maxServer=%s", minClient.String(), maxClient.String(), minServer.String(), maxProtocolVersion.String()))
 	}
+	version := maxClient
 	if maxClient.AboveVersion(maxProtocolVersion) {
-		return maxProtocolVersion, nil
-	} else {
-		return maxClient, nil
+		version = maxProtocolVersion
 	}
+	metricProtocolVersions.Inc(version.String())
+	return version, nil
 }
 
 // purgeRequest logs the request excluding any attribute values.
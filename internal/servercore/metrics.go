@@ -0,0 +1,20 @@
+package servercore
+
+import "github.com/privacybydesign/irmago/internal/metrics"
+
+var (
+	metricSessionsStarted = metrics.NewCounterVec("irma_sessions_started_total",
+		"Number of sessions started.", "action", "requestor")
+	metricSessionsFinished = metrics.NewCounterVec("irma_sessions_finished_total",
+		"Number of sessions that finished, by final status.", "action", "requestor", "status")
+	metricSessionsFailed = metrics.NewCounterVec("irma_sessions_failed_total",
+		"Number of sessions that were aborted due to an error.", "action", "requestor", "error")
+	metricSessionDuration = metrics.NewHistogramVec("irma_session_duration_seconds",
+		"Time from the start of a session until it finished.", metrics.DefaultDurationBuckets, "action", "status")
+	metricProtocolVersions = metrics.NewCounterVec("irma_protocol_versions_total",
+		"Number of sessions per negotiated protocol version.", "version")
+	metricProofFailures = metrics.NewCounterVec("irma_proof_verification_failures_total",
+		"Number of received proofs that were not valid, by proof status.", "status")
+	metricSchemeUpdates = metrics.NewCounterVec("irma_scheme_updates_total",
+		"Number of scheme update attempts, by outcome.", "scheme", "outcome")
+)
@@ -2,9 +2,12 @@ package servercore
 
 import (
 	"crypto/rand"
+	"encoding/json"
+	"io"
 	"sync"
 	"time"
 
+	"github.com/go-errors/errors"
 	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/gabi/big"
 	"github.com/privacybydesign/irmago"
@@ -14,11 +17,15 @@ import (
 )
 
 type session struct {
-	sync.Mutex
+	mutex       sync.Mutex
+	unlockStore func()        // releases the lock on the session in the session store
+	busy        chan struct{} // set while the session is busy, see unlocked()
 
 	action           irma.Action
 	token            string
 	clientToken      string
+	tenant           string
+	requestor        string
 	version          *irma.ProtocolVersion
 	rrequest         irma.RequestorRequest
 	request          irma.SessionRequest
@@ -27,15 +34,25 @@ type session struct {
 	status        server.Status
 	prevStatus    server.Status
 	evtSource     eventsource.EventSource
+	listeners     []chan server.Status // notified of status updates, for long-polling and WebSockets
 	responseCache responseCache
 
+	created    time.Time
 	lastActive time.Time
 	result     *server.SessionResult
 
 	kssProofs map[irma.SchemeManagerIdentifier]*gabi.ProofP
+	next      *irma.Qr // follow-up session started while finishing the session, for the final response
+
+	// Functions of the starter of the session (not kept in the session store)
+	handlers SessionHandlers
+	restored bool // whether the session was started elsewhere, so that handlers is not set by its starter
+	revision int  // revision of the session in the session store that the session is up to date with
+	dirty    bool // whether the session changed since it was last written to the session store
+	open     bool // whether the session is counted as unfinished by the sessionStore, guarded by its lock
 
 	conf     *server.Configuration
-	sessions sessionStore
+	sessions *sessionStore
 }
 
 type responseCache struct {
@@ -45,109 +62,600 @@ type responseCache struct {
 	sessionStatus server.Status
 }
 
-type sessionStore interface {
-	get(token string) *session
-	clientGet(token string) *session
-	add(session *session)
-	update(session *session)
-	deleteExpired()
-	stop()
+// sessionStore keeps the sessions of a Server and the servers of its tenants in a
+// server.SessionStore. It also keeps the sessions that it has handled in memory, along with
+// their state that is not kept in the server.SessionStore, such as their status listeners.
+type sessionStore struct {
+	sync.Mutex
+	store   server.SessionStore
+	closer  io.Closer          // closes the store, if it is not provided by the configuration
+	servers map[string]*Server // key: tenant
+	local   map[string]*session
+	open    map[requestorKey]int // number of sessions in local that have not finished
+	logger  *logrus.Logger
 }
 
-type memorySessionStore struct {
-	sync.RWMutex
-	conf *server.Configuration
-
-	requestor map[string]*session
-	client    map[string]*session
+type requestorKey struct {
+	tenant, requestor string
 }
 
 const (
-	maxSessionLifetime = 5 * time.Minute // After this a session is cancelled
-	sessionChars       = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	SessionStoreMemory = "memory" // Keep sessions in memory only (default)
+	SessionStoreBolt   = "bolt"   // Additionally persist sessions to disk using bbolt
+)
+
+const (
+	defaultSessionTimeout    = 300  // Default for the client timeout, session lifetime and result lifetime, in seconds
+	defaultMaxSessionTimeout = 3600 // Default maximum that requestors may specify for these, in seconds
+	defaultLongPollTimeout   = 30   // Default maximum duration of long-polling status requests, in seconds
+	sessionChars             = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 )
 
 var (
 	minProtocolVersion = irma.NewVersion(2, 4)
-	maxProtocolVersion = irma.NewVersion(2, 5)
+	maxProtocolVersion = irma.NewVersion(2, 7)
 )
 
-func (s *memorySessionStore) get(t string) *session {
-	s.RLock()
-	defer s.RUnlock()
-	return s.requestor[t]
+func newSessionStore(conf *server.Configuration) (*sessionStore, error) {
+	s := &sessionStore{
+		servers: map[string]*Server{},
+		local:   map[string]*session{},
+		open:    map[requestorKey]int{},
+		logger:  conf.Logger,
+	}
+	switch {
+	case conf.CustomSessionStore != nil:
+		s.store = conf.CustomSessionStore
+	case conf.SessionStore == "" || conf.SessionStore == SessionStoreMemory:
+		s.store = newMemorySessionStore()
+	case conf.SessionStore == SessionStoreBolt:
+		store, err := newBoltSessionStore(conf)
+		if err != nil {
+			return nil, err
+		}
+		s.store, s.closer = store, store
+	default:
+		return nil, errors.Errorf("Unknown session store %s (supported: %s, %s)", conf.SessionStore, SessionStoreMemory, SessionStoreBolt)
+	}
+	return s, nil
+}
+
+// register makes the sessions of the tenant of the server known to the store.
+func (s *sessionStore) register(serv *Server) {
+	s.Lock()
+	defer s.Unlock()
+	s.servers[serv.tenant] = serv
+	// Forget sessions of the tenant that were loaded before it was registered, so that they are
+	// loaded again using the configuration and handlers of the tenant
+	for token, session := range s.local {
+		if session.tenant == serv.tenant && serv.tenant != "" {
+			delete(s.local, token)
+			s.count(session, false)
+		}
+	}
+}
+
+// setRestoredHandlers sets the function providing the handlers of sessions of the tenant of the
+// server that were not started by this server, and applies it to those that are already loaded.
+func (s *sessionStore) setRestoredHandlers(serv *Server, f RestoredHandlers) {
+	s.Lock()
+	serv.restoredHandlers = f
+	s.Unlock()
+	for _, session := range s.loaded() {
+		session.mutex.Lock()
+		if session.restored && session.tenant == serv.tenant {
+			session.handlers = f(session.requestor)
+		}
+		session.mutex.Unlock()
+	}
+}
+
+// get returns the session with the specified requestor token, or nil if there is none.
+func (s *sessionStore) get(token string) *session {
+	data, err := s.store.Get(token)
+	if err != nil {
+		_ = server.LogError(errors.WrapPrefix(err, "failed to get session from session store", 0))
+		return nil
+	}
+	return s.session(token, data)
+}
+
+// clientGet returns the session with the specified client token, or nil if there is none.
+func (s *sessionStore) clientGet(clientToken string) *session {
+	data, err := s.store.ClientGet(clientToken)
+	if err != nil {
+		_ = server.LogError(errors.WrapPrefix(err, "failed to get session from session store", 0))
+		return nil
+	}
+	if data == nil {
+		return nil
+	}
+	return s.session(data.Token, data)
 }
 
-func (s *memorySessionStore) clientGet(t string) *session {
-	s.RLock()
-	defer s.RUnlock()
-	return s.client[t]
+// session returns the in-memory session of the specified session data, loading it if necessary.
+// If data is nil, i.e. the session does not exist (anymore), the in-memory session is forgotten.
+func (s *sessionStore) session(token string, data *server.SessionData) *session {
+	s.Lock()
+	defer s.Unlock()
+	if data == nil {
+		delete(s.local, token)
+		return nil
+	}
+	if session := s.local[token]; session != nil {
+		return session
+	}
+
+	session := &session{restored: true, sessions: s}
+	if err := session.load(data); err != nil {
+		_ = server.LogError(errors.WrapPrefix(err, "failed to load session "+token+" from session store", 0))
+		return nil
+	}
+	// Sessions of unknown tenants are loaded using the configuration of the default tenant, so
+	// that they can expire, but without handlers
+	if serv := s.servers[session.tenant]; serv != nil {
+		session.conf = serv.conf
+		if serv.restoredHandlers != nil {
+			session.handlers = serv.restoredHandlers(session.requestor)
+		}
+	} else {
+		session.conf = s.servers[""].conf
+	}
+	s.local[token] = session
+	s.count(session, true)
+	s.logger.WithFields(logrus.Fields{"session": token, "status": session.status}).Debug("Session loaded from session store")
+	return session
 }
 
-func (s *memorySessionStore) add(session *session) {
+func (s *sessionStore) add(session *session) error {
+	if err := s.store.Add(session.data()); err != nil {
+		return errors.WrapPrefix(err, "failed to add session to session store", 0)
+	}
 	s.Lock()
 	defer s.Unlock()
-	s.requestor[session.token] = session
-	s.client[session.clientToken] = session
+	s.local[session.token] = session
+	s.count(session, true)
+	return nil
 }
 
-func (s *memorySessionStore) update(session *session) {
-	session.onUpdate()
+// count keeps track of the number of unfinished sessions in memory per requestor, after the
+// session is loaded in or removed from memory, or its status changed. The caller must hold the
+// lock of the store, and the session lock if the session is loaded.
+func (s *sessionStore) count(session *session, loaded bool) {
+	open := loaded && !session.status.Finished()
+	if open == session.open {
+		return
+	}
+	session.open = open
+	key := requestorKey{session.tenant, session.requestor}
+	if open {
+		s.open[key]++
+	} else if s.open[key]--; s.open[key] == 0 {
+		delete(s.open, key)
+	}
 }
 
-func (s *memorySessionStore) stop() {
+// statusChanged updates the number of unfinished sessions after the status of the session
+// changed. The caller must hold the session lock.
+func (s *sessionStore) statusChanged(session *session) {
 	s.Lock()
 	defer s.Unlock()
-	for _, session := range s.requestor {
-		if session.evtSource != nil {
-			session.evtSource.Close()
+	if s.local[session.token] == session {
+		s.count(session, true)
+	}
+}
+
+// unfinishedOf returns the number of sessions of the requestor that have not yet finished.
+func (s *sessionStore) unfinishedOf(tenant, requestor string) int {
+	s.Lock()
+	defer s.Unlock()
+	return s.open[requestorKey{tenant, requestor}]
+}
+
+// update writes the state of the session to the store. The caller must hold the session lock.
+func (s *sessionStore) update(session *session) {
+	session.dirty = false
+	session.revision++
+	if err := s.store.Update(session.data()); err != nil {
+		_ = server.LogError(errors.WrapPrefix(err, "failed to update session in session store", 0))
+	}
+}
+
+// lock locks the session in the store, and updates the session if it was changed in the store
+// by another server. It returns the function that unlocks the session in the store.
+func (s *sessionStore) lock(session *session) func() {
+	unlock, err := s.store.Lock(session.token)
+	if err != nil {
+		_ = server.LogError(errors.WrapPrefix(err, "failed to lock session in session store", 0))
+		unlock = func() {}
+	}
+	data, err := s.store.Get(session.token)
+	if err != nil {
+		_ = server.LogError(errors.WrapPrefix(err, "failed to get session from session store", 0))
+		return unlock
+	}
+	if data != nil && data.Revision != session.revision {
+		status := session.status
+		if err = session.load(data); err != nil {
+			_ = server.LogError(errors.WrapPrefix(err, "failed to load session "+session.token+" from session store", 0))
+		} else if session.status != status {
+			s.statusChanged(session)
+			session.onUpdate()
 		}
 	}
+	return unlock
 }
 
-func (s *memorySessionStore) deleteExpired() {
-	// First check which sessions have expired
-	// We don't need a write lock for this yet, so postpone that for actual deleting
-	s.RLock()
-	expired := make([]string, 0, len(s.requestor))
-	for token, session := range s.requestor {
+// list returns all sessions in the store.
+func (s *sessionStore) list() []*session {
+	all, err := s.store.List()
+	if err != nil {
+		_ = server.LogError(errors.WrapPrefix(err, "failed to list sessions in session store", 0))
+		return nil
+	}
+	sessions := make([]*session, 0, len(all))
+	for _, data := range all {
+		if session := s.session(data.Token, data); session != nil {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
+
+// loaded returns the sessions that this server has handled, i.e. that are kept in memory.
+func (s *sessionStore) loaded() []*session {
+	s.Lock()
+	defer s.Unlock()
+	sessions := make([]*session, 0, len(s.local))
+	for _, session := range s.local {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// unfinished returns the number of sessions handled by this server that have not yet finished.
+func (s *sessionStore) unfinished() int {
+	count := 0
+	for _, session := range s.loaded() {
 		session.Lock()
+		if !session.status.Finished() {
+			count++
+		}
+		session.Unlock()
+	}
+	return count
+}
 
-		timeout := maxSessionLifetime
-		if session.status == server.StatusInitialized && session.rrequest.Base().ClientTimeout != 0 {
-			timeout = time.Duration(session.rrequest.Base().ClientTimeout) * time.Second
+// refreshListened updates the sessions having status listeners from the store, notifying the
+// listeners of status changes made by other servers sharing the store.
+func (s *sessionStore) refreshListened() {
+	for _, session := range s.loaded() {
+		session.mutex.Lock()
+		listened := session.evtSource != nil || len(session.listeners) > 0
+		session.mutex.Unlock()
+		if listened {
+			session.Lock()
+			session.Unlock()
 		}
+	}
+}
 
-		if session.lastActive.Add(timeout).Before(time.Now()) {
+// deleteExpired times out sessions that have expired, and deletes expired sessions that have finished.
+func (s *sessionStore) deleteExpired() {
+	all, err := s.store.List()
+	if err != nil {
+		_ = server.LogError(errors.WrapPrefix(err, "failed to list sessions in session store", 0))
+		return
+	}
+	for _, data := range all {
+		session := s.session(data.Token, data)
+		if session == nil {
+			continue
+		}
+		session.Lock()
+		expired := false
+		if session.expiry().Before(time.Now()) {
 			if !session.status.Finished() {
-				s.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Infof("Session expired")
+				s.logger.WithFields(logrus.Fields{"session": session.token}).Infof("Session expired")
 				session.markAlive()
 				session.setStatus(server.StatusTimeout)
 			} else {
-				s.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Infof("Deleting session")
-				expired = append(expired, token)
+				s.logger.WithFields(logrus.Fields{"session": session.token}).Infof("Deleting session")
+				expired = true
 			}
 		}
 		session.Unlock()
+		if expired {
+			s.delete(session)
+		}
+	}
+
+	// Forget sessions that were deleted by other servers sharing the store
+	for _, session := range s.loaded() {
+		if data, err := s.store.Get(session.token); err == nil && data == nil {
+			s.forget(session)
+		}
 	}
-	s.RUnlock()
+}
 
-	// Using a write lock, delete the expired sessions
+// delete deletes the session from the store.
+func (s *sessionStore) delete(session *session) {
+	if err := s.store.Delete(session.token); err != nil {
+		_ = server.LogError(errors.WrapPrefix(err, "failed to delete session from session store", 0))
+		return
+	}
+	s.forget(session)
+}
+
+// forget removes the session from memory.
+func (s *sessionStore) forget(session *session) {
 	s.Lock()
-	for _, token := range expired {
-		session := s.requestor[token]
+	delete(s.local, session.token)
+	s.count(session, false)
+	s.Unlock()
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if session.evtSource != nil {
+		session.evtSource.Close()
+	}
+}
+
+func (s *sessionStore) stop() {
+	for _, session := range s.loaded() {
+		session.mutex.Lock()
 		if session.evtSource != nil {
 			session.evtSource.Close()
 		}
-		delete(s.client, session.clientToken)
+		session.mutex.Unlock()
+	}
+	if s.closer != nil {
+		if err := s.closer.Close(); err != nil {
+			_ = server.LogError(errors.WrapPrefix(err, "failed to close session store", 0))
+		}
+	}
+}
+
+// Lock locks the session, both in memory and in the session store, bringing it up to date with
+// the session store. While the session is busy, this server keeps it locked in the session store
+// and it is up to date already, so then it is only locked in memory.
+func (session *session) Lock() {
+	session.mutex.Lock()
+	if session.busy == nil {
+		session.unlockStore = session.sessions.lock(session)
+	}
+}
+
+// Unlock unlocks the session.
+func (session *session) Unlock() {
+	if session.busy == nil {
+		unlock := session.unlockStore
+		session.unlockStore = nil
+		unlock()
+	}
+	session.mutex.Unlock()
+}
+
+// unlocked runs f with the session unlocked in memory, so that handlers of the starter of the
+// session that may take a while (e.g. because they make HTTP requests) do not block status
+// requests, and may themselves call functions of the server concerning the session. Meanwhile
+// the session is busy: requests of the client other than status requests wait until f has
+// returned (see awaitIdle()), and other servers sharing the session store wait as well.
+// As the session may have been cancelled in the meantime, callers must check its status afterwards.
+func (session *session) unlocked(f func()) {
+	busy := make(chan struct{})
+	session.busy = busy
+	session.mutex.Unlock()
+	defer func() {
+		session.mutex.Lock()
+		session.busy = nil
+		close(busy)
+	}()
+	f()
+}
+
+// awaitIdle waits until the locked session is no longer busy, see unlocked().
+func (session *session) awaitIdle() {
+	for session.busy != nil {
+		busy := session.busy
+		session.mutex.Unlock()
+		<-busy
+		session.Lock()
+	}
+}
+
+// data returns the state of the session to be kept in the session store.
+func (session *session) data() *server.SessionData {
+	rrequest, _ := json.Marshal(session.rrequest) // can't fail, the request was parsed from JSON
+	data := &server.SessionData{
+		Action:           session.action,
+		Token:            session.token,
+		ClientToken:      session.clientToken,
+		Tenant:           session.tenant,
+		Requestor:        session.requestor,
+		Version:          session.version,
+		Rrequest:         rrequest,
+		LegacyCompatible: session.legacyCompatible,
+		LegacySession:    session.result.LegacySession,
+		Status:           session.status,
+		PrevStatus:       session.prevStatus,
+		Created:          session.created,
+		LastActive:       session.lastActive,
+		Result:           session.result,
+		KssProofs:        session.kssProofs,
+		Revision:         session.revision,
+	}
+	data.ResponseCache.Message = session.responseCache.message
+	data.ResponseCache.Response = session.responseCache.response
+	data.ResponseCache.Status = session.responseCache.status
+	data.ResponseCache.SessionStatus = session.responseCache.sessionStatus
+	return data
+}
+
+// load replaces the state of the session by the state kept in the session store.
+func (session *session) load(data *server.SessionData) error {
+	rrequest, err := parseRequestorRequest(data.Action, data.Rrequest)
+	if err != nil {
+		return err
+	}
+	if data.Result == nil {
+		return errors.Errorf("stored session %s has no result", data.Token)
+	}
+	data.Result.LegacySession = data.LegacySession
+
+	session.action = data.Action
+	session.token = data.Token
+	session.clientToken = data.ClientToken
+	session.tenant = data.Tenant
+	session.requestor = data.Requestor
+	session.version = data.Version
+	session.rrequest = rrequest
+	session.request = rrequest.SessionRequest()
+	session.legacyCompatible = data.LegacyCompatible
+	session.status = data.Status
+	session.prevStatus = data.PrevStatus
+	session.responseCache = responseCache{
+		message:       data.ResponseCache.Message,
+		response:      data.ResponseCache.Response,
+		status:        data.ResponseCache.Status,
+		sessionStatus: data.ResponseCache.SessionStatus,
+	}
+	session.created = data.Created
+	session.lastActive = data.LastActive
+	session.result = data.Result
+	session.kssProofs = data.KssProofs
+	session.revision = data.Revision
+	return nil
+}
+
+// parseRequestorRequest unmarshals a requestor request of the specified session type.
+func parseRequestorRequest(action irma.Action, bts []byte) (irma.RequestorRequest, error) {
+	var rrequest irma.RequestorRequest
+	switch action {
+	case irma.ActionDisclosing:
+		rrequest = &irma.ServiceProviderRequest{}
+	case irma.ActionSigning:
+		rrequest = &irma.SignatureRequestorRequest{}
+	case irma.ActionIssuing:
+		rrequest = &irma.IdentityProviderRequest{}
+	default:
+		return nil, errors.Errorf("unknown session type %s", action)
+	}
+	if err := json.Unmarshal(bts, rrequest); err != nil {
+		return nil, err
+	}
+	return rrequest, nil
+}
+
+// memorySessionStore is a server.SessionStore that keeps sessions in memory only.
+type memorySessionStore struct {
+	mutex     sync.RWMutex
+	requestor map[string]*server.SessionData
+	client    map[string]string // client token to requestor token
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{
+		requestor: make(map[string]*server.SessionData),
+		client:    make(map[string]string),
+	}
+}
+
+func (s *memorySessionStore) Add(session *server.SessionData) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.requestor[session.Token] = session
+	s.client[session.ClientToken] = session.Token
+	return nil
+}
+
+func (s *memorySessionStore) Get(token string) (*server.SessionData, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.requestor[token], nil
+}
+
+func (s *memorySessionStore) ClientGet(clientToken string) (*server.SessionData, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.requestor[s.client[clientToken]], nil
+}
+
+func (s *memorySessionStore) Update(session *server.SessionData) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.requestor[session.Token]; ok {
+		s.requestor[session.Token] = session
+	}
+	return nil
+}
+
+func (s *memorySessionStore) Delete(token string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if session := s.requestor[token]; session != nil {
+		delete(s.client, session.ClientToken)
 		delete(s.requestor, token)
 	}
-	s.Unlock()
+	return nil
+}
+
+func (s *memorySessionStore) List() ([]*server.SessionData, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	sessions := make([]*server.SessionData, 0, len(s.requestor))
+	for _, session := range s.requestor {
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+// Lock does nothing, as the server locks its sessions itself and the store is not shared.
+func (s *memorySessionStore) Lock(token string) (func(), error) {
+	return func() {}, nil
+}
+
+// pointer returns the session pointer with which the IRMA app can start the session.
+func (session *session) pointer() *irma.Qr {
+	return &irma.Qr{
+		Type: session.action,
+		URL:  session.conf.URL + "session/" + session.clientToken,
+	}
+}
+
+// expiry returns when the session in its current status expires. Unfinished sessions time out
+// once their lifetime since they were created has passed, or before that if the client does not
+// connect in time. After the session has finished, its result is kept for the result lifetime.
+// The requestor may override each of these in its request, up to the maximum allowed by the
+// server configuration.
+func (session *session) expiry() time.Time {
+	base := session.rrequest.Base()
+	conf := session.conf
+	if session.status.Finished() {
+		return session.lastActive.Add(sessionDuration(base.ResultLifetime, conf.ResultLifetime, conf.MaxResultLifetime))
+	}
+	expiry := session.created.Add(sessionDuration(base.SessionLifetime, conf.SessionLifetime, conf.MaxSessionLifetime))
+	if session.status == server.StatusInitialized {
+		if timeout := session.lastActive.Add(sessionDuration(base.ClientTimeout, conf.ClientTimeout, conf.MaxClientTimeout)); timeout.Before(expiry) {
+			return timeout
+		}
+	}
+	return expiry
+}
+
+func sessionDuration(requested, def, max int) time.Duration {
+	seconds := def
+	if requested != 0 {
+		seconds = requested
+	}
+	if seconds > max {
+		seconds = max
+	}
+	return time.Duration(seconds) * time.Second
 }
 
 var one *big.Int = big.NewInt(1)
 
-func (s *Server) newSession(action irma.Action, request irma.RequestorRequest) *session {
+func (s *Server) newSession(action irma.Action, request irma.RequestorRequest, requestor string, handlers SessionHandlers) (*session, error) {
 	token := newSessionToken()
 	clientToken := newSessionToken()
 
@@ -155,9 +663,13 @@ func (s *Server) newSession(action irma.Action, request irma.RequestorRequest) *
 		action:      action,
 		rrequest:    request,
 		request:     request.SessionRequest(),
+		created:     time.Now(),
 		lastActive:  time.Now(),
 		token:       token,
 		clientToken: clientToken,
+		tenant:      s.tenant,
+		requestor:   requestor,
+		handlers:    handlers,
 		status:      server.StatusInitialized,
 		prevStatus:  server.StatusInitialized,
 		conf:        s.conf,
@@ -174,9 +686,11 @@ func (s *Server) newSession(action irma.Action, request irma.RequestorRequest) *
 	nonce, _ := gabi.RandomBigInt(gabi.DefaultSystemParameters[2048].Lstatzk)
 	ses.request.Base().Nonce = nonce
 	ses.request.Base().Context = one
-	s.sessions.add(ses)
+	if err := s.sessions.add(ses); err != nil {
+		return nil, err
+	}
 
-	return ses
+	return ses, nil
 }
 
 func newSessionToken() string {
@@ -0,0 +1,68 @@
+package servercore
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/privacybydesign/irmago/server"
+)
+
+const (
+	webSocketWriteTimeout     = 10 * time.Second
+	webSocketKeepAliveTimeout = 30 * time.Second
+	webSocketMaxMessageSize   = 4096
+)
+
+// webSocketUpgrader returns the upgrader of status WebSockets, which accepts connections from
+// browsers only from the same origin, or from one of the origins allowed by the configuration.
+func webSocketUpgrader(conf *server.Configuration) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			if origin == "" { // not a browser
+				return true
+			}
+			for _, allowed := range conf.WebSocketOrigins {
+				if allowed == "*" || strings.EqualFold(allowed, origin) {
+					return true
+				}
+			}
+			u, err := url.Parse(origin)
+			return err == nil && strings.EqualFold(u.Host, r.Host)
+		},
+	}
+}
+
+// readWebSocket reads the messages sent by the client, only so that pings and closes are
+// answered, until the connection is closed or breaks. It returns a channel that is then closed.
+func readWebSocket(conn *websocket.Conn) chan struct{} {
+	closed := make(chan struct{})
+	conn.SetReadLimit(webSocketMaxMessageSize)
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+	return closed
+}
+
+// writeWebSocket sends a message of the specified type.
+func writeWebSocket(conn *websocket.Conn, messageType int, data []byte) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(webSocketWriteTimeout)); err != nil {
+		return err
+	}
+	return conn.WriteMessage(messageType, data)
+}
+
+// closeWebSocket sends a close message with the specified status code and closes the connection.
+func closeWebSocket(conn *websocket.Conn, code int) {
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""),
+		time.Now().Add(webSocketWriteTimeout))
+	_ = conn.Close()
+}
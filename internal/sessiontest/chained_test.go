@@ -0,0 +1,154 @@
+package sessiontest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/irmaclient"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/irmaserver"
+	"github.com/privacybydesign/irmago/server/requestorserver"
+	"github.com/stretchr/testify/require"
+)
+
+// chainedNameIssuanceRequest returns an issuance request of a fullName credential whose first
+// name is the studentID disclosed in the session result.
+func chainedNameIssuanceRequest(t *testing.T, result *server.SessionResult) *irma.IssuanceRequest {
+	require.Equal(t, irma.ActionDisclosing, result.Type)
+	require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+	request := getNameIssuanceRequest()
+	request.Credentials[0].Attributes["firstname"] = *result.Disclosed[0][0].RawValue
+	return request
+}
+
+func checkChainedCredential(t *testing.T, client *irmaclient.Client) {
+	firstname := irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.firstname")
+	for _, cred := range client.CredentialInfoList() {
+		if cred.SchemeManagerID == "irma-demo" && cred.IssuerID == "MijnOverheid" && cred.ID == "fullName" {
+			require.Equal(t, "s1234567", cred.Attributes[firstname]["en"])
+			return
+		}
+	}
+	t.Fatal("credential issued in follow-up session not found")
+}
+
+func TestChainedSession(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	require.NoError(t, client.RemoveAllCredentials())
+	require.Nil(t, requestorSessionHelper(t, getIssuanceRequest(true), client).Err)
+
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+
+	results := make(chan *server.SessionResult, 2)
+	qr, token, err := irmaServer.StartSessionWithHandlers(
+		irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")),
+		"",
+		irmaserver.SessionHandlers{
+			Result: func(result *server.SessionResult) { results <- result },
+			Next: func(result *server.SessionResult) (interface{}, error) {
+				if result.Type == irma.ActionIssuing {
+					return nil, nil // end of the chain
+				}
+				// The session only becomes DONE once its follow-up session is known
+				require.Equal(t, server.StatusDone, result.Status)
+				require.Equal(t, server.StatusConnected, irmaServer.GetSessionResult(result.Token).Status)
+				return chainedNameIssuanceRequest(t, result), nil
+			},
+		},
+	)
+	require.NoError(t, err)
+
+	c := make(chan *SessionResult)
+	qrjson, err := json.Marshal(qr)
+	require.NoError(t, err)
+	client.NewSession(string(qrjson), &TestHandler{t: t, c: c, client: client})
+	if result := <-c; result != nil {
+		require.NoError(t, result.Err)
+	}
+
+	// Both sessions finished, the first pointing to the second
+	first, second := <-results, <-results
+	if first.Token != token {
+		first, second = second, first
+	}
+	require.Equal(t, server.StatusDone, first.Status)
+	require.Equal(t, second.Token, first.NextSession)
+	require.Equal(t, irma.ActionIssuing, second.Type)
+	require.Equal(t, server.StatusDone, second.Status)
+	require.Empty(t, second.NextSession)
+	checkChainedCredential(t, client)
+}
+
+func TestRequestorServerChainedSession(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	require.NoError(t, client.RemoveAllCredentials())
+	require.Nil(t, requestorSessionHelper(t, getIssuanceRequest(true), client).Err)
+
+	// The requestor's next session endpoint issues a credential containing the disclosed studentID
+	nextSessionServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NotEmpty(t, r.Header.Get(requestorserver.CallbackSignatureHeader))
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		result := &server.SessionResult{}
+		require.NoError(t, json.Unmarshal(body, result))
+		bts, err := json.Marshal(chainedNameIssuanceRequest(t, result))
+		require.NoError(t, err)
+		_, _ = w.Write(bts)
+	}))
+	defer nextSessionServer.Close()
+
+	StartRequestorServer(&requestorserver.Configuration{
+		Configuration: &server.Configuration{
+			URL:                   "http://localhost:48682/irma",
+			Logger:                logger,
+			SchemesPath:           filepath.Join(testdata, "irma_configuration"),
+			IssuerPrivateKeysPath: filepath.Join(testdata, "privatekeys"),
+			DisableSchemesUpdate:  true,
+		},
+		Port:                           48682,
+		DisableRequestorAuthentication: true,
+		CallbackKey:                    "c2VjcmV0IGNhbGxiYWNrIGtleSBvZiB0aGUgcmVxdWVzdG9y",
+		Permissions: requestorserver.Permissions{
+			Disclosing: []string{"irma-demo.RU.studentCard.studentID"},
+			Issuing:    []string{"irma-demo.MijnOverheid.fullName"},
+		},
+	})
+	defer StopRequestorServer()
+
+	request := &irma.ServiceProviderRequest{
+		Request: irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")),
+		RequestorBaseRequest: irma.RequestorBaseRequest{
+			NextSession: &irma.NextSessionData{URL: nextSessionServer.URL},
+		},
+	}
+	transport := irma.NewHTTPTransport("http://localhost:48682")
+	pkg := &server.SessionPackage{}
+	require.NoError(t, transport.Post("session", pkg, request))
+
+	c := make(chan *SessionResult)
+	qrjson, err := json.Marshal(pkg.SessionPtr)
+	require.NoError(t, err)
+	client.NewSession(string(qrjson), &TestHandler{t: t, c: c, client: client})
+	if result := <-c; result != nil {
+		require.NoError(t, result.Err)
+	}
+
+	result := &server.SessionResult{}
+	require.NoError(t, transport.Get("session/"+pkg.Token+"/result", result))
+	require.Equal(t, server.StatusDone, result.Status)
+	require.NotEmpty(t, result.NextSession)
+	next := &server.SessionResult{}
+	require.NoError(t, transport.Get("session/"+result.NextSession+"/result", next))
+	require.Equal(t, server.StatusDone, next.Status)
+	require.Equal(t, irma.ActionIssuing, next.Type)
+	checkChainedCredential(t, client)
+}
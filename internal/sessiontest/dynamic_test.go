@@ -0,0 +1,139 @@
+package sessiontest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/irmaserver"
+	"github.com/privacybydesign/irmago/server/requestorserver"
+	"github.com/stretchr/testify/require"
+)
+
+// getDynamicIssuanceRequest returns a dynamic issuance request of a fullName credential, asking
+// for the studentID from which its attributes are computed.
+func getDynamicIssuanceRequest() *irma.IssuanceRequest {
+	request := getNameIssuanceRequest()
+	request.Credentials[0].Attributes = nil
+	request.Dynamic = true
+	request.AddSingle(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"), nil, nil)
+	return request
+}
+
+// dynamicNameCredentials computes the fullName credential, whose first name is the disclosed studentID.
+func dynamicNameCredentials(t *testing.T, result *server.SessionResult) []*irma.CredentialRequest {
+	require.Equal(t, irma.ActionIssuing, result.Type)
+	require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+	creds := getNameIssuanceRequest().Credentials
+	creds[0].Validity = nil // taken from the request
+	creds[0].Attributes["firstname"] = *result.Disclosed[0][0].RawValue
+	return creds
+}
+
+func TestDynamicIssuanceSession(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	require.NoError(t, client.RemoveAllCredentials())
+	require.Nil(t, requestorSessionHelper(t, getIssuanceRequest(true), client).Err)
+
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+
+	// Dynamic issuance requires a handler computing the credentials
+	_, _, err := irmaServer.StartSession(getDynamicIssuanceRequest(), nil)
+	require.Error(t, err)
+
+	results := make(chan *server.SessionResult, 1)
+	qr, _, err := irmaServer.StartSessionWithHandlers(getDynamicIssuanceRequest(), "", irmaserver.SessionHandlers{
+		Result: func(result *server.SessionResult) { results <- result },
+		Credentials: func(result *server.SessionResult, request *irma.IssuanceRequest) ([]*irma.CredentialRequest, error) {
+			require.True(t, request.Dynamic)
+			// The session is not locked while the credentials are computed
+			require.Equal(t, server.StatusConnected, irmaServer.GetSessionResult(result.Token).Status)
+			return dynamicNameCredentials(t, result), nil
+		},
+	})
+	require.NoError(t, err)
+
+	c := make(chan *SessionResult)
+	qrjson, err := json.Marshal(qr)
+	require.NoError(t, err)
+	client.NewSession(string(qrjson), &TestHandler{t: t, c: c, client: client})
+	if result := <-c; result != nil {
+		require.NoError(t, result.Err)
+	}
+
+	result := <-results
+	require.Equal(t, server.StatusDone, result.Status)
+	checkChainedCredential(t, client)
+}
+
+func TestRequestorServerDynamicIssuanceSession(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	require.NoError(t, client.RemoveAllCredentials())
+	require.Nil(t, requestorSessionHelper(t, getIssuanceRequest(true), client).Err)
+
+	// The requestor's credentials endpoint computes the credential from the disclosed studentID
+	credentialsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NotEmpty(t, r.Header.Get(requestorserver.CallbackSignatureHeader))
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		result := &server.SessionResult{}
+		require.NoError(t, json.Unmarshal(body, result))
+		bts, err := json.Marshal(dynamicNameCredentials(t, result))
+		require.NoError(t, err)
+		_, _ = w.Write(bts)
+	}))
+	defer credentialsServer.Close()
+
+	StartRequestorServer(&requestorserver.Configuration{
+		Configuration: &server.Configuration{
+			URL:                   "http://localhost:48682/irma",
+			Logger:                logger,
+			SchemesPath:           filepath.Join(testdata, "irma_configuration"),
+			IssuerPrivateKeysPath: filepath.Join(testdata, "privatekeys"),
+			DisableSchemesUpdate:  true,
+		},
+		Port:                           48682,
+		DisableRequestorAuthentication: true,
+		CallbackKey:                    "c2VjcmV0IGNhbGxiYWNrIGtleSBvZiB0aGUgcmVxdWVzdG9y",
+		Permissions: requestorserver.Permissions{
+			Disclosing: []string{"irma-demo.RU.studentCard.studentID"},
+			Issuing:    []string{"irma-demo.MijnOverheid.fullName"},
+		},
+	})
+	defer StopRequestorServer()
+
+	transport := irma.NewHTTPTransport("http://localhost:48682")
+	pkg := &server.SessionPackage{}
+
+	// Dynamic issuance requires a credentials URL
+	err := transport.Post("session", pkg, &irma.IdentityProviderRequest{Request: getDynamicIssuanceRequest()})
+	require.Error(t, err)
+
+	request := &irma.IdentityProviderRequest{
+		Request:        getDynamicIssuanceRequest(),
+		CredentialsURL: credentialsServer.URL,
+	}
+	require.NoError(t, transport.Post("session", pkg, request))
+
+	c := make(chan *SessionResult)
+	qrjson, err := json.Marshal(pkg.SessionPtr)
+	require.NoError(t, err)
+	client.NewSession(string(qrjson), &TestHandler{t: t, c: c, client: client})
+	if result := <-c; result != nil {
+		require.NoError(t, result.Err)
+	}
+
+	result := &server.SessionResult{}
+	require.NoError(t, transport.Get("session/"+pkg.Token+"/result", result))
+	require.Equal(t, server.StatusDone, result.Status)
+	checkChainedCredential(t, client)
+}
@@ -0,0 +1,92 @@
+package sessiontest
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerHooks(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	require.NoError(t, client.RemoveAllCredentials())
+	require.Nil(t, requestorSessionHelper(t, getIssuanceRequest(true), client).Err)
+
+	studentID := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	university := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.university")
+	blocked := "s1234567"
+	requestHookTokens := make(chan string, 1)
+
+	startIrmaServer(t, false, server.Hooks{
+		StartSession: func(request irma.RequestorRequest, requestor string) error {
+			if request.SessionRequest().Action() == irma.ActionSigning {
+				return errors.New("signing not allowed")
+			}
+			return nil
+		},
+		SessionRequest: func(token string, request irma.SessionRequest) error {
+			requestHookTokens <- token
+			// Ask for the student ID instead of the university
+			request.Disclosure().Disclose = irma.AttributeConDisCon{{{irma.NewAttributeRequest(studentID.String())}}}
+			return nil
+		},
+		Disclosure: func(result *server.SessionResult) error {
+			for _, attr := range result.Disclosed[0] {
+				if attr.RawValue != nil && *attr.RawValue == blocked {
+					return errors.New("attribute value blocked")
+				}
+			}
+			return nil
+		},
+	})
+	defer StopIrmaServer()
+
+	// StartSession hook rejects signing sessions
+	_, _, err := irmaServer.StartSession(irma.NewSignatureRequest("message", studentID), nil)
+	require.Error(t, err)
+	rerr, ok := err.(*irma.RemoteError)
+	require.True(t, ok)
+	require.Equal(t, string(server.ErrorRejected.Type), rerr.ErrorName)
+	require.Equal(t, "signing not allowed", rerr.Message)
+
+	doSession := func() (*server.SessionResult, error) {
+		results := make(chan *server.SessionResult, 1)
+		qr, token, err := irmaServer.StartSession(irma.NewDisclosureRequest(university),
+			func(result *server.SessionResult) { results <- result })
+		require.NoError(t, err)
+
+		c := make(chan *SessionResult)
+		qrjson, err := json.Marshal(qr)
+		require.NoError(t, err)
+		client.NewSession(string(qrjson), &TestHandler{t: t, c: c, client: client})
+		var sessionErr error
+		if result := <-c; result != nil {
+			sessionErr = result.Err
+		}
+		require.Equal(t, token, <-requestHookTokens)
+		return <-results, sessionErr
+	}
+
+	// Disclosure hook vetoes the disclosed student ID, which the SessionRequest hook asked for
+	result, err := doSession()
+	require.Error(t, err)
+	serr, ok := err.(*irma.SessionError)
+	require.True(t, ok)
+	require.NotNil(t, serr.RemoteError)
+	require.Equal(t, string(server.ErrorRejected.Type), serr.RemoteError.ErrorName)
+	require.Equal(t, server.StatusCancelled, result.Status)
+	require.Empty(t, result.Disclosed)
+	require.Equal(t, string(server.ErrorRejected.Type), result.Err.ErrorName)
+
+	// Without the blocked value the session succeeds, disclosing the student ID
+	blocked = ""
+	result, err = doSession()
+	require.NoError(t, err)
+	require.Equal(t, server.StatusDone, result.Status)
+	require.Equal(t, studentID, result.Disclosed[0][0].Identifier)
+}
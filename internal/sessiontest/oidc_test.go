@@ -0,0 +1,184 @@
+package sessiontest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/requestorserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOidcProvider(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	// Issue a fresh studentCard credential, to be disclosed during the OIDC login
+	require.NoError(t, client.RemoveAllCredentials())
+	require.Nil(t, requestorSessionHelper(t, getIssuanceRequest(true), client).Err)
+
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	skbts, err := x509.MarshalECPrivateKey(sk)
+	require.NoError(t, err)
+	redirectURI := "https://app.example.com/callback"
+	StartRequestorServer(&requestorserver.Configuration{
+		Configuration: &server.Configuration{
+			URL:                  "http://localhost:48682/irma",
+			Logger:               logger,
+			SchemesPath:          filepath.Join(testdata, "irma_configuration"),
+			DisableSchemesUpdate: true,
+		},
+		Port:                           48682,
+		DisableRequestorAuthentication: true,
+		JwtPrivateKey:                  string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: skbts})),
+		OidcClients: map[string]requestorserver.OidcClient{
+			"app": {
+				Secret:       "secret",
+				RedirectURIs: []string{redirectURI},
+				Request: irma.NewDisclosureRequest(
+					irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"),
+					irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.university"),
+				),
+				Claims: map[string]string{
+					"sub":        "irma-demo.RU.studentCard.studentID",
+					"university": "irma-demo.RU.studentCard.university",
+				},
+			},
+		},
+	})
+	defer StopRequestorServer()
+
+	httpClient := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	get := func(u string, result interface{}) *http.Response {
+		res, err := httpClient.Get(u)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		if result != nil {
+			require.NoError(t, json.NewDecoder(res.Body).Decode(result))
+		}
+		return res
+	}
+
+	discovery := map[string]interface{}{}
+	get("http://localhost:48682/oidc/.well-known/openid-configuration", &discovery)
+	issuer := "http://localhost:48682/oidc"
+	require.Equal(t, issuer, discovery["issuer"])
+	require.Equal(t, issuer+"/token", discovery["token_endpoint"])
+
+	// Unknown redirect URIs are not redirected to
+	res := get(issuer+"/authorize?response_type=code&scope=openid&client_id=app&redirect_uri=https://evil.example.com", nil)
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	// Start the login, and perform the IRMA session using the session pointer shown on the login page
+	res = get(issuer+"/authorize?"+url.Values{
+		"response_type": {"code"},
+		"scope":         {"openid"},
+		"client_id":     {"app"},
+		"redirect_uri":  {redirectURI},
+		"state":         {"xyz"},
+		"nonce":         {"n-0S6_WzA2Mj"},
+	}.Encode(), nil)
+	require.Equal(t, http.StatusFound, res.StatusCode)
+	loginURL := res.Header.Get("Location")
+	require.True(t, strings.HasPrefix(loginURL, issuer+"/login/"))
+
+	res, err = httpClient.Get(loginURL)
+	require.NoError(t, err)
+	page, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Contains(t, string(page), "data:image/png;base64,")
+
+	var session struct {
+		SessionPtr *irma.Qr      `json:"sessionPtr"`
+		Status     server.Status `json:"status"`
+	}
+	get(loginURL+"/session", &session)
+	require.Equal(t, server.StatusInitialized, session.Status)
+
+	c := make(chan *SessionResult)
+	qrjson, err := json.Marshal(session.SessionPtr)
+	require.NoError(t, err)
+	client.NewSession(string(qrjson), &TestHandler{t: t, c: c, client: client, expectedServerName: expectedServerName(t, nil, client.Configuration)})
+	if result := <-c; result != nil {
+		require.NoError(t, result.Err)
+	}
+
+	// Finishing the login redirects back to the client with an authorization code
+	res = get(loginURL+"/finish", nil)
+	require.Equal(t, http.StatusFound, res.StatusCode)
+	location, err := url.Parse(res.Header.Get("Location"))
+	require.NoError(t, err)
+	require.Equal(t, "app.example.com", location.Host)
+	require.Equal(t, "xyz", location.Query().Get("state"))
+	code := location.Query().Get("code")
+	require.NotEmpty(t, code)
+
+	// Exchange the code for tokens
+	exchange := func(secret string) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, issuer+"/token", strings.NewReader(url.Values{
+			"grant_type":   {"authorization_code"},
+			"code":         {code},
+			"redirect_uri": {redirectURI},
+		}.Encode()))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("app", secret)
+		res, err := httpClient.Do(req)
+		require.NoError(t, err)
+		return res
+	}
+	res = exchange("wrong")
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	res = exchange("secret")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+		IDToken     string `json:"id_token"`
+	}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&tokens))
+	require.NoError(t, res.Body.Close())
+
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(tokens.IDToken, claims, func(*jwt.Token) (interface{}, error) { return &sk.PublicKey, nil })
+	require.NoError(t, err)
+	require.Equal(t, issuer, claims["iss"])
+	require.Equal(t, "app", claims["aud"])
+	require.Equal(t, "n-0S6_WzA2Mj", claims["nonce"])
+	require.Equal(t, "s1234567", claims["sub"])
+	require.Equal(t, "Radboud", claims["university"])
+
+	// The code can be used only once
+	res = exchange("secret")
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	// Fetch the claims at the userinfo endpoint
+	req, err := http.NewRequest(http.MethodGet, issuer+"/userinfo", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	res, err = httpClient.Do(req)
+	require.NoError(t, err)
+	userinfo := map[string]string{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&userinfo))
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, map[string]string{"sub": "s1234567", "university": "Radboud"}, userinfo)
+}
@@ -2,18 +2,39 @@ package sessiontest
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
+	"image/png"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
+	"time"
 
 	"testing"
 
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/websocket"
 	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/test"
 	"github.com/privacybydesign/irmago/irmaclient"
 	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/irmaserver"
+	"github.com/privacybydesign/irmago/server/requestorserver"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
 )
 
 type sessionOption int
@@ -102,6 +123,18 @@ func TestRequestorInvalidRequest(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestRequestorInvalidTimeout(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	_, _, err := irmaServer.StartSession(&irma.ServiceProviderRequest{
+		RequestorBaseRequest: irma.RequestorBaseRequest{ResultLifetime: -1},
+		Request: irma.NewDisclosureRequest(
+			irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"),
+		),
+	}, nil)
+	require.Error(t, err)
+}
+
 func TestRequestorDoubleGET(t *testing.T) {
 	StartIrmaServer(t, false)
 	defer StopIrmaServer()
@@ -333,3 +366,1021 @@ func TestOptionalDisclosure(t *testing.T) {
 		require.True(t, reflect.DeepEqual(args.disclosed, result.Disclosed))
 	}
 }
+
+func TestRequestorBoltSessionStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "irmaserver")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	conf := &server.Configuration{
+		URL:                  "http://localhost:48680",
+		Logger:               logger,
+		SchemesPath:          filepath.Join(testdata, "irma_configuration"),
+		DisableSchemesUpdate: true,
+		SessionStore:         "bolt",
+		SessionStorePath:     filepath.Join(dir, "sessions.db"),
+	}
+	serv, err := irmaserver.New(conf)
+	require.NoError(t, err)
+	_, token, err := serv.StartSession(irma.NewDisclosureRequest(
+		irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"),
+	), nil)
+	require.NoError(t, err)
+	serv.Stop()
+
+	// The session should survive a restart
+	serv, err = irmaserver.New(conf)
+	require.NoError(t, err)
+	defer serv.Stop()
+	result := serv.GetSessionResult(token)
+	require.NotNil(t, result)
+	require.Equal(t, server.StatusInitialized, result.Status)
+	require.NotNil(t, serv.GetRequest(token).SessionRequest().Base().Nonce)
+
+	require.NoError(t, serv.CancelSession(token))
+	require.Equal(t, server.StatusCancelled, serv.GetSessionResult(token).Status)
+}
+
+// sharedSessionStore is a server.SessionStore that can be shared by several servers, like one
+// backed by a database would be.
+type sharedSessionStore struct {
+	mutex    sync.Mutex
+	sessions map[string][]byte
+	locks    map[string]*sync.Mutex
+}
+
+func (s *sharedSessionStore) Add(session *server.SessionData) error {
+	return s.Update(session)
+}
+
+func (s *sharedSessionStore) Get(token string) (*server.SessionData, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	bts, ok := s.sessions[token]
+	if !ok {
+		return nil, nil
+	}
+	session := &server.SessionData{}
+	return session, json.Unmarshal(bts, session)
+}
+
+func (s *sharedSessionStore) ClientGet(clientToken string) (*server.SessionData, error) {
+	sessions, err := s.List()
+	for _, session := range sessions {
+		if session.ClientToken == clientToken {
+			return session, err
+		}
+	}
+	return nil, err
+}
+
+func (s *sharedSessionStore) Update(session *server.SessionData) error {
+	bts, err := json.Marshal(session)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sessions[session.Token] = bts
+	return err
+}
+
+func (s *sharedSessionStore) Delete(token string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.sessions, token)
+	return nil
+}
+
+func (s *sharedSessionStore) List() ([]*server.SessionData, error) {
+	s.mutex.Lock()
+	tokens := make([]string, 0, len(s.sessions))
+	for token := range s.sessions {
+		tokens = append(tokens, token)
+	}
+	s.mutex.Unlock()
+	var sessions []*server.SessionData
+	for _, token := range tokens {
+		if session, err := s.Get(token); err != nil {
+			return nil, err
+		} else if session != nil {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
+
+func (s *sharedSessionStore) Lock(token string) (func(), error) {
+	s.mutex.Lock()
+	lock := s.locks[token]
+	if lock == nil {
+		lock = &sync.Mutex{}
+		s.locks[token] = lock
+	}
+	s.mutex.Unlock()
+	lock.Lock()
+	return lock.Unlock, nil
+}
+
+func TestIrmaServerSharedSessionStore(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	require.Nil(t, requestorSessionHelper(t, getIssuanceRequest(true), client).Err)
+
+	store := &sharedSessionStore{sessions: map[string][]byte{}, locks: map[string]*sync.Mutex{}}
+	newServer := func() *irmaserver.Server {
+		serv, err := irmaserver.New(&server.Configuration{
+			URL:                  "http://localhost:48680",
+			Logger:               logger,
+			SchemesPath:          filepath.Join(testdata, "irma_configuration"),
+			DisableSchemesUpdate: true,
+			CustomSessionStore:   store,
+		})
+		require.NoError(t, err)
+		return serv
+	}
+
+	// The session is started at one server, and performed by the IRMA app at another
+	serv1 := newServer()
+	defer serv1.Stop()
+	serv2 := newServer()
+	defer serv2.Stop()
+	results := make(chan *server.SessionResult, 1)
+	serv2.SetRestoredHandlers(func(requestor string) irmaserver.SessionHandlers {
+		require.Equal(t, "requestor", requestor)
+		return irmaserver.SessionHandlers{Result: func(result *server.SessionResult) { results <- result }}
+	})
+	httpServer := &http.Server{Addr: ":48680", Handler: serv2.HandlerFunc()}
+	go func() {
+		_ = httpServer.ListenAndServe()
+	}()
+	defer httpServer.Close()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	qr, token, err := serv1.StartSessionWithHandlers(irma.NewDisclosureRequest(id), "requestor", irmaserver.SessionHandlers{})
+	require.NoError(t, err)
+	statuses := make(chan server.Status, 1)
+	go func() {
+		status, err := serv1.WaitStatus(token, true, server.StatusInitialized)
+		require.NoError(t, err)
+		statuses <- status
+	}()
+
+	c := make(chan *SessionResult)
+	j, err := json.Marshal(qr)
+	require.NoError(t, err)
+	client.NewSession(string(j), &TestHandler{t: t, c: c, client: client})
+	if result := <-c; result != nil {
+		require.NoError(t, result.Err)
+	}
+
+	// Both servers know the result, and the server that finished the session called its handler
+	result := <-results
+	require.Equal(t, token, result.Token)
+	require.Equal(t, server.StatusDone, serv1.GetSessionResult(token).Status)
+	require.Equal(t, "s1234567", *serv1.GetSessionResult(token).Disclosed[0][0].RawValue)
+	require.NotEqual(t, server.StatusInitialized, <-statuses)
+
+	// Status requests of the IRMA app do not write to the store
+	store.mutex.Lock()
+	stored := store.sessions[token]
+	store.mutex.Unlock()
+	var status server.Status
+	require.NoError(t, irma.NewHTTPTransport(qr.URL).Get("status", &status))
+	require.Equal(t, server.StatusDone, status)
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	require.Equal(t, stored, store.sessions[token])
+}
+
+func TestRequestorServerReadiness(t *testing.T) {
+	StartRequestorServer(JwtServerConfiguration)
+	defer StopRequestorServer()
+
+	res, err := http.Get("http://localhost:48682/health")
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	res, err = http.Get("http://localhost:48682/ready")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	readiness := &server.Readiness{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(readiness))
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.True(t, readiness.Ready)
+	require.True(t, readiness.Schemes["irma-demo"].Ready)
+	require.True(t, readiness.Issuers["irma-demo.RU"].Ready)
+	require.True(t, readiness.JwtPrivateKey.Ready)
+}
+
+func TestRequestorServerReload(t *testing.T) {
+	newConfiguration := func(requestor, key string) *requestorserver.Configuration {
+		return &requestorserver.Configuration{
+			Configuration: &server.Configuration{
+				URL:                  "http://localhost:48682/irma",
+				Logger:               logger,
+				SchemesPath:          filepath.Join(testdata, "irma_configuration"),
+				DisableSchemesUpdate: true,
+			},
+			Port:        48682,
+			AdminPort:   48683,
+			AdminKey:    "adminkey",
+			Permissions: requestorserver.Permissions{Disclosing: []string{"*"}},
+			Requestors: map[string]requestorserver.Requestor{
+				requestor: {AuthenticationMethod: requestorserver.AuthenticationMethodToken, AuthenticationKey: key},
+			},
+		}
+	}
+	conf := newConfiguration("requestor1", "key1")
+	conf.ReadConfiguration = func() (*requestorserver.Configuration, error) {
+		return newConfiguration("requestor2", "key2"), nil
+	}
+	StartRequestorServer(conf)
+	defer StopRequestorServer()
+
+	post := func(url, authorization string, body []byte) int {
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", authorization)
+		req.Header.Set("Content-Type", "application/json")
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		return res.StatusCode
+	}
+	request, err := json.Marshal(irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")))
+	require.NoError(t, err)
+
+	require.Equal(t, http.StatusOK, post("http://localhost:48682/session", "key1", request))
+	require.Equal(t, http.StatusForbidden, post("http://localhost:48683/reload", "wrongkey", nil))
+	require.Equal(t, http.StatusNoContent, post("http://localhost:48683/reload", "adminkey", nil))
+	require.Equal(t, http.StatusForbidden, post("http://localhost:48682/session", "key1", request))
+	require.Equal(t, http.StatusOK, post("http://localhost:48682/session", "key2", request))
+}
+
+func TestRequestorServerAdmin(t *testing.T) {
+	StartRequestorServer(&requestorserver.Configuration{
+		Configuration: &server.Configuration{
+			URL:                  "http://localhost:48682/irma",
+			Logger:               logger,
+			SchemesPath:          filepath.Join(testdata, "irma_configuration"),
+			DisableSchemesUpdate: true,
+		},
+		Port:        48682,
+		AdminPort:   48683,
+		AdminKey:    "adminkey",
+		Permissions: requestorserver.Permissions{Disclosing: []string{"*"}},
+		Requestors: map[string]requestorserver.Requestor{
+			"requestor1": {AuthenticationMethod: requestorserver.AuthenticationMethodToken, AuthenticationKey: "key1"},
+		},
+	})
+	defer StopRequestorServer()
+
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	pkg := &server.SessionPackage{}
+	transport := irma.NewHTTPTransport("http://localhost:48682")
+	transport.SetHeader("Authorization", "key1")
+	require.NoError(t, transport.Post("session", pkg, request))
+
+	admin := func(method, path string, result interface{}) int {
+		req, err := http.NewRequest(method, "http://localhost:48683"+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "adminkey")
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		if result != nil && res.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(res.Body).Decode(result))
+		}
+		return res.StatusCode
+	}
+
+	// The admin API is not available at the requestor port
+	res, err := http.Get("http://localhost:48682/sessions")
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	// The request field of server.SessionInfo is an interface, so we use our own struct
+	type sessionInfo struct {
+		Token     string          `json:"token"`
+		Requestor string          `json:"requestor"`
+		Type      irma.Action     `json:"type"`
+		Status    server.Status   `json:"status"`
+		Request   json.RawMessage `json:"request"`
+	}
+	var sessions []sessionInfo
+	require.Equal(t, http.StatusOK, admin(http.MethodGet, "/sessions", &sessions))
+	require.Len(t, sessions, 1)
+	require.Equal(t, pkg.Token, sessions[0].Token)
+	require.Equal(t, irma.ActionDisclosing, sessions[0].Type)
+	require.Equal(t, server.StatusInitialized, sessions[0].Status)
+	require.Equal(t, "requestor1", sessions[0].Requestor)
+	require.Equal(t, http.StatusOK, admin(http.MethodGet, "/sessions?requestor=nonexisting", &sessions))
+	require.Empty(t, sessions)
+
+	var info sessionInfo
+	require.Equal(t, http.StatusOK, admin(http.MethodGet, "/sessions/"+pkg.Token, &info))
+	require.NotEmpty(t, info.Request)
+	require.Equal(t, http.StatusBadRequest, admin(http.MethodGet, "/sessions/nonexisting", nil))
+
+	var cancelled struct {
+		Cancelled int `json:"cancelled"`
+	}
+	require.Equal(t, http.StatusBadRequest, admin(http.MethodDelete, "/sessions", nil))
+	require.Equal(t, http.StatusOK, admin(http.MethodDelete, "/sessions?requestor=requestor1", &cancelled))
+	require.Equal(t, 1, cancelled.Cancelled)
+	require.Equal(t, http.StatusOK, admin(http.MethodGet, "/sessions/"+pkg.Token, &info))
+	require.Equal(t, server.StatusCancelled, info.Status)
+}
+
+func TestRequestorServerMetrics(t *testing.T) {
+	StartRequestorServer(&requestorserver.Configuration{
+		Configuration: &server.Configuration{
+			URL:                  "http://localhost:48682/irma",
+			Logger:               logger,
+			SchemesPath:          filepath.Join(testdata, "irma_configuration"),
+			DisableSchemesUpdate: true,
+		},
+		Port:        48682,
+		MetricsPort: 48684,
+		Permissions: requestorserver.Permissions{Disclosing: []string{"*"}},
+		Requestors: map[string]requestorserver.Requestor{
+			"requestor1": {AuthenticationMethod: requestorserver.AuthenticationMethodToken, AuthenticationKey: "key1"},
+		},
+	})
+	defer StopRequestorServer()
+
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	transport := irma.NewHTTPTransport("http://localhost:48682")
+	transport.SetHeader("Authorization", "key1")
+	require.NoError(t, transport.Post("session", &server.SessionPackage{}, request))
+
+	res, err := http.Get("http://localhost:48684/metrics")
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Contains(t, string(body), `irma_sessions_started_total{action="disclosing",requestor="requestor1"}`)
+
+	// The metrics are not available at the requestor port
+	res, err = http.Get("http://localhost:48682/metrics")
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestRequestorServerRateLimit(t *testing.T) {
+	StartRequestorServer(&requestorserver.Configuration{
+		Configuration: &server.Configuration{
+			URL:                   "http://localhost:48682/irma",
+			Logger:                logger,
+			SchemesPath:           filepath.Join(testdata, "irma_configuration"),
+			IssuerPrivateKeysPath: filepath.Join(testdata, "privatekeys"),
+			DisableSchemesUpdate:  true,
+		},
+		Port:            48682,
+		ClientRateLimit: 1,
+		Permissions:     requestorserver.Permissions{Disclosing: []string{"*"}, Issuing: []string{"*"}},
+		Requestors: map[string]requestorserver.Requestor{
+			"requestor1": {
+				AuthenticationMethod:  requestorserver.AuthenticationMethodToken,
+				AuthenticationKey:     "key1",
+				MaxSessionsPerMinute:  2,
+				MaxConcurrentSessions: 1,
+			},
+			"requestor2": {
+				AuthenticationMethod: requestorserver.AuthenticationMethodToken,
+				AuthenticationKey:    "key2",
+				MaxIssuancePerDay:    1,
+			},
+		},
+	})
+	defer StopRequestorServer()
+
+	request, err := json.Marshal(irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")))
+	require.NoError(t, err)
+	do := func(method, url string, body []byte) *http.Response {
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "key1")
+		req.Header.Set("Content-Type", "application/json")
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		return res
+	}
+
+	// The first session is allowed, the second is not as the first is still running
+	pkg := &server.SessionPackage{}
+	transport := irma.NewHTTPTransport("http://localhost:48682")
+	transport.SetHeader("Authorization", "key1")
+	require.NoError(t, transport.Post("session", pkg, json.RawMessage(request)))
+	res := do(http.MethodPost, "http://localhost:48682/session", request)
+	require.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+	require.Equal(t, "10", res.Header.Get("Retry-After"))
+
+	// After cancelling the first session, the second is allowed, after which the per minute limit is reached
+	require.Equal(t, http.StatusOK, do(http.MethodDelete, "http://localhost:48682/session/"+pkg.Token, nil).StatusCode)
+	require.NoError(t, transport.Post("session", pkg, json.RawMessage(request)))
+	require.Equal(t, http.StatusOK, do(http.MethodDelete, "http://localhost:48682/session/"+pkg.Token, nil).StatusCode)
+	res = do(http.MethodPost, "http://localhost:48682/session", request)
+	require.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+	require.NotEmpty(t, res.Header.Get("Retry-After"))
+
+	// The credentials of an issuance session count against the issuance quota as soon as it is
+	// started, and are refunded once it is cancelled
+	issuance, err := json.Marshal(getIssuanceRequest(true))
+	require.NoError(t, err)
+	issuanceTransport := irma.NewHTTPTransport("http://localhost:48682")
+	issuanceTransport.SetHeader("Authorization", "key2")
+	require.NoError(t, issuanceTransport.Post("session", pkg, json.RawMessage(issuance)))
+	err = issuanceTransport.Post("session", pkg, json.RawMessage(issuance))
+	require.Error(t, err)
+	require.Equal(t, http.StatusTooManyRequests, err.(*irma.SessionError).RemoteStatus)
+	require.Equal(t, http.StatusOK, do(http.MethodDelete, "http://localhost:48682/session/"+pkg.Token, nil).StatusCode)
+	time.Sleep(100 * time.Millisecond) // the quota is refunded asynchronously
+	require.NoError(t, issuanceTransport.Post("session", pkg, json.RawMessage(issuance)))
+
+	// The client endpoints allow one request per minute per IP
+	res = do(http.MethodGet, pkg.SessionPtr.URL+"/status", nil)
+	require.NotEqual(t, http.StatusTooManyRequests, res.StatusCode)
+	res = do(http.MethodGet, pkg.SessionPtr.URL+"/status", nil)
+	require.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+}
+
+func TestRequestorServerEd25519ResultJwt(t *testing.T) {
+	_, sk, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	skbts, err := test.MarshalPKCS8PrivateKey(sk)
+	require.NoError(t, err)
+
+	StartRequestorServer(&requestorserver.Configuration{
+		Configuration: &server.Configuration{
+			URL:                  "http://localhost:48682/irma",
+			Logger:               logger,
+			SchemesPath:          filepath.Join(testdata, "irma_configuration"),
+			DisableSchemesUpdate: true,
+		},
+		Port:                           48682,
+		DisableRequestorAuthentication: true,
+		Permissions:                    requestorserver.Permissions{Disclosing: []string{"*"}},
+		JwtIssuer:                      "irmaserver",
+		JwtPrivateKey:                  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: skbts})),
+	})
+	defer StopRequestorServer()
+
+	transport := irma.NewHTTPTransport("http://localhost:48682")
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	pkg := &server.SessionPackage{}
+	require.NoError(t, transport.Post("session", pkg, request))
+
+	var pkbts, resultJwt string
+	require.NoError(t, transport.Get("publickey", &pkbts))
+	pk, method, err := irma.ParseJwtPublicKey([]byte(pkbts))
+	require.NoError(t, err)
+	require.Equal(t, irma.SigningMethodEdDSA, method)
+
+	require.NoError(t, transport.Get("session/"+pkg.Token+"/result-jwt", &resultJwt))
+	claims := &jwt.StandardClaims{}
+	token, err := jwt.ParseWithClaims(resultJwt, claims, func(*jwt.Token) (interface{}, error) { return pk, nil })
+	require.NoError(t, err)
+	require.Equal(t, "EdDSA", token.Method.Alg())
+	require.Equal(t, "irmaserver", claims.Issuer)
+}
+
+func TestRequestorServerEncryptedResult(t *testing.T) {
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	pkbts, err := x509.MarshalPKIXPublicKey(&sk.PublicKey)
+	require.NoError(t, err)
+	jwtSk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	jwtSkBts, err := x509.MarshalECPrivateKey(jwtSk)
+	require.NoError(t, err)
+
+	StartRequestorServer(&requestorserver.Configuration{
+		Configuration: &server.Configuration{
+			URL:                  "http://localhost:48682/irma",
+			Logger:               logger,
+			SchemesPath:          filepath.Join(testdata, "irma_configuration"),
+			DisableSchemesUpdate: true,
+		},
+		Port:          48682,
+		Permissions:   requestorserver.Permissions{Disclosing: []string{"*"}},
+		JwtIssuer:     "irmaserver",
+		JwtPrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: jwtSkBts})),
+		Requestors: map[string]requestorserver.Requestor{
+			"requestor1": {
+				AuthenticationMethod: requestorserver.AuthenticationMethodToken,
+				AuthenticationKey:    "key1",
+				ResultEncryptionKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkbts})),
+			},
+			"requestor2": {AuthenticationMethod: requestorserver.AuthenticationMethodToken, AuthenticationKey: "key2"},
+		},
+	})
+	defer StopRequestorServer()
+
+	startSession := func(key string, encrypt bool) (*server.SessionPackage, error) {
+		transport := irma.NewHTTPTransport("http://localhost:48682")
+		transport.SetHeader("Authorization", key)
+		pkg := &server.SessionPackage{}
+		err := transport.Post("session", pkg, &irma.ServiceProviderRequest{
+			RequestorBaseRequest: irma.RequestorBaseRequest{EncryptResult: encrypt},
+			Request:              irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")),
+		})
+		return pkg, err
+	}
+	transport := irma.NewHTTPTransport("http://localhost:48682")
+
+	// Without encryptResult the result is returned in cleartext
+	pkg, err := startSession("key1", false)
+	require.NoError(t, err)
+	result := &server.SessionResult{}
+	require.NoError(t, transport.Get("session/"+pkg.Token+"/result", result))
+	require.Equal(t, pkg.Token, result.Token)
+
+	// With encryptResult the result and result JWT are returned as JWE
+	pkg, err = startSession("key1", true)
+	require.NoError(t, err)
+	var jwe string
+	require.NoError(t, transport.Get("session/"+pkg.Token+"/result", &jwe))
+	plaintext, header, err := irma.DecryptJwe(jwe, sk)
+	require.NoError(t, err)
+	require.Equal(t, irma.JweAlgEcdhEs, header.Alg)
+	require.NotEmpty(t, header.Kid)
+	require.NoError(t, json.Unmarshal(plaintext, result))
+	require.Equal(t, pkg.Token, result.Token)
+	require.Equal(t, server.StatusInitialized, result.Status)
+
+	require.NoError(t, transport.Get("session/"+pkg.Token+"/result-jwt", &jwe))
+	plaintext, header, err = irma.DecryptJwe(jwe, sk)
+	require.NoError(t, err)
+	require.Equal(t, "JWT", header.Cty)
+	claims := &jwt.StandardClaims{}
+	_, _, err = new(jwt.Parser).ParseUnverified(string(plaintext), claims)
+	require.NoError(t, err)
+	require.Equal(t, "irmaserver", claims.Issuer)
+
+	// Requestors without result encryption key cannot request encryption
+	_, err = startSession("key2", true)
+	require.Error(t, err)
+	require.Equal(t, string(server.ErrorUnsupported.Type), err.(*irma.SessionError).RemoteError.ErrorName)
+}
+
+func TestRequestorServerJwtKeyRotation(t *testing.T) {
+	pemKey := func() string {
+		_, sk, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		bts, err := test.MarshalPKCS8PrivateKey(sk)
+		require.NoError(t, err)
+		return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: bts}))
+	}
+	oldKey, newKey := pemKey(), pemKey()
+	newConfiguration := func(key, kid string, verificationKeys map[string]requestorserver.JwtKey) *requestorserver.Configuration {
+		return &requestorserver.Configuration{
+			Configuration: &server.Configuration{
+				URL:                  "http://localhost:48682/irma",
+				Logger:               logger,
+				SchemesPath:          filepath.Join(testdata, "irma_configuration"),
+				DisableSchemesUpdate: true,
+			},
+			Port:                           48682,
+			DisableRequestorAuthentication: true,
+			Permissions:                    requestorserver.Permissions{Disclosing: []string{"*"}},
+			JwtPrivateKey:                  key,
+			JwtKeyID:                       kid,
+			JwtVerificationKeys:            verificationKeys,
+		}
+	}
+	StartRequestorServer(newConfiguration(oldKey, "old", nil))
+	defer StopRequestorServer()
+
+	transport := irma.NewHTTPTransport("http://localhost:48682")
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	kids := func() []string {
+		var jwks struct {
+			Keys []struct {
+				Kid string `json:"kid"`
+			} `json:"keys"`
+		}
+		require.NoError(t, transport.Get(".well-known/jwks.json", &jwks))
+		var kids []string
+		for _, k := range jwks.Keys {
+			kids = append(kids, k.Kid)
+		}
+		return kids
+	}
+	resultKid := func() interface{} {
+		pkg := &server.SessionPackage{}
+		require.NoError(t, transport.Post("session", pkg, request))
+		var resultJwt string
+		require.NoError(t, transport.Get("session/"+pkg.Token+"/result-jwt", &resultJwt))
+		token, _, err := new(jwt.Parser).ParseUnverified(resultJwt, &jwt.StandardClaims{})
+		require.NoError(t, err)
+		return token.Header["kid"]
+	}
+	require.Equal(t, []string{"old"}, kids())
+	require.Equal(t, "old", resultKid())
+
+	// Publish the new key, then start using it while still publishing the old key, then drop the old key
+	require.NoError(t, requestorServer.Reload(newConfiguration(oldKey, "old", map[string]requestorserver.JwtKey{"new": {Key: newKey}})))
+	require.Equal(t, []string{"old", "new"}, kids())
+	require.Equal(t, "old", resultKid())
+	require.NoError(t, requestorServer.Reload(newConfiguration(newKey, "new", map[string]requestorserver.JwtKey{"old": {Key: oldKey}})))
+	require.Equal(t, []string{"new", "old"}, kids())
+	require.Equal(t, "new", resultKid())
+	require.NoError(t, requestorServer.Reload(newConfiguration(newKey, "new", nil)))
+	require.Equal(t, []string{"new"}, kids())
+}
+
+// testCertificate creates a certificate for the specified template signed by the parent certificate,
+// or a self-signed certificate if parent is nil.
+func testCertificate(t *testing.T, template *x509.Certificate, parent *tls.Certificate) *tls.Certificate {
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer, signerSk := template, interface{}(sk)
+	if parent != nil {
+		signer, signerSk = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &sk.PublicKey, signerSk)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: sk, Leaf: cert}
+}
+
+func pemCertificate(t *testing.T, cert *tls.Certificate) (string, string) {
+	skbts, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	require.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: skbts}))
+}
+
+func TestRequestorServerTlsAuthentication(t *testing.T) {
+	ca := testCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	serverCert := testCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	clientCert := func(cn string) *tls.Certificate {
+		return testCertificate(t, &x509.Certificate{
+			Subject:     pkix.Name{CommonName: cn},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, ca)
+	}
+	caPem, _ := pemCertificate(t, ca)
+	serverCertPem, serverSkPem := pemCertificate(t, serverCert)
+
+	StartRequestorServer(&requestorserver.Configuration{
+		Configuration: &server.Configuration{
+			URL:                  "https://localhost:48682/irma",
+			Logger:               logger,
+			SchemesPath:          filepath.Join(testdata, "irma_configuration"),
+			DisableSchemesUpdate: true,
+		},
+		Port:           48682,
+		TlsCertificate: serverCertPem,
+		TlsPrivateKey:  serverSkPem,
+		TlsClientCA:    caPem,
+		Permissions:    requestorserver.Permissions{Disclosing: []string{"*"}},
+		Requestors: map[string]requestorserver.Requestor{
+			"requestor1": {AuthenticationMethod: requestorserver.AuthenticationMethodTls, TlsSubject: "CN=backend"},
+		},
+	})
+	defer StopRequestorServer()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	request, err := json.Marshal(irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")))
+	require.NoError(t, err)
+	post := func(cert *tls.Certificate) int {
+		tlsConf := &tls.Config{RootCAs: roots}
+		if cert != nil {
+			tlsConf.Certificates = []tls.Certificate{*cert}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConf}}
+		res, err := client.Post("https://localhost:48682/session", "application/json", bytes.NewReader(request))
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		return res.StatusCode
+	}
+
+	require.Equal(t, http.StatusOK, post(clientCert("backend")))
+	require.Equal(t, http.StatusForbidden, post(clientCert("other")))
+	require.Equal(t, http.StatusBadRequest, post(nil))
+}
+
+func TestRequestorServerDrain(t *testing.T) {
+	StartRequestorServer(&requestorserver.Configuration{
+		Configuration: &server.Configuration{
+			URL:                  "http://localhost:48682/irma",
+			Logger:               logger,
+			SchemesPath:          filepath.Join(testdata, "irma_configuration"),
+			DisableSchemesUpdate: true,
+		},
+		Port:                           48682,
+		DisableRequestorAuthentication: true,
+		Permissions:                    requestorserver.Permissions{Disclosing: []string{"*"}},
+	})
+
+	transport := irma.NewHTTPTransport("http://localhost:48682")
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	pkg := &server.SessionPackage{}
+	require.NoError(t, transport.Post("session", pkg, request))
+
+	drained := make(chan struct{})
+	go func() {
+		requestorServer.Drain()
+		close(drained)
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	// New sessions are refused while the running session may still finish
+	err := transport.Post("session", &server.SessionPackage{}, request)
+	require.Error(t, err)
+	require.Equal(t, http.StatusServiceUnavailable, err.(*irma.SessionError).RemoteStatus)
+	var status server.Status
+	require.NoError(t, transport.Get("session/"+pkg.Token+"/status", &status))
+	require.Equal(t, server.StatusInitialized, status)
+
+	// Once the running session has finished, the server stops
+	req, err := http.NewRequest(http.MethodDelete, "http://localhost:48682/session/"+pkg.Token, nil)
+	require.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server not stopped after session finished")
+	}
+}
+
+func TestRequestorServerQr(t *testing.T) {
+	StartRequestorServer(&requestorserver.Configuration{
+		Configuration: &server.Configuration{
+			URL:                  "http://localhost:48682/irma",
+			Logger:               logger,
+			SchemesPath:          filepath.Join(testdata, "irma_configuration"),
+			DisableSchemesUpdate: true,
+		},
+		Port:                           48682,
+		DisableRequestorAuthentication: true,
+		Permissions:                    requestorserver.Permissions{Disclosing: []string{"*"}},
+	})
+	defer StopRequestorServer()
+
+	transport := irma.NewHTTPTransport("http://localhost:48682")
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	pkg := &server.SessionPackage{}
+	require.NoError(t, transport.Post("session", pkg, request))
+
+	get := func(path string) (*http.Response, []byte) {
+		res, err := http.Get("http://localhost:48682/session/" + pkg.Token + path)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		bts, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res, bts
+	}
+
+	res, bts := get("/qr.png?size=200")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "image/png", res.Header.Get("Content-Type"))
+	img, err := png.Decode(bytes.NewReader(bts))
+	require.NoError(t, err)
+	require.True(t, img.Bounds().Dx() <= 200)
+
+	res, bts = get("/qr.svg")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "image/svg+xml", res.Header.Get("Content-Type"))
+	require.Contains(t, string(bts), `width="300"`)
+
+	res, _ = get("/qr.png?size=1")
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res, bts = get("/links")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	links := &server.SessionLinks{}
+	require.NoError(t, json.Unmarshal(bts, links))
+	fragment, err := url.PathUnescape(strings.TrimPrefix(links.Universal, "https://irma.app/-/session#"))
+	require.NoError(t, err)
+	qr := &irma.Qr{}
+	require.NoError(t, json.Unmarshal([]byte(fragment), qr))
+	require.Equal(t, pkg.SessionPtr, qr)
+}
+
+func TestRequestorServerStatusChannels(t *testing.T) {
+	StartRequestorServer(&requestorserver.Configuration{
+		Configuration: &server.Configuration{
+			URL:                  "http://localhost:48682/irma",
+			Logger:               logger,
+			SchemesPath:          filepath.Join(testdata, "irma_configuration"),
+			DisableSchemesUpdate: true,
+			LongPollTimeout:      1,
+		},
+		Port:                           48682,
+		DisableRequestorAuthentication: true,
+		Permissions:                    requestorserver.Permissions{Disclosing: []string{"*"}},
+	})
+	defer StopRequestorServer()
+
+	transport := irma.NewHTTPTransport("http://localhost:48682")
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	pkg := &server.SessionPackage{}
+	require.NoError(t, transport.Post("session", pkg, request))
+	clientToken := pkg.SessionPtr.URL[strings.LastIndex(pkg.SessionPtr.URL, "/")+1:]
+
+	// Long-polling returns immediately if the status differs, and otherwise after the timeout
+	var status server.Status
+	require.NoError(t, transport.Get("session/"+pkg.Token+"/status?wait=CONNECTED", &status))
+	require.Equal(t, server.StatusInitialized, status)
+	start := time.Now()
+	require.NoError(t, transport.Get("session/"+pkg.Token+"/status?wait=INITIALIZED", &status))
+	require.Equal(t, server.StatusInitialized, status)
+	require.True(t, time.Since(start) >= time.Second)
+
+	requestorWs, _, err := websocket.DefaultDialer.Dial("ws://localhost:48682/session/"+pkg.Token+"/statussocket", nil)
+	require.NoError(t, err)
+	defer requestorWs.Close()
+	clientWs, _, err := websocket.DefaultDialer.Dial("ws://localhost:48682/irma/session/"+clientToken+"/statussocket", nil)
+	require.NoError(t, err)
+	defer clientWs.Close()
+	for _, ws := range []*websocket.Conn{requestorWs, clientWs} {
+		messageType, message, err := ws.ReadMessage()
+		require.NoError(t, err)
+		require.Equal(t, websocket.TextMessage, messageType)
+		require.Equal(t, `"INITIALIZED"`, string(message))
+	}
+
+	// Browsers from other origins are refused
+	_, res, err := websocket.DefaultDialer.Dial("ws://localhost:48682/session/"+pkg.Token+"/statussocket",
+		http.Header{"Origin": []string{"http://evil.example"}})
+	require.Error(t, err)
+	require.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	// Long-polling, and both WebSockets, are notified when the session is cancelled
+	polled := make(chan server.Status)
+	go func() {
+		var status server.Status
+		if err := irma.NewHTTPTransport("http://localhost:48682").Get("session/"+pkg.Token+"/status?wait=INITIALIZED", &status); err != nil {
+			status = ""
+		}
+		polled <- status
+	}()
+	time.Sleep(200 * time.Millisecond)
+	req, err := http.NewRequest(http.MethodDelete, "http://localhost:48682/session/"+pkg.Token, nil)
+	require.NoError(t, err)
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+
+	require.Equal(t, server.StatusCancelled, <-polled)
+	for _, ws := range []*websocket.Conn{requestorWs, clientWs} {
+		messageType, message, err := ws.ReadMessage()
+		require.NoError(t, err)
+		require.Equal(t, websocket.TextMessage, messageType)
+		require.Equal(t, `"CANCELLED"`, string(message))
+		_, _, err = ws.ReadMessage()
+		require.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure))
+	}
+
+	// Unknown sessions are refused before upgrading
+	res, err = http.Get("http://localhost:48682/session/unknown/statussocket")
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestRequestorServerSessionTemplate(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	require.Nil(t, requestorSessionHelper(t, getIssuanceRequest(true), client).Err)
+
+	StartRequestorServer(&requestorserver.Configuration{
+		Configuration: &server.Configuration{
+			URL:                  "http://localhost:48682/irma",
+			Logger:               logger,
+			SchemesPath:          filepath.Join(testdata, "irma_configuration"),
+			DisableSchemesUpdate: true,
+		},
+		Port: 48682,
+		Requestors: map[string]requestorserver.Requestor{
+			"requestor1": {
+				AuthenticationMethod: requestorserver.AuthenticationMethodToken,
+				AuthenticationKey:    "key1",
+				Permissions:          requestorserver.Permissions{Disclosing: []string{"irma-demo.RU.studentCard.studentID"}},
+				SessionTemplates: map[string]interface{}{
+					"student": map[string]interface{}{
+						"@context": "https://irma.app/ld/request/disclosure/v2",
+						"disclose": []interface{}{[]interface{}{[]interface{}{map[string]interface{}{
+							"type":  "irma-demo.RU.studentCard.studentID",
+							"value": "{{studentID}}",
+						}}}},
+					},
+				},
+			},
+		},
+	})
+	defer StopRequestorServer()
+
+	transport := irma.NewHTTPTransport("http://localhost:48682")
+	transport.SetHeader("Authorization", "key1")
+	pkg := &server.SessionPackage{}
+
+	// Missing parameters are rejected
+	require.Error(t, transport.Post("session", pkg, &requestorserver.TemplateRequest{Template: "student"}))
+
+	require.NoError(t, transport.Post("session", pkg, &requestorserver.TemplateRequest{
+		Template:   "student",
+		Parameters: map[string]string{"studentID": "s1234567"},
+	}))
+	c := make(chan *SessionResult)
+	qrjson, err := json.Marshal(pkg.SessionPtr)
+	require.NoError(t, err)
+	client.NewSession(string(qrjson), &TestHandler{t: t, c: c, client: client})
+	if result := <-c; result != nil {
+		require.NoError(t, result.Err)
+	}
+
+	result := &server.SessionResult{}
+	require.NoError(t, transport.Get("session/"+pkg.Token+"/result", result))
+	require.Equal(t, server.StatusDone, result.Status)
+	require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+	require.Equal(t, "s1234567", *result.Disclosed[0][0].RawValue)
+}
+
+func TestRequestorServerTenants(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	require.Nil(t, requestorSessionHelper(t, getIssuanceRequest(true), client).Err)
+
+	studentID := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	StartRequestorServer(&requestorserver.Configuration{
+		Configuration: &server.Configuration{
+			URL:                  "http://localhost:48682/irma",
+			Logger:               logger,
+			SchemesPath:          filepath.Join(testdata, "irma_configuration"),
+			DisableSchemesUpdate: true,
+		},
+		Port: 48682,
+		Requestors: map[string]requestorserver.Requestor{
+			"requestor1": {
+				AuthenticationMethod: requestorserver.AuthenticationMethodToken,
+				AuthenticationKey:    "key1",
+				Permissions:          requestorserver.Permissions{Disclosing: []string{"*"}},
+			},
+		},
+		Tenants: map[string]*requestorserver.Tenant{
+			"tenant1": {
+				PathPrefix: "/tenant1",
+				Requestors: map[string]requestorserver.Requestor{
+					"requestor1": {
+						AuthenticationMethod: requestorserver.AuthenticationMethodToken,
+						AuthenticationKey:    "key2",
+					},
+				},
+				Permissions: requestorserver.Permissions{Disclosing: []string{studentID.String()}},
+			},
+		},
+	})
+	defer StopRequestorServer()
+
+	transport := irma.NewHTTPTransport("http://localhost:48682")
+	transport.SetHeader("Authorization", "key1")
+	tenantTransport := irma.NewHTTPTransport("http://localhost:48682/tenant1")
+	tenantTransport.SetHeader("Authorization", "key2")
+	request := irma.NewDisclosureRequest(studentID)
+	pkg := &server.SessionPackage{}
+
+	// Requestors and permissions are those of the tenant
+	require.Error(t, tenantTransport.Post("session", pkg, irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.university"))))
+	require.NoError(t, tenantTransport.Post("session", pkg, request))
+	require.Contains(t, pkg.SessionPtr.URL, "http://localhost:48682/tenant1/irma/session/")
+
+	c := make(chan *SessionResult)
+	qrjson, err := json.Marshal(pkg.SessionPtr)
+	require.NoError(t, err)
+	client.NewSession(string(qrjson), &TestHandler{t: t, c: c, client: client})
+	if result := <-c; result != nil {
+		require.NoError(t, result.Err)
+	}
+
+	result := &server.SessionResult{}
+	require.NoError(t, tenantTransport.Get("session/"+pkg.Token+"/result", result))
+	require.Equal(t, server.StatusDone, result.Status)
+	require.Equal(t, "s1234567", *result.Disclosed[0][0].RawValue)
+
+	// The session of the tenant is unknown to the default tenant
+	require.Error(t, transport.Get("session/"+pkg.Token+"/result", result))
+}
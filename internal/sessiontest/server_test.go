@@ -48,6 +48,10 @@ func StopRequestorServer() {
 }
 
 func StartIrmaServer(t *testing.T, updatedIrmaConf bool) {
+	startIrmaServer(t, updatedIrmaConf, server.Hooks{})
+}
+
+func startIrmaServer(t *testing.T, updatedIrmaConf bool, hooks server.Hooks) {
 	testdata := test.FindTestdataFolder(t)
 	irmaconf := "irma_configuration"
 	if updatedIrmaConf {
@@ -63,6 +67,7 @@ func StartIrmaServer(t *testing.T, updatedIrmaConf bool) {
 		URL:         "http://localhost:48680",
 		Logger:      logger,
 		SchemesPath: filepath.Join(testdata, irmaconf),
+		Hooks:       hooks,
 	})
 
 	require.NoError(t, err)
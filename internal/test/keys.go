@@ -0,0 +1,43 @@
+package test
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// oidEd25519 identifies Ed25519 keys in PKCS #8 and PKIX structures (RFC 8410).
+var oidEd25519 = asn1.ObjectIdentifier{1, 3, 101, 112}
+
+// MarshalPKCS8PrivateKey is like x509.MarshalPKCS8PrivateKey, but also supports Ed25519 keys
+// on Go versions before 1.13.
+func MarshalPKCS8PrivateKey(key interface{}) ([]byte, error) {
+	sk, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return x509.MarshalPKCS8PrivateKey(key)
+	}
+	seed, err := asn1.Marshal(sk[:ed25519.PrivateKeySize-ed25519.PublicKeySize])
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(struct {
+		Version    int
+		Algo       pkix.AlgorithmIdentifier
+		PrivateKey []byte
+	}{Algo: pkix.AlgorithmIdentifier{Algorithm: oidEd25519}, PrivateKey: seed})
+}
+
+// MarshalPKIXPublicKey is like x509.MarshalPKIXPublicKey, but also supports Ed25519 keys
+// on Go versions before 1.13.
+func MarshalPKIXPublicKey(key interface{}) ([]byte, error) {
+	pk, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return x509.MarshalPKIXPublicKey(key)
+	}
+	return asn1.Marshal(struct {
+		Algo      pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}{pkix.AlgorithmIdentifier{Algorithm: oidEd25519}, asn1.BitString{Bytes: pk, BitLength: 8 * len(pk)}})
+}
@@ -11,7 +11,6 @@ import (
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/go-errors/errors"
-	"github.com/mdp/qrterminal"
 	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/fs"
 	"github.com/privacybydesign/irmago/server"
@@ -63,11 +62,17 @@ func signRequest(request irma.RequestorRequest, name, authmethod, key string) (s
 		if sk, err = fs.Base64Decode(bts); err != nil {
 			return "", err
 		}
-	case "rsa":
-		jwtalg = jwt.SigningMethodRS256
-		if sk, err = jwt.ParseRSAPrivateKeyFromPEM(bts); err != nil {
+	case "rsa", "ecdsa", "ed25519":
+		if sk, jwtalg, err = irma.ParseJwtPrivateKey(bts); err != nil {
 			return "", err
 		}
+		if expected := map[string]jwt.SigningMethod{
+			"rsa":     jwt.SigningMethodRS256,
+			"ecdsa":   jwt.SigningMethodES256,
+			"ed25519": irma.SigningMethodEdDSA,
+		}[authmethod]; jwtalg != expected {
+			return "", errors.Errorf("Key is not suitable for authentication method '%s'", authmethod)
+		}
 	default:
 		return "", errors.Errorf("Unsupported signing algorithm: '%s'", authmethod)
 	}
@@ -265,15 +270,9 @@ func printQr(qr *irma.Qr, noqr bool) error {
 	}
 	if noqr {
 		fmt.Println(string(qrBts))
-	} else {
-		qrterminal.GenerateWithConfig(string(qrBts), qrterminal.Config{
-			Level:     qrterminal.L,
-			Writer:    os.Stdout,
-			BlackChar: qrterminal.BLACK,
-			WhiteChar: qrterminal.WHITE,
-		})
+		return nil
 	}
-	return nil
+	return server.PrintQrTerminal(os.Stdout, qr)
 }
 
 func printSessionResult(result *server.SessionResult) {
@@ -301,7 +300,7 @@ func authmethodAlias(f *pflag.FlagSet, name string) pflag.NormalizedName {
 
 func addRequestFlags(flags *pflag.FlagSet) {
 	flags.StringP("schemes-path", "s", server.DefaultSchemesPath(), "path to irma_configuration")
-	flags.StringP("auth-method", "a", "none", "Authentication method to server (none, token, rsa, hmac)")
+	flags.StringP("auth-method", "a", "none", "Authentication method to server (none, token, rsa, ecdsa, ed25519, hmac)")
 	flags.SetNormalizeFunc(authmethodAlias)
 	flags.String("key", "", "Key to sign request with")
 	flags.String("name", "", "Requestor name")
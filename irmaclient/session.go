@@ -77,6 +77,7 @@ type session struct {
 	client      *Client
 	request     irma.SessionRequest
 	done        bool
+	next        SessionDismisser // follow-up session of a chained session, if any
 
 	// State for issuance sessions
 	issuerProofNonce *big.Int
@@ -99,6 +100,8 @@ var supportedVersions = map[int][]int{
 	2: {
 		4, // old protocol with legacy session requests
 		5, // introduces condiscon feature
+		6, // introduces ServerSessionResponse with chained sessions
+		7, // introduces dynamic issuance
 	},
 }
 var minVersion = &irma.ProtocolVersion{Major: 2, Minor: supportedVersions[2][0]}
@@ -377,6 +380,7 @@ func (session *session) sendResponse(message interface{}) {
 	var log *LogEntry
 	var err error
 	var messageJson []byte
+	var serverResponse *irma.ServerSessionResponse
 
 	switch session.Action {
 	case irma.ActionSigning:
@@ -393,15 +397,10 @@ func (session *session) sendResponse(message interface{}) {
 		}
 
 		if session.IsInteractive() {
-			var response disclosureResponse
-			if err = session.transport.Post("proofs", &response, irmaSignature); err != nil {
+			if serverResponse, err = session.postProofs(irmaSignature); err != nil {
 				session.fail(err.(*irma.SessionError))
 				return
 			}
-			if response != "VALID" {
-				session.fail(&irma.SessionError{ErrorType: irma.ErrorRejected, Info: string(response)})
-				return
-			}
 		}
 		log, err = session.createLogEntry(message)
 		if err != nil {
@@ -415,15 +414,10 @@ func (session *session) sendResponse(message interface{}) {
 			return
 		}
 		if session.IsInteractive() {
-			var response disclosureResponse
-			if err = session.transport.Post("proofs", &response, message); err != nil {
+			if serverResponse, err = session.postProofs(message); err != nil {
 				session.fail(err.(*irma.SessionError))
 				return
 			}
-			if response != "VALID" {
-				session.fail(&irma.SessionError{ErrorType: irma.ErrorRejected, Info: string(response)})
-				return
-			}
 		}
 		log, err = session.createLogEntry(message)
 		if err != nil {
@@ -432,10 +426,21 @@ func (session *session) sendResponse(message interface{}) {
 		}
 	case irma.ActionIssuing:
 		response := []*gabi.IssueSignatureMessage{}
-		if err = session.transport.Post("commitments", &response, message); err != nil {
+		if session.Version.Below(2, 6) {
+			err = session.transport.Post("commitments", &response, message)
+		} else {
+			serverResponse = &irma.ServerSessionResponse{}
+			err = session.transport.Post("commitments", serverResponse, message)
+			response = serverResponse.IssueSignatures
+		}
+		if err != nil {
 			session.fail(err.(*irma.SessionError))
 			return
 		}
+		if err = session.acceptDynamicCredentials(serverResponse); err != nil {
+			session.fail(&irma.SessionError{ErrorType: irma.ErrorServerResponse, Err: err})
+			return
+		}
 		if err = session.client.ConstructCredentials(response, session.request.(*irma.IssuanceRequest), session.builders); err != nil {
 			session.fail(&irma.SessionError{ErrorType: irma.ErrorCrypto, Err: err})
 			return
@@ -454,9 +459,57 @@ func (session *session) sendResponse(message interface{}) {
 		session.client.handler.UpdateAttributes()
 	}
 	session.done = true
+
+	// Continue into the follow-up session, if any, which reports its own success to the handler
+	if serverResponse != nil && serverResponse.NextSession != nil {
+		session.next = session.client.newQrSession(serverResponse.NextSession, session.Handler)
+		return
+	}
 	session.Handler.Success(string(messageJson))
 }
 
+// acceptDynamicCredentials replaces the credentials of a dynamic issuance request by the
+// credentials that the server computed, as included in its response.
+func (session *session) acceptDynamicCredentials(response *irma.ServerSessionResponse) error {
+	ir := session.request.(*irma.IssuanceRequest)
+	if !ir.Dynamic {
+		return nil
+	}
+	if response == nil {
+		return errors.New("server did not send dynamic credentials")
+	}
+	if err := ir.CheckDynamicCredentials(response.Credentials); err != nil {
+		return err
+	}
+	ir.Credentials = response.Credentials
+	ir.CredentialInfoList = nil // recomputed from the new credentials when needed
+	return nil
+}
+
+// postProofs POSTs the disclosure proofs or attribute-based signature to the server and checks
+// that the server accepted them, returning the server's response from protocol version 2.6 onwards.
+func (session *session) postProofs(message interface{}) (*irma.ServerSessionResponse, error) {
+	if session.Version.Below(2, 6) {
+		var response disclosureResponse
+		if err := session.transport.Post("proofs", &response, message); err != nil {
+			return nil, err
+		}
+		if response != "VALID" {
+			return nil, &irma.SessionError{ErrorType: irma.ErrorRejected, Info: string(response)}
+		}
+		return nil, nil
+	}
+
+	response := &irma.ServerSessionResponse{}
+	if err := session.transport.Post("proofs", response, message); err != nil {
+		return nil, err
+	}
+	if response.ProofStatus != irma.ProofStatusValid {
+		return nil, &irma.SessionError{ErrorType: irma.ErrorRejected, Info: string(response.ProofStatus)}
+	}
+	return response, nil
+}
+
 // managerSession performs a "session" in which a new scheme manager is added (asking for permission first).
 func (session *session) managerSession() {
 	defer session.recoverFromPanic()
@@ -656,6 +709,10 @@ func (session *session) cancel() {
 }
 
 func (session *session) Dismiss() {
+	if session.next != nil {
+		session.next.Dismiss()
+		return
+	}
 	session.cancel()
 }
 
@@ -55,6 +55,10 @@ type Configuration struct {
 
 	Warnings []string
 
+	// SchemeUpdated, if set, is called by UpdateSchemes after each attempt to update a scheme,
+	// with the error that occurred if the attempt failed.
+	SchemeUpdated func(id SchemeManagerIdentifier, err error)
+
 	kssPublicKeys map[SchemeManagerIdentifier]map[int]*rsa.PublicKey
 	publicKeys    map[IssuerIdentifier]map[int]*gabi.PublicKey
 	privateKeys   map[IssuerIdentifier]*gabi.PrivateKey
@@ -877,9 +881,10 @@ func (conf *Configuration) checkCredentialTypes(session SessionRequest, missing
 			}
 
 			// Check if all attributes from the configuration are present, unless they are marked as optional
+			// or the issuer computes them in a dynamic issuance session
 			for _, attrtype := range typ.AttributeTypes {
 				_, present := credreq.Attributes[attrtype.ID]
-				if !present && !attrtype.IsOptional() {
+				if !present && !attrtype.IsOptional() && !s.Dynamic {
 					requiredMissing.AttributeTypes[attrtype.GetAttributeTypeIdentifier()] = struct{}{}
 				}
 			}
@@ -1272,7 +1277,11 @@ func (conf *Configuration) UpdateSchemes() error {
 	}
 	for id := range conf.SchemeManagers {
 		Logger.WithField("scheme", id).Info("Auto-updating scheme")
-		if err := conf.UpdateSchemeManager(id, &updated); err != nil {
+		err := conf.UpdateSchemeManager(id, &updated)
+		if conf.SchemeUpdated != nil {
+			conf.SchemeUpdated(id, err)
+		}
+		if err != nil {
 			return err
 		}
 	}
@@ -1,9 +1,16 @@
 package irma
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
 	"encoding/json"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -522,3 +529,36 @@ func TestConDisconSingletons(t *testing.T) {
 		}
 	}
 }
+
+func TestJwe(t *testing.T) {
+	rsaSk, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecSk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	plaintext := []byte(`{"status":"DONE"}`)
+
+	for alg, sk := range map[string]interface {
+		Public() crypto.PublicKey
+	}{JweAlgRsaOaep256: rsaSk, JweAlgEcdhEs: ecSk} {
+		jwe, err := EncryptJwe(plaintext, sk.Public(), "kid", "JWT")
+		require.NoError(t, err)
+		decrypted, header, err := DecryptJwe(jwe, sk)
+		require.NoError(t, err)
+		require.Equal(t, plaintext, decrypted)
+		require.Equal(t, &JweHeader{Alg: alg, Enc: JweEncA256Gcm, Kid: "kid", Cty: "JWT", Epk: header.Epk}, header)
+
+		// Tampering with the protected header is detected
+		parts := strings.SplitN(jwe, ".", 2)
+		header.Kid = "other"
+		bts, err := json.Marshal(header)
+		require.NoError(t, err)
+		_, _, err = DecryptJwe(base64.RawURLEncoding.EncodeToString(bts)+"."+parts[1], sk)
+		require.Error(t, err)
+	}
+
+	// Decrypting with the wrong type of key fails
+	jwe, err := EncryptJwe(plaintext, &rsaSk.PublicKey, "", "")
+	require.NoError(t, err)
+	_, _, err = DecryptJwe(jwe, ecSk)
+	require.Error(t, err)
+}
@@ -0,0 +1,210 @@
+package irma
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"strings"
+
+	"github.com/go-errors/errors"
+)
+
+// JWE key management algorithms and content encryption algorithm (see RFC 7516 and RFC 7518)
+// supported by EncryptJwe and DecryptJwe.
+const (
+	JweAlgRsaOaep256 = "RSA-OAEP-256" // for RSA keys
+	JweAlgEcdhEs     = "ECDH-ES"      // for P-256 keys, using direct key agreement
+	JweEncA256Gcm    = "A256GCM"
+)
+
+// JweHeader is the protected header of a JWE.
+type JweHeader struct {
+	Alg string  `json:"alg"`
+	Enc string  `json:"enc"`
+	Kid string  `json:"kid,omitempty"`
+	Cty string  `json:"cty,omitempty"`
+	Epk *jweEpk `json:"epk,omitempty"`
+}
+
+// jweEpk is the ephemeral public key of the ECDH-ES key agreement, in JWK format.
+type jweEpk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// EncryptJwe encrypts the plaintext to the specified RSA or P-256 public key, returning a JWE in
+// compact serialization. The kid and cty header parameters are included if nonempty.
+func EncryptJwe(plaintext []byte, pk crypto.PublicKey, kid, cty string) (string, error) {
+	header := &JweHeader{Enc: JweEncA256Gcm, Kid: kid, Cty: cty}
+	var cek, encryptedKey []byte
+	var err error
+	switch pk := pk.(type) {
+	case *rsa.PublicKey:
+		header.Alg = JweAlgRsaOaep256
+		cek = make([]byte, 32)
+		if _, err = rand.Read(cek); err != nil {
+			return "", err
+		}
+		if encryptedKey, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, pk, cek, nil); err != nil {
+			return "", err
+		}
+	case *ecdsa.PublicKey:
+		if pk.Curve != elliptic.P256() {
+			return "", errors.New("unsupported elliptic curve, only P-256 is supported")
+		}
+		header.Alg = JweAlgEcdhEs
+		ephemeral, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return "", err
+		}
+		header.Epk = &jweEpk{
+			Kty: "EC",
+			Crv: "P-256",
+			X:   base64.RawURLEncoding.EncodeToString(JwkPad(ephemeral.X.Bytes(), 32)),
+			Y:   base64.RawURLEncoding.EncodeToString(JwkPad(ephemeral.Y.Bytes(), 32)),
+		}
+		cek = jweEcdhEs(pk, ephemeral.D)
+	default:
+		return "", errors.New("unsupported JWE public key type")
+	}
+
+	headerBts, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	protected := base64.RawURLEncoding.EncodeToString(headerBts)
+	gcm, err := jweGcm(cek)
+	if err != nil {
+		return "", err
+	}
+	iv := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(iv); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nil, iv, plaintext, []byte(protected))
+	ciphertext, tag := sealed[:len(sealed)-gcm.Overhead()], sealed[len(sealed)-gcm.Overhead():]
+
+	return strings.Join([]string{
+		protected,
+		base64.RawURLEncoding.EncodeToString(encryptedKey),
+		base64.RawURLEncoding.EncodeToString(iv),
+		base64.RawURLEncoding.EncodeToString(ciphertext),
+		base64.RawURLEncoding.EncodeToString(tag),
+	}, "."), nil
+}
+
+// DecryptJwe decrypts a JWE in compact serialization produced by EncryptJwe using the specified
+// RSA or P-256 private key, returning the plaintext along with the protected header.
+func DecryptJwe(jwe string, sk crypto.PrivateKey) ([]byte, *JweHeader, error) {
+	parts := strings.Split(jwe, ".")
+	if len(parts) != 5 {
+		return nil, nil, errors.New("JWE does not consist of five parts")
+	}
+	decoded := make([][]byte, 5)
+	for i, part := range parts {
+		var err error
+		if decoded[i], err = base64.RawURLEncoding.DecodeString(part); err != nil {
+			return nil, nil, errors.WrapPrefix(err, "failed to decode JWE", 0)
+		}
+	}
+	header := &JweHeader{}
+	if err := json.Unmarshal(decoded[0], header); err != nil {
+		return nil, nil, errors.WrapPrefix(err, "failed to parse JWE header", 0)
+	}
+	if header.Enc != JweEncA256Gcm {
+		return nil, nil, errors.Errorf("unsupported JWE content encryption algorithm %s", header.Enc)
+	}
+
+	var cek []byte
+	var err error
+	switch sk := sk.(type) {
+	case *rsa.PrivateKey:
+		if header.Alg != JweAlgRsaOaep256 {
+			return nil, nil, errors.Errorf("JWE algorithm %s does not match RSA private key", header.Alg)
+		}
+		if cek, err = rsa.DecryptOAEP(sha256.New(), rand.Reader, sk, decoded[1], nil); err != nil {
+			return nil, nil, errors.WrapPrefix(err, "failed to decrypt JWE content encryption key", 0)
+		}
+	case *ecdsa.PrivateKey:
+		if header.Alg != JweAlgEcdhEs || header.Epk == nil || header.Epk.Crv != "P-256" || sk.Curve != elliptic.P256() {
+			return nil, nil, errors.Errorf("JWE algorithm %s does not match P-256 private key", header.Alg)
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(header.Epk.X)
+		y, errY := base64.RawURLEncoding.DecodeString(header.Epk.Y)
+		epk := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if errX != nil || errY != nil || !epk.Curve.IsOnCurve(epk.X, epk.Y) {
+			return nil, nil, errors.New("invalid JWE ephemeral public key")
+		}
+		cek = jweEcdhEs(epk, sk.D)
+	default:
+		return nil, nil, errors.New("unsupported JWE private key type")
+	}
+
+	gcm, err := jweGcm(cek)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(decoded[2]) != gcm.NonceSize() {
+		return nil, nil, errors.New("invalid JWE initialization vector")
+	}
+	plaintext, err := gcm.Open(nil, decoded[2], append(decoded[3], decoded[4]...), []byte(parts[0]))
+	if err != nil {
+		return nil, nil, errors.WrapPrefix(err, "failed to decrypt JWE", 0)
+	}
+	return plaintext, header, nil
+}
+
+// jweEcdhEs computes the content encryption key from the ECDH shared secret using the Concat KDF
+// (RFC 7518 section 4.6.2), with the enc algorithm as AlgorithmID and empty PartyUInfo and PartyVInfo.
+func jweEcdhEs(pk *ecdsa.PublicKey, d *big.Int) []byte {
+	z, _ := pk.Curve.ScalarMult(pk.X, pk.Y, d.Bytes())
+	var otherInfo []byte
+	otherInfo = jweAppendLength(otherInfo, JweEncA256Gcm)
+	otherInfo = jweAppendLength(otherInfo, "")       // PartyUInfo
+	otherInfo = jweAppendLength(otherInfo, "")       // PartyVInfo
+	otherInfo = append(otherInfo, jweUint32(256)...) // SuppPubInfo: key length in bits
+
+	h := sha256.New()
+	h.Write(jweUint32(1)) // round counter
+	h.Write(JwkPad(z.Bytes(), 32))
+	h.Write(otherInfo)
+	return h.Sum(nil)
+}
+
+func jweAppendLength(bts []byte, data string) []byte {
+	return append(append(bts, jweUint32(len(data))...), data...)
+}
+
+func jweUint32(i int) []byte {
+	bts := make([]byte, 4)
+	binary.BigEndian.PutUint32(bts, uint32(i))
+	return bts
+}
+
+// JwkPad left-pads the big-endian encoding of an elliptic curve coordinate with zeros to the
+// size of the curve in bytes, as JWKs and JWEs require (RFC 7518, section 6.2.1.2).
+func JwkPad(bts []byte, size int) []byte {
+	if len(bts) >= size {
+		return bts
+	}
+	return append(make([]byte, size-len(bts)), bts...)
+}
+
+func jweGcm(cek []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,184 @@
+package irma
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-errors/errors"
+	"golang.org/x/crypto/ed25519"
+)
+
+// SigningMethodEdDSA signs and verifies JWTs using Ed25519 (alg "EdDSA", see RFC 8037).
+// Keys are of type ed25519.PrivateKey and ed25519.PublicKey.
+var SigningMethodEdDSA jwt.SigningMethod = &signingMethodEdDSA{}
+
+type signingMethodEdDSA struct{}
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+func (*signingMethodEdDSA) Alg() string {
+	return "EdDSA"
+}
+
+func (*signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	pk, ok := key.(ed25519.PublicKey)
+	if !ok || len(pk) != ed25519.PublicKeySize {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pk, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
+
+func (*signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	sk, ok := key.(ed25519.PrivateKey)
+	if !ok || len(sk) != ed25519.PrivateKeySize {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(sk, []byte(signingString))), nil
+}
+
+// ParseJwtPrivateKey parses a PEM encoded RSA, ECDSA (P-256) or Ed25519 private key, returning
+// the key along with the JWT signing method (RS256, ES256 or EdDSA respectively) to use it with.
+func ParseJwtPrivateKey(bts []byte) (crypto.Signer, jwt.SigningMethod, error) {
+	block, _ := pem.Decode(bts)
+	if block == nil {
+		return nil, nil, errors.New("private key is not PEM encoded")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = parsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, nil, errors.Errorf("unsupported private key type %s", block.Type)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch sk := key.(type) {
+	case *rsa.PrivateKey:
+		return sk, jwt.SigningMethodRS256, nil
+	case *ecdsa.PrivateKey:
+		if sk.Curve != elliptic.P256() {
+			return nil, nil, errors.New("unsupported elliptic curve, only P-256 is supported")
+		}
+		return sk, jwt.SigningMethodES256, nil
+	case ed25519.PrivateKey:
+		return sk, SigningMethodEdDSA, nil
+	default:
+		return nil, nil, errors.New("unsupported private key type")
+	}
+}
+
+// ParseJwtPublicKey parses a PEM encoded RSA, ECDSA (P-256) or Ed25519 public key or certificate,
+// returning the key along with the JWT signing method (RS256, ES256 or EdDSA respectively)
+// with which signatures can be verified using it.
+func ParseJwtPublicKey(bts []byte) (crypto.PublicKey, jwt.SigningMethod, error) {
+	block, _ := pem.Decode(bts)
+	if block == nil {
+		return nil, nil, errors.New("public key is not PEM encoded")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err = parsePKIXPublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			key, err = parsePKIXPublicKey(cert.RawSubjectPublicKeyInfo)
+		}
+	default:
+		return nil, nil, errors.Errorf("unsupported public key type %s", block.Type)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch pk := key.(type) {
+	case *rsa.PublicKey:
+		return pk, jwt.SigningMethodRS256, nil
+	case *ecdsa.PublicKey:
+		if pk.Curve != elliptic.P256() {
+			return nil, nil, errors.New("unsupported elliptic curve, only P-256 is supported")
+		}
+		return pk, jwt.SigningMethodES256, nil
+	case ed25519.PublicKey:
+		return pk, SigningMethodEdDSA, nil
+	default:
+		return nil, nil, errors.New("unsupported public key type")
+	}
+}
+
+// oidEd25519 identifies Ed25519 keys in PKCS #8 and PKIX structures (RFC 8410).
+var oidEd25519 = asn1.ObjectIdentifier{1, 3, 101, 112}
+
+// ed25519SeedSize is the size of the seed of which Ed25519 private keys are encoded in PKCS #8.
+const ed25519SeedSize = 32
+
+// pkcs8 and pkixPublicKey are the ASN.1 structures of PKCS #8 private keys and PKIX public keys.
+type pkcs8 struct {
+	Version    int
+	Algo       pkix.AlgorithmIdentifier
+	PrivateKey []byte
+}
+
+type pkixPublicKey struct {
+	Algo      pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+// parsePKCS8PrivateKey parses a PKCS #8 private key like x509.ParsePKCS8PrivateKey, which
+// supports Ed25519 keys only as of Go 1.13.
+func parsePKCS8PrivateKey(der []byte) (interface{}, error) {
+	var info pkcs8
+	if _, err := asn1.Unmarshal(der, &info); err != nil || !info.Algo.Algorithm.Equal(oidEd25519) {
+		return x509.ParsePKCS8PrivateKey(der)
+	}
+	var seed []byte
+	if _, err := asn1.Unmarshal(info.PrivateKey, &seed); err != nil || len(seed) != ed25519SeedSize {
+		return nil, errors.New("invalid Ed25519 private key")
+	}
+	_, sk, err := ed25519.GenerateKey(bytes.NewReader(seed)) // derives the key from the seed read from the reader
+	return sk, err
+}
+
+// parsePKIXPublicKey parses a PKIX public key like x509.ParsePKIXPublicKey, which supports
+// Ed25519 keys only as of Go 1.13.
+func parsePKIXPublicKey(der []byte) (interface{}, error) {
+	var info pkixPublicKey
+	if _, err := asn1.Unmarshal(der, &info); err != nil || !info.Algo.Algorithm.Equal(oidEd25519) {
+		return x509.ParsePKIXPublicKey(der)
+	}
+	if info.PublicKey.BitLength != 8*ed25519.PublicKeySize {
+		return nil, errors.New("invalid Ed25519 public key")
+	}
+	return ed25519.PublicKey(info.PublicKey.Bytes), nil
+}
@@ -295,6 +295,7 @@ func (ir *IssuanceRequest) UnmarshalJSON(bts []byte) (err error) {
 			Disclose    AttributeConDisCon       `json:"disclose"`
 			Labels      map[int]TranslatedString `json:"labels"`
 			Credentials []*CredentialRequest     `json:"credentials"`
+			Dynamic     bool                     `json:"dynamic"`
 		}
 		if err = json.Unmarshal(bts, &req); err != nil {
 			return err
@@ -302,6 +303,7 @@ func (ir *IssuanceRequest) UnmarshalJSON(bts []byte) (err error) {
 		*ir = IssuanceRequest{
 			DisclosureRequest: DisclosureRequest{req.BaseRequest, req.Disclose, req.Labels},
 			Credentials:       req.Credentials,
+			Dynamic:           req.Dynamic,
 		}
 		return nil
 	}
@@ -150,6 +150,18 @@ type Qr struct {
 
 type SchemeManagerRequest Qr
 
+// ServerSessionResponse is the response of the IRMA server to the proofs or commitments of the
+// client that finish an IRMA session, from protocol version 2.6 onwards.
+type ServerSessionResponse struct {
+	ProofStatus     ProofStatus                   `json:"proofStatus"`
+	IssueSignatures []*gabi.IssueSignatureMessage `json:"sigs,omitempty"`
+	// Session pointer of the follow-up session, if any, which the client continues into
+	NextSession *Qr `json:"nextSession,omitempty"`
+	// Credentials issued in dynamic issuance sessions, containing the attribute values computed
+	// by the issuer (from protocol version 2.7 onwards)
+	Credentials []*CredentialRequest `json:"credentials,omitempty"`
+}
+
 // Statuses
 const (
 	StatusConnected     = Status("connected")
@@ -70,6 +70,9 @@ type SignatureRequest struct {
 type IssuanceRequest struct {
 	DisclosureRequest
 	Credentials []*CredentialRequest `json:"credentials"`
+	// If true, the attribute values of the credentials are computed by the issuer from the
+	// attributes disclosed in the session, and attribute values specified here are not issued
+	Dynamic bool `json:"dynamic,omitempty"`
 
 	// Derived data
 	CredentialInfoList        CredentialInfoList `json:",omitempty"`
@@ -104,14 +107,28 @@ type ServerJwt struct {
 	Type       string    `json:"sub"`
 	ServerName string    `json:"iss"`
 	IssuedAt   Timestamp `json:"iat"`
+	ID         string    `json:"jti,omitempty"` // Identifier of the JWT, for servers that accept each JWT only once
+	Audience   string    `json:"aud,omitempty"` // Name of the server for which the JWT is meant
 }
 
 // RequestorBaseRequest contains fields present in all RequestorRequest types
 // with which the requestor configures an IRMA session.
 type RequestorBaseRequest struct {
-	ResultJwtValidity int    `json:"validity,omitempty"`    // Validity of session result JWT in seconds
-	ClientTimeout     int    `json:"timeout,omitempty"`     // Wait this many seconds for the IRMA app to connect before the session times out
-	CallbackURL       string `json:"callbackUrl,omitempty"` // URL to post session result to
+	ResultJwtValidity int              `json:"validity,omitempty"`        // Validity of session result JWT in seconds
+	ClientTimeout     int              `json:"timeout,omitempty"`         // Wait this many seconds for the IRMA app to connect before the session times out
+	SessionLifetime   int              `json:"sessionLifetime,omitempty"` // Time out the session if it has not finished this many seconds after it was started
+	ResultLifetime    int              `json:"resultLifetime,omitempty"`  // Keep the session result this many seconds after the session finished
+	CallbackURL       string           `json:"callbackUrl,omitempty"`     // URL to post session result to
+	EncryptResult     bool             `json:"encryptResult,omitempty"`   // Encrypt the session result to the result encryption key of the requestor
+	NextSession       *NextSessionData `json:"nextSession,omitempty"`     // Follow-up session to continue into after this session
+}
+
+// NextSessionData specifies how to obtain the follow-up session of a session, into which the IRMA
+// app continues without scanning another QR once the session has finished successfully.
+type NextSessionData struct {
+	// URL to which the session result is POSTed, returning the RequestorRequest of the follow-up
+	// session, or an empty response if there is none
+	URL string `json:"url"`
 }
 
 // RequestorRequest is the message with which requestors start an IRMA session. It contains a
@@ -138,6 +155,9 @@ type SignatureRequestorRequest struct {
 type IdentityProviderRequest struct {
 	RequestorBaseRequest
 	Request *IssuanceRequest `json:"request"`
+	// URL to which the session result is POSTed in dynamic issuance sessions, returning the
+	// credentials to issue as a JSON array of credential requests
+	CredentialsURL string `json:"credentialsUrl,omitempty"`
 }
 
 // ServiceProviderJwt is a requestor JWT for a disclosure session.
@@ -462,7 +482,11 @@ func (dr *DisclosureRequest) Validate() error {
 }
 
 func (cr *CredentialRequest) Info(conf *Configuration, metadataVersion byte) (*CredentialInfo, error) {
-	list, err := cr.AttributeList(conf, metadataVersion)
+	return cr.info(conf, metadataVersion, true)
+}
+
+func (cr *CredentialRequest) info(conf *Configuration, metadataVersion byte, requireAll bool) (*CredentialInfo, error) {
+	list, err := cr.attributeList(conf, metadataVersion, requireAll)
 	if err != nil {
 		return nil, err
 	}
@@ -473,6 +497,10 @@ func (cr *CredentialRequest) Info(conf *Configuration, metadataVersion byte) (*C
 // the credential type is known, all required attributes are present and no unknown attributes
 // are given.
 func (cr *CredentialRequest) Validate(conf *Configuration) error {
+	return cr.validate(conf, true)
+}
+
+func (cr *CredentialRequest) validate(conf *Configuration, requireAll bool) error {
 	credtype := conf.CredentialTypes[cr.CredentialTypeID]
 	if credtype == nil {
 		return errors.New("Credential request of unknown credential type")
@@ -494,7 +522,7 @@ func (cr *CredentialRequest) Validate(conf *Configuration) error {
 	}
 
 	for _, attrtype := range credtype.AttributeTypes {
-		if _, present := cr.Attributes[attrtype.ID]; !present && attrtype.Optional != "true" {
+		if _, present := cr.Attributes[attrtype.ID]; requireAll && !present && attrtype.Optional != "true" {
 			return errors.New("Required attribute not present in credential request")
 		}
 	}
@@ -504,7 +532,11 @@ func (cr *CredentialRequest) Validate(conf *Configuration) error {
 
 // AttributeList returns the list of attributes from this credential request.
 func (cr *CredentialRequest) AttributeList(conf *Configuration, metadataVersion byte) (*AttributeList, error) {
-	if err := cr.Validate(conf); err != nil {
+	return cr.attributeList(conf, metadataVersion, true)
+}
+
+func (cr *CredentialRequest) attributeList(conf *Configuration, metadataVersion byte, requireAll bool) (*AttributeList, error) {
+	if err := cr.validate(conf, requireAll); err != nil {
 		return nil, err
 	}
 
@@ -569,7 +601,8 @@ func (ir *IssuanceRequest) Identifiers() *IrmaIdentifierSet {
 func (ir *IssuanceRequest) GetCredentialInfoList(conf *Configuration, version *ProtocolVersion) (CredentialInfoList, error) {
 	if ir.CredentialInfoList == nil {
 		for _, credreq := range ir.Credentials {
-			info, err := credreq.Info(conf, GetMetadataVersion(version))
+			// Attributes of dynamic credential requests may be absent until the issuer computes them
+			info, err := credreq.info(conf, GetMetadataVersion(version), !ir.Dynamic)
 			if err != nil {
 				return nil, err
 			}
@@ -581,6 +614,25 @@ func (ir *IssuanceRequest) GetCredentialInfoList(conf *Configuration, version *P
 
 func (ir *IssuanceRequest) Action() Action { return ActionIssuing }
 
+// CheckDynamicCredentials checks that the credentials computed by the issuer in a dynamic issuance
+// session correspond to the credential requests of this request, i.e. that they have the same
+// credential types. The key counters, and validity dates if absent, are taken from this request.
+func (ir *IssuanceRequest) CheckDynamicCredentials(creds []*CredentialRequest) error {
+	if len(creds) != len(ir.Credentials) {
+		return errors.Errorf("expected %d dynamic credentials, got %d", len(ir.Credentials), len(creds))
+	}
+	for i, cred := range creds {
+		if cred == nil || cred.CredentialTypeID != ir.Credentials[i].CredentialTypeID {
+			return errors.Errorf("dynamic credential %d is not of type %s", i, ir.Credentials[i].CredentialTypeID)
+		}
+		cred.KeyCounter = ir.Credentials[i].KeyCounter
+		if cred.Validity == nil {
+			cred.Validity = ir.Credentials[i].Validity
+		}
+	}
+	return nil
+}
+
 func (ir *IssuanceRequest) Validate() error {
 	if ir.LDContext != LDContextIssuanceRequest {
 		return errors.New("Not an issuance request")
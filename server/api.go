@@ -54,6 +54,35 @@ type Configuration struct {
 	Email string `json:"email" mapstructure:"email"`
 	// Enable server sent events for status updates (experimental; tends to hang when a reverse proxy is used)
 	EnableSSE bool `json:"enable_sse" mapstructure:"enable_sse"`
+	// Maximum number of seconds that a long-polling status request waits for the session status
+	// to change (default value 0 means 30)
+	LongPollTimeout int `json:"long_poll_timeout" mapstructure:"long_poll_timeout"`
+	// Origins from which browsers may open status WebSockets, besides the origin of the server
+	// itself ("*" allows all)
+	WebSocketOrigins []string `json:"websocket_origins" mapstructure:"websocket_origins"`
+
+	// Where to keep session state: "memory" (default) or "bolt". The latter persists sessions to the
+	// file at SessionStorePath, so that running sessions and their results survive a restart.
+	// Neither can be shared by several servers; for that, see CustomSessionStore.
+	SessionStore string `json:"session_store" mapstructure:"session_store"`
+	// Path to the database file of the bolt session store
+	SessionStorePath string `json:"session_store_path" mapstructure:"session_store_path"`
+	// Session store to use instead of the one selected by SessionStore, e.g. one backed by a
+	// database that is shared by several servers
+	CustomSessionStore SessionStore `json:"-" mapstructure:"-"`
+
+	// Wait this many seconds for the IRMA app to connect before the session times out (default value 0 means 300)
+	ClientTimeout int `json:"client_timeout" mapstructure:"client_timeout"`
+	// Time out sessions that have not finished this many seconds after they were started, whether
+	// or not the IRMA app has connected (default value 0 means 300)
+	SessionLifetime int `json:"session_lifetime" mapstructure:"session_lifetime"`
+	// Keep the result of finished (i.e. done, cancelled or timed out) sessions for this many seconds (default value 0 means 300)
+	ResultLifetime int `json:"result_lifetime" mapstructure:"result_lifetime"`
+	// Maximum values that requestors may specify in their session requests for the three settings above
+	// (default value 0 means 3600, or the corresponding setting above if that is larger)
+	MaxClientTimeout   int `json:"max_client_timeout" mapstructure:"max_client_timeout"`
+	MaxSessionLifetime int `json:"max_session_lifetime" mapstructure:"max_session_lifetime"`
+	MaxResultLifetime  int `json:"max_result_lifetime" mapstructure:"max_result_lifetime"`
 
 	// Logging verbosity level: 0 is normal, 1 includes DEBUG level, 2 includes TRACE level
 	Verbose int `json:"verbose" mapstructure:"verbose"`
@@ -64,10 +93,32 @@ type Configuration struct {
 	// Custom logger instance. If specified, Verbose, Quiet and LogJSON are ignored.
 	Logger *logrus.Logger `json:"-"`
 
+	// Functions through which applications embedding the irmaserver library can intervene in sessions
+	Hooks Hooks `json:"-" mapstructure:"-"`
+
 	// Production mode: enables safer and stricter defaults and config checking
 	Production bool `json:"production" mapstructure:"production"`
 }
 
+// Hooks are functions that are called during sessions, allowing applications embedding the
+// irmaserver library to approve, modify or reject them. Each of them is optional. If a hook
+// returns an *irma.RemoteError, that error is passed on as is (to the requestor or the IRMA app);
+// other errors are passed on as an ErrorRejected containing the error message.
+// Except for StartSession, the hooks are called while the session is locked, so they must not
+// call functions of the server concerning the same session.
+type Hooks struct {
+	// Called when a session is started, after the session request has been validated.
+	// Returning an error rejects the session request.
+	StartSession func(request irma.RequestorRequest, requestor string) error
+	// Called just before the IRMA app fetches the session request, which the hook may modify.
+	// Returning an error cancels the session.
+	SessionRequest func(token string, request irma.SessionRequest) error
+	// Called after the disclosure of a disclosure or signature session has been verified,
+	// with the session result containing the disclosed attributes. Returning an error vetoes the
+	// disclosure, cancelling the session.
+	Disclosure func(result *SessionResult) error
+}
+
 type SessionPackage struct {
 	SessionPtr *irma.Qr `json:"sessionPtr"`
 	Token      string   `json:"token"`
@@ -83,10 +134,24 @@ type SessionResult struct {
 	Disclosed   [][]*irma.DisclosedAttribute `json:"disclosed,omitempty"`
 	Signature   *irma.SignedMessage          `json:"signature,omitempty"`
 	Err         *irma.RemoteError            `json:"error,omitempty"`
+	NextSession string                       `json:"nextSession,omitempty"` // Token of the follow-up session, if any
 
 	LegacySession bool `json:"-"` // true if request was started with legacy (i.e. pre-condiscon) session request
 }
 
+// SessionInfo contains information about a session for server administrators.
+type SessionInfo struct {
+	Token           string                `json:"token"`
+	Tenant          string                `json:"tenant,omitempty"`
+	Requestor       string                `json:"requestor"`
+	Type            irma.Action           `json:"type"`
+	Status          Status                `json:"status"`
+	Created         time.Time             `json:"created"`
+	Age             int64                 `json:"age"` // in seconds
+	ProtocolVersion *irma.ProtocolVersion `json:"protocolVersion,omitempty"`
+	Request         irma.RequestorRequest `json:"request,omitempty"` // without attribute values
+}
+
 // Status is the status of an IRMA session.
 type Status string
 
@@ -98,6 +163,22 @@ const (
 	StatusTimeout     Status = "TIMEOUT"     // Session timed out
 )
 
+// Readiness reports whether the server is ready to handle IRMA sessions, along with the state of
+// each of the components that it depends on. The server is ready iff all of its components are.
+type Readiness struct {
+	Ready         bool                        `json:"ready"`
+	Schemes       map[string]*ComponentStatus `json:"schemes"`
+	Issuers       map[string]*ComponentStatus `json:"issuers,omitempty"`
+	JwtPrivateKey *ComponentStatus            `json:"jwtPrivateKey,omitempty"`
+}
+
+// ComponentStatus is the state of a component of the server.
+type ComponentStatus struct {
+	Ready  bool   `json:"ready"`
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
 // Remove this when dropping support for legacy pre-condiscon session requests
 type LegacySessionResult struct {
 	Token       string                     `json:"token"`
@@ -33,4 +33,7 @@ var (
 	ErrorUnsupported     Error = Error{Type: "UNSUPPORTED", Status: 501, Description: "Unsupported by this server"}
 	ErrorInvalidRequest  Error = Error{Type: "INVALID_REQUEST", Status: 400, Description: "Invalid HTTP request"}
 	ErrorProtocolVersion Error = Error{Type: "PROTOCOL_VERSION", Status: 400, Description: "Protocol version negotiation failed"}
+	ErrorShuttingDown    Error = Error{Type: "SHUTTING_DOWN", Status: 503, Description: "Server is shutting down, try again later"}
+	ErrorRateLimited     Error = Error{Type: "RATE_LIMITED", Status: 429, Description: "Rate limit exceeded, try again later"}
+	ErrorRejected        Error = Error{Type: "REJECTED", Status: 403, Description: "Rejected by the server"}
 )
@@ -69,7 +69,7 @@ func StartSession(requestString *C.char) C.struct_StartSessionReturn {
 	}
 
 	// Run the actual core function
-	qr, token, err := s.StartSession(C.GoString(requestString))
+	qr, token, err := s.StartSession(C.GoString(requestString), "")
 
 	// And properly return the result
 	if err != nil {
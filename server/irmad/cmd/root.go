@@ -36,6 +36,9 @@ var RootCommand = &cobra.Command{
 		stopped := make(chan struct{})
 		interrupt := make(chan os.Signal, 1)
 		signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+		hangup := make(chan os.Signal, 1)
+		signal.Notify(hangup, syscall.SIGHUP)
+		var draining bool
 
 		go func() {
 			if err := serv.Start(conf); err != nil {
@@ -48,13 +51,27 @@ var RootCommand = &cobra.Command{
 		for {
 			select {
 			case <-interrupt:
+				if draining {
+					conf.Logger.Warn("Caught second interrupt, exiting without draining")
+					os.Exit(1)
+				}
 				conf.Logger.Debug("Caught interrupt")
-				serv.Stop() // causes serv.Start() above to return
-				conf.Logger.Debug("Sent stop signal to server")
+				draining = true
+				go serv.Drain() // stops the server afterwards, causing serv.Start() above to return
+			case <-hangup:
+				conf.Logger.Info("Caught SIGHUP, reloading configuration")
+				newconf, err := reloadConfiguration()
+				if err == nil {
+					err = serv.Reload(newconf)
+				}
+				if err != nil {
+					_ = server.LogError(errors.WrapPrefix(err, "Failed to reload configuration", 0))
+				}
 			case <-stopped:
 				conf.Logger.Info("Exiting")
 				close(stopped)
 				close(interrupt)
+				signal.Stop(hangup)
 				return
 			}
 		}
@@ -110,6 +127,16 @@ func setFlags(cmd *cobra.Command, production bool) error {
 	flags.String("static-prefix", "/", "Host static files under this URL prefix")
 	flags.StringP("url", "u", defaulturl, "external URL to server to which the IRMA client connects, \":port\" being replaced by --port value")
 	flags.Bool("sse", false, "Enable server sent for status updates (experimental)")
+	flags.Int("long-poll-timeout", 30, "maximum seconds that a long-polling status request waits for a status change")
+	flags.StringSlice("websocket-origins", nil, "origins from which browsers may open status WebSockets (default: same origin only)")
+	flags.String("session-store", "memory", "where to keep sessions: memory or bolt")
+	flags.String("session-store-path", "", "path to the session database file (required with --session-store bolt)")
+	flags.Int("client-timeout", 300, "seconds to wait for the IRMA app to connect before a session times out")
+	flags.Int("session-lifetime", 300, "seconds after its start after which a session that has not finished times out")
+	flags.Int("result-lifetime", 300, "seconds to keep the result of a finished session")
+	flags.Int("max-client-timeout", 0, "maximum client timeout requestors may specify (default 3600)")
+	flags.Int("max-session-lifetime", 0, "maximum session lifetime requestors may specify (default 3600)")
+	flags.Int("max-result-lifetime", 0, "maximum result lifetime requestors may specify (default 3600)")
 
 	flags.IntP("port", "p", 8088, "port at which to listen")
 	flags.StringP("listen-addr", "l", "", "address at which to listen (default 0.0.0.0)")
@@ -126,19 +153,34 @@ func setFlags(cmd *cobra.Command, production bool) error {
 		issHelp += " (default *)"
 	}
 	flags.StringSlice("issue-perms", nil, issHelp)
+	flags.String("value-perms", "", "values that requestors may request per attribute (in JSON)")
 	flags.String("static-sessions", "", "preconfigured static sessions (in JSON)")
 	flags.Lookup("no-auth").Header = `Requestor authentication and default requestor permissions`
 
 	flags.StringP("jwt-issuer", "j", "irmaserver", "JWT issuer")
-	flags.String("jwt-privkey", "", "JWT private key")
+	flags.String("jwt-privkey", "", "JWT private key (RSA, ECDSA P-256 or Ed25519)")
 	flags.String("jwt-privkey-file", "", "path to JWT private key")
+	flags.String("jwt-kid", "", "key ID of JWT private key (default: its JWK thumbprint)")
+	flags.String("jwt-verification-keys", "", "keys by their key ID that are published along with the JWT private key (in JSON)")
 	flags.Int("max-request-age", 300, "max age in seconds of a session request JWT")
+	flags.Bool("jwt-require-audience", false, "require the aud field of session request JWTs to equal the JWT issuer")
+	flags.Bool("jwt-require-id", false, "require session request JWTs to have a jti field and accept each JWT only once (remembered in memory, so per process)")
+	flags.Int("jwt-replay-cache-size", 100000, "max number of used session request JWTs to remember per requestor")
 	flags.Lookup("jwt-issuer").Header = `JWT configuration`
 
+	flags.String("callback-key", "", "key (base64 encoded) to sign result callbacks with using HMAC-SHA256")
+	flags.String("callback-key-file", "", "path to key to sign result callbacks with using HMAC-SHA256")
+	flags.Int("callback-max-retries", 10, "max number of retries of a failed result callback")
+	flags.Int("callback-max-backoff", 3600, "max time in seconds between two attempts of a result callback")
+	flags.String("callback-outbox", "", "database file in which to keep pending result callbacks across restarts")
+	flags.Lookup("callback-key").Header = `Result callbacks`
+
 	flags.String("tls-cert", "", "TLS certificate (chain)")
 	flags.String("tls-cert-file", "", "path to TLS certificate (chain)")
 	flags.String("tls-privkey", "", "TLS private key")
 	flags.String("tls-privkey-file", "", "path to TLS private key")
+	flags.String("tls-client-ca", "", "CA certificate(s) to verify client certificates of requestors against")
+	flags.String("tls-client-ca-file", "", "path to CA certificate(s) to verify client certificates of requestors against")
 	flags.String("client-tls-cert", "", "TLS certificate (chain) for IRMA app server")
 	flags.String("client-tls-cert-file", "", "path to TLS certificate (chain) for IRMA app server")
 	flags.String("client-tls-privkey", "", "TLS private key for IRMA app server")
@@ -146,6 +188,24 @@ func setFlags(cmd *cobra.Command, production bool) error {
 	flags.Bool("no-tls", false, "Disable TLS")
 	flags.Lookup("tls-cert").Header = "TLS configuration (leave empty to disable TLS)"
 
+	flags.String("oidc-clients", "", "OpenID Connect clients (in JSON)")
+	flags.String("oidc-issuer", "", "external URL of the OpenID Connect provider (default: --url with irma/ replaced by oidc)")
+	flags.Int("oidc-token-lifetime", 300, "lifetime in seconds of OpenID Connect ID tokens and access tokens")
+	flags.Lookup("oidc-clients").Header = "OpenID Connect provider (leave oidc-clients empty to disable)"
+
+	flags.Int("admin-port", 0, "if specified, start a server for the admin API at this port")
+	flags.String("admin-listen-addr", "", "address at which server for the admin API listens")
+	flags.String("admin-key", "", "token with which requests to the admin API must authenticate")
+	flags.String("admin-key-file", "", "path to token with which requests to the admin API must authenticate")
+	flags.Lookup("admin-port").Header = "Admin API (leave admin-port empty to disable)"
+
+	flags.Int("metrics-port", 0, "if specified, expose metrics in Prometheus format at /metrics at this port, which should not be public")
+	flags.String("metrics-listen-addr", "", "address at which server for metrics listens")
+	flags.Lookup("metrics-port").Header = "Metrics (leave metrics-port empty to disable)"
+
+	flags.String("tenants", "", "tenants hosted in addition to the default tenant, selected by host and/or path prefix (in JSON)")
+	flags.Lookup("tenants").Header = "Multi-tenant hosting (leave empty to host only the default tenant)"
+
 	flags.StringP("email", "e", "", "Email address of server admin, for incidental notifications such as breaking API changes")
 	flags.Bool("no-email", !production, "Opt out of prodiding an email address with --email")
 	flags.Lookup("email").Header = "Email address (see README for more info)"
@@ -153,6 +213,8 @@ func setFlags(cmd *cobra.Command, production bool) error {
 	flags.CountP("verbose", "v", "verbose (repeatable)")
 	flags.BoolP("quiet", "q", false, "quiet")
 	flags.Bool("log-json", false, "Log in JSON format")
+	flags.Int("client-rate-limit", 0, "max requests per minute to the IRMA app endpoints per IP address (0 means unlimited)")
+	flags.Int("drain-timeout", 60, "Max time in seconds to wait for running sessions and callbacks when shutting down")
 	flags.Bool("production", false, "Production mode")
 	flags.Lookup("verbose").Header = `Other options`
 
@@ -211,8 +273,30 @@ func configure(cmd *cobra.Command) error {
 		logger.Info("Config file: ", viper.ConfigFileUsed())
 	}
 
-	// Read configuration from flags and/or environmental variables
-	conf = &requestorserver.Configuration{
+	conf, err = readConfiguration()
+	if err != nil {
+		return err
+	}
+
+	logger.Debug("Done configuring")
+
+	return nil
+}
+
+// reloadConfiguration re-reads the configuration file, returning the resulting configuration.
+func reloadConfiguration() (*requestorserver.Configuration, error) {
+	if err := viper.ReadInConfig(); err != nil {
+		if _, notfound := err.(viper.ConfigFileNotFoundError); !notfound {
+			return nil, errors.WrapPrefix(err, "Failed to unmarshal configuration file at "+viper.ConfigFileUsed(), 0)
+		}
+	}
+	return readConfiguration()
+}
+
+// readConfiguration reads the configuration from the configuration file, flags and/or
+// environmental variables.
+func readConfiguration() (*requestorserver.Configuration, error) {
+	conf := &requestorserver.Configuration{
 		Configuration: &server.Configuration{
 			SchemesPath:           viper.GetString("schemes-path"),
 			SchemesAssetsPath:     viper.GetString("schemes-assets-path"),
@@ -223,6 +307,16 @@ func configure(cmd *cobra.Command) error {
 			DisableTLS:            viper.GetBool("no-tls"),
 			Email:                 viper.GetString("email"),
 			EnableSSE:             viper.GetBool("sse"),
+			LongPollTimeout:       viper.GetInt("long-poll-timeout"),
+			WebSocketOrigins:      viper.GetStringSlice("websocket-origins"),
+			SessionStore:          viper.GetString("session-store"),
+			SessionStorePath:      viper.GetString("session-store-path"),
+			ClientTimeout:         viper.GetInt("client-timeout"),
+			SessionLifetime:       viper.GetInt("session-lifetime"),
+			ResultLifetime:        viper.GetInt("result-lifetime"),
+			MaxClientTimeout:      viper.GetInt("max-client-timeout"),
+			MaxSessionLifetime:    viper.GetInt("max-session-lifetime"),
+			MaxResultLifetime:     viper.GetInt("max-result-lifetime"),
 			Verbose:               viper.GetInt("verbose"),
 			Quiet:                 viper.GetBool("quiet"),
 			LogJSON:               viper.GetBool("log-json"),
@@ -243,14 +337,36 @@ func configure(cmd *cobra.Command) error {
 		JwtIssuer:                      viper.GetString("jwt-issuer"),
 		JwtPrivateKey:                  viper.GetString("jwt-privkey"),
 		JwtPrivateKeyFile:              viper.GetString("jwt-privkey-file"),
+		JwtKeyID:                       viper.GetString("jwt-kid"),
 		MaxRequestAge:                  viper.GetInt("max-request-age"),
+		JwtRequireAudience:             viper.GetBool("jwt-require-audience"),
+		JwtRequireID:                   viper.GetBool("jwt-require-id"),
+		JwtReplayCacheSize:             viper.GetInt("jwt-replay-cache-size"),
+		CallbackKey:                    viper.GetString("callback-key"),
+		CallbackKeyFile:                viper.GetString("callback-key-file"),
+		CallbackMaxRetries:             viper.GetInt("callback-max-retries"),
+		CallbackMaxBackoff:             viper.GetInt("callback-max-backoff"),
+		CallbackOutboxPath:             viper.GetString("callback-outbox"),
 		StaticPath:                     viper.GetString("static-path"),
 		StaticPrefix:                   viper.GetString("static-prefix"),
+		ClientRateLimit:                viper.GetInt("client-rate-limit"),
+		DrainTimeout:                   viper.GetInt("drain-timeout"),
+		MetricsPort:                    viper.GetInt("metrics-port"),
+		MetricsListenAddress:           viper.GetString("metrics-listen-addr"),
+		AdminPort:                      viper.GetInt("admin-port"),
+		AdminListenAddress:             viper.GetString("admin-listen-addr"),
+		AdminKey:                       viper.GetString("admin-key"),
+		AdminKeyFile:                   viper.GetString("admin-key-file"),
+		OidcIssuer:                     viper.GetString("oidc-issuer"),
+		OidcTokenLifetime:              viper.GetInt("oidc-token-lifetime"),
+		ReadConfiguration:              reloadConfiguration,
 
 		TlsCertificate:           viper.GetString("tls-cert"),
 		TlsCertificateFile:       viper.GetString("tls-cert-file"),
 		TlsPrivateKey:            viper.GetString("tls-privkey"),
 		TlsPrivateKeyFile:        viper.GetString("tls-privkey-file"),
+		TlsClientCA:              viper.GetString("tls-client-ca"),
+		TlsClientCAFile:          viper.GetString("tls-client-ca-file"),
 		ClientTlsCertificate:     viper.GetString("client-tls-cert"),
 		ClientTlsCertificateFile: viper.GetString("client-tls-cert-file"),
 		ClientTlsPrivateKey:      viper.GetString("client-tls-privkey"),
@@ -259,33 +375,44 @@ func configure(cmd *cobra.Command) error {
 
 	if conf.Production {
 		if !viper.GetBool("no-email") && conf.Email == "" {
-			return errors.New("In production mode it is required to specify either an email address with the --email flag, or explicitly opting out with --no-email. See help or README for more info.")
+			return nil, errors.New("In production mode it is required to specify either an email address with the --email flag, or explicitly opting out with --no-email. See help or README for more info.")
 		}
 		if viper.GetBool("no-email") && conf.Email != "" {
-			return errors.New("--no-email cannot be combined with --email")
+			return nil, errors.New("--no-email cannot be combined with --email")
 		}
 	}
 
 	// Handle requestors
 	var requestors map[string]interface{}
+	var err error
 	if val, flagOrEnv := viper.Get("requestors").(string); !flagOrEnv || val != "" {
 		if requestors, err = cast.ToStringMapE(viper.Get("requestors")); err != nil {
-			return errors.WrapPrefix(err, "Failed to unmarshal requestors from flag or env var", 0)
+			return nil, errors.WrapPrefix(err, "Failed to unmarshal requestors from flag or env var", 0)
 		}
 	}
 	if len(requestors) > 0 {
 		if err := mapstructure.Decode(requestors, &conf.Requestors); err != nil {
-			return errors.WrapPrefix(err, "Failed to unmarshal requestors from config file", 0)
+			return nil, errors.WrapPrefix(err, "Failed to unmarshal requestors from config file", 0)
 		}
 	}
 
 	if err = handleMapOrString("static-sessions", &conf.StaticSessions); err != nil {
-		return err
+		return nil, err
+	}
+	if err = handleMapOrString("jwt-verification-keys", &conf.JwtVerificationKeys); err != nil {
+		return nil, err
+	}
+	if err = handleMapOrString("value-perms", &conf.Values); err != nil {
+		return nil, err
+	}
+	if err = handleMapOrString("oidc-clients", &conf.OidcClients); err != nil {
+		return nil, err
+	}
+	if err = handleMapOrString("tenants", &conf.Tenants); err != nil {
+		return nil, err
 	}
 
-	logger.Debug("Done configuring")
-
-	return nil
+	return conf, nil
 }
 
 func handleMapOrString(key string, dest interface{}) error {
@@ -7,6 +7,8 @@ package irmaserver
 import (
 	"io/ioutil"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/go-errors/errors"
 	"github.com/privacybydesign/irmago"
@@ -17,13 +19,51 @@ import (
 // Server is an irmaserver instance.
 type Server struct {
 	*servercore.Server
-	handlers map[string]SessionHandler
+	runningHandlers *sync.WaitGroup
 }
 
 // SessionHandler is a function that can handle a session result
 // once an IRMA session has completed.
 type SessionHandler func(*server.SessionResult)
 
+// NextSessionHandler returns the request of the follow-up session of the specified session that
+// has finished successfully, into which the IRMA app continues without scanning another QR, or
+// nil if there is none. The request can be of any of the types accepted by StartSession().
+// The handler is called while the session is finishing: the IRMA app awaits the follow-up session,
+// and the session becomes DONE, with the token of the follow-up session in its result, only once
+// the handler has returned.
+type NextSessionHandler func(*server.SessionResult) (interface{}, error)
+
+// CredentialsHandler computes the credentials to issue in a dynamic issuance session, from the
+// session result containing the attributes disclosed in the session. The returned credentials
+// must be of the same credential types as those in the issuance request; their key counters are
+// taken from the request, as are their validity dates if absent. Meanwhile the IRMA app awaits
+// the issuance, but requests concerning the session, e.g. status requests, are handled.
+type CredentialsHandler func(*server.SessionResult, *irma.IssuanceRequest) ([]*irma.CredentialRequest, error)
+
+// SessionHandlers contains the handlers of a session, each of which is optional.
+type SessionHandlers struct {
+	// Handles the session result once the session has completed
+	Result SessionHandler
+	// Determines the follow-up session once the session has finished successfully
+	Next NextSessionHandler
+	// Computes the credentials of dynamic issuance sessions; required for those
+	Credentials CredentialsHandler
+	// Called when the session has finished, whatever its status: unlike Result, also when the
+	// session timed out or was cancelled by the requestor
+	Finished SessionHandler
+}
+
+// ErrDraining is returned when starting a session while the server is being drained.
+var ErrDraining = servercore.ErrDraining
+
+// ErrUnknownSession is returned by WaitStatus and SubscribeStatusWebSocket for unknown sessions.
+var ErrUnknownSession = servercore.ErrUnknownSession
+
+// ErrWebSocketUpgrade is returned by SubscribeStatusWebSocket if the request could not be upgraded
+// to a WebSocket connection, in which case the error response has already been written.
+var ErrWebSocketUpgrade = servercore.ErrWebSocketUpgrade
+
 // Default server instance
 var s *Server
 
@@ -40,8 +80,26 @@ func New(conf *server.Configuration) (*Server, error) {
 		return nil, err
 	}
 	return &Server{
-		Server:   s,
-		handlers: make(map[string]SessionHandler),
+		Server:          s,
+		runningHandlers: &sync.WaitGroup{},
+	}, nil
+}
+
+// NewTenant creates a Server for the named tenant, which shares the parsed schemes and session
+// store of the server, but otherwise uses the specified configuration
+// (notably its URL and issuer private keys). The sessions of a tenant can be managed only through
+// its own Server, while the HandlerFunc() of any of them can handle the sessions of all tenants.
+func NewTenant(name string, conf *server.Configuration) (*Server, error) {
+	return s.NewTenant(name, conf)
+}
+func (s *Server) NewTenant(name string, conf *server.Configuration) (*Server, error) {
+	t, err := s.Server.NewTenant(name, conf)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		Server:          t,
+		runningHandlers: s.runningHandlers,
 	}, nil
 }
 
@@ -53,6 +111,27 @@ func (s *Server) Stop() {
 	s.Server.Stop()
 }
 
+// Drain makes the server refuse new sessions, and waits until all running sessions have finished
+// and their handlers have returned, or until the deadline has passed. It returns whether all
+// sessions have finished. Drain does not stop the server; call Stop() afterwards.
+func Drain(deadline time.Time) bool {
+	return s.Drain(deadline)
+}
+func (s *Server) Drain(deadline time.Time) bool {
+	finished := s.Server.Drain(deadline)
+	done := make(chan struct{})
+	go func() {
+		s.runningHandlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return finished
+	case <-time.After(time.Until(deadline)):
+		return false
+	}
+}
+
 // StartSession starts an IRMA session, running the handler on completion, if specified.
 // The session token (the second return parameter) can be used in GetSessionResult()
 // and CancelSession().
@@ -62,14 +141,56 @@ func StartSession(request interface{}, handler SessionHandler) (*irma.Qr, string
 	return s.StartSession(request, handler)
 }
 func (s *Server) StartSession(request interface{}, handler SessionHandler) (*irma.Qr, string, error) {
-	qr, token, err := s.Server.StartSession(request)
-	if err != nil {
-		return nil, "", err
+	return s.StartSessionWithHandlers(request, "", SessionHandlers{Result: handler})
+}
+
+// StartSessionWithHandlers is like StartSession, additionally recording the name of the requestor
+// on behalf of which the session is started (used in logging and metrics), and specifying all
+// handlers of the session. Follow-up sessions, determined by the Next handler once the session has
+// finished successfully, are started with the same requestor and handlers, so that sessions can be
+// chained repeatedly. Only IRMA apps supporting protocol version 2.6 or higher continue into
+// follow-up sessions.
+func StartSessionWithHandlers(request interface{}, requestor string, handlers SessionHandlers) (*irma.Qr, string, error) {
+	return s.StartSessionWithHandlers(request, requestor, handlers)
+}
+func (s *Server) StartSessionWithHandlers(request interface{}, requestor string, handlers SessionHandlers) (*irma.Qr, string, error) {
+	return s.Server.StartSessionWithHandlers(request, requestor, s.coreHandlers(requestor, handlers))
+}
+
+// SetRestoredHandlers sets the function providing the handlers of sessions that were not started
+// by the server, but restored from the session store: after a restart of the server, or because
+// they were started by another server sharing the session store. Without it, restored sessions
+// have no handlers; in particular, dynamic issuance sessions then fail.
+func SetRestoredHandlers(f func(requestor string) SessionHandlers) {
+	s.SetRestoredHandlers(f)
+}
+func (s *Server) SetRestoredHandlers(f func(requestor string) SessionHandlers) {
+	s.Server.SetRestoredHandlers(func(requestor string) servercore.SessionHandlers {
+		return s.coreHandlers(requestor, f(requestor))
+	})
+}
+
+func (s *Server) coreHandlers(requestor string, handlers SessionHandlers) servercore.SessionHandlers {
+	var core servercore.SessionHandlers
+	if handlers.Result != nil {
+		core.Result = servercore.ResultHandler(handlers.Result)
+	}
+	if handlers.Next != nil {
+		core.Next = func(result *server.SessionResult) (*irma.Qr, string, error) {
+			request, err := handlers.Next(result)
+			if err != nil || request == nil {
+				return nil, "", err
+			}
+			return s.StartSessionWithHandlers(request, requestor, handlers)
+		}
+	}
+	if handlers.Credentials != nil {
+		core.Credentials = servercore.CredentialsComputer(handlers.Credentials)
 	}
-	if handler != nil {
-		s.handlers[token] = handler
+	if handlers.Finished != nil {
+		core.Finished = servercore.ResultHandler(handlers.Finished)
 	}
-	return qr, token, nil
+	return core
 }
 
 // GetSessionResult retrieves the result of the specified IRMA session.
@@ -96,6 +217,58 @@ func (s *Server) CancelSession(token string) error {
 	return s.Server.CancelSession(token)
 }
 
+// Readiness reports whether the server is ready to handle sessions, along with the state of
+// the schemes and issuer private keys.
+func Readiness() *server.Readiness {
+	return s.Readiness()
+}
+func (s *Server) Readiness() *server.Readiness {
+	return s.Server.Readiness()
+}
+
+// Sessions returns information about all sessions currently held by the server.
+func Sessions() []*server.SessionInfo {
+	return s.Sessions()
+}
+func (s *Server) Sessions() []*server.SessionInfo {
+	return s.Server.Sessions()
+}
+
+// SessionInfo returns information about the specified session, including its request from which
+// all attribute values are removed.
+func SessionInfo(token string) *server.SessionInfo {
+	return s.SessionInfo(token)
+}
+func (s *Server) SessionInfo(token string) *server.SessionInfo {
+	return s.Server.SessionInfo(token)
+}
+
+// SessionPointer returns the session pointer of the specified session, to be passed to the IRMA
+// app, or nil if the session is unknown.
+func SessionPointer(token string) *irma.Qr {
+	return s.SessionPointer(token)
+}
+func (s *Server) SessionPointer(token string) *irma.Qr {
+	return s.Server.SessionPointer(token)
+}
+
+// UnfinishedSessions returns the number of sessions of the specified requestor that have not yet finished.
+func UnfinishedSessions(requestor string) int {
+	return s.UnfinishedSessions(requestor)
+}
+func (s *Server) UnfinishedSessions(requestor string) int {
+	return s.Server.UnfinishedSessions(requestor)
+}
+
+// CancelRequestorSessions cancels all unfinished sessions of the specified requestor, returning
+// the number of cancelled sessions.
+func CancelRequestorSessions(requestor string) int {
+	return s.CancelRequestorSessions(requestor)
+}
+func (s *Server) CancelRequestorSessions(requestor string) int {
+	return s.Server.CancelRequestorSessions(requestor)
+}
+
 // SubscribeServerSentEvents subscribes the HTTP client to server sent events on status updates
 // of the specified IRMA session.
 func SubscribeServerSentEvents(w http.ResponseWriter, r *http.Request, token string, requestor bool) error {
@@ -105,6 +278,39 @@ func (s *Server) SubscribeServerSentEvents(w http.ResponseWriter, r *http.Reques
 	return s.Server.SubscribeServerSentEvents(w, r, token, requestor)
 }
 
+// WaitStatus waits until the status of the specified IRMA session differs from the specified
+// status, or until the long-poll timeout of the server configuration has passed, and returns the
+// status of the session.
+func WaitStatus(token string, requestor bool, status server.Status) (server.Status, error) {
+	return s.WaitStatus(token, requestor, status)
+}
+func (s *Server) WaitStatus(token string, requestor bool, status server.Status) (server.Status, error) {
+	return s.Server.WaitStatus(token, requestor, status)
+}
+
+// SubscribeStatusWebSocket upgrades the HTTP request to a WebSocket connection over which status
+// updates of the specified IRMA session are sent, until the session has finished. Browsers may
+// connect only from the origin of the server or from the origins in the WebSocketOrigins option.
+func SubscribeStatusWebSocket(w http.ResponseWriter, r *http.Request, token string, requestor bool) error {
+	return s.SubscribeStatusWebSocket(w, r, token, requestor)
+}
+func (s *Server) SubscribeStatusWebSocket(w http.ResponseWriter, r *http.Request, token string, requestor bool) error {
+	return s.Server.SubscribeStatusWebSocket(w, r, token, requestor)
+}
+
+// WriteStatusError writes the error returned by WaitStatus or SubscribeStatusWebSocket,
+// unless it has already been written (ErrWebSocketUpgrade).
+func WriteStatusError(w http.ResponseWriter, err error) {
+	if err == ErrWebSocketUpgrade {
+		return
+	}
+	if err == ErrUnknownSession {
+		server.WriteError(w, server.ErrorSessionUnknown, "")
+	} else {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+	}
+}
+
 // HandlerFunc returns a http.HandlerFunc that handles the IRMA protocol
 // with IRMA apps.
 //
@@ -137,6 +343,21 @@ func (s *Server) HandlerFunc() http.HandlerFunc {
 			}
 			return
 		}
+		if err == nil && noun == "statussocket" {
+			if err = s.SubscribeStatusWebSocket(w, r, token, false); err != nil {
+				WriteStatusError(w, err)
+			}
+			return
+		}
+		if err == nil && noun == "status" && r.Method == http.MethodGet && r.URL.Query().Get("wait") != "" {
+			status, err := s.WaitStatus(token, false, server.Status(r.URL.Query().Get("wait")))
+			if err != nil {
+				WriteStatusError(w, err)
+				return
+			}
+			server.WriteJson(w, status)
+			return
+		}
 
 		status, response, result := s.HandleProtocolMessage(r.URL.Path, r.Method, r.Header, message)
 		w.WriteHeader(status)
@@ -145,8 +366,12 @@ func (s *Server) HandlerFunc() http.HandlerFunc {
 			_ = server.LogError(errors.WrapPrefix(err, "http.ResponseWriter.Write() returned error", 0))
 		}
 		if result != nil && result.Status.Finished() {
-			if handler := s.handlers[result.Token]; handler != nil {
-				go handler(result)
+			if handler := s.SessionResultHandler(result.Token); handler != nil {
+				s.runningHandlers.Add(1)
+				go func() {
+					defer s.runningHandlers.Done()
+					handler(result)
+				}()
 			}
 		}
 	}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"rsc.io/qr"
+)
+
+const (
+	// QrDefaultSize is the default width and height in pixels of rendered QR images.
+	QrDefaultSize = 300
+	// QrMinSize and QrMaxSize bound the size in pixels of rendered QR images.
+	QrMinSize = 50
+	QrMaxSize = 2000
+
+	// Number of modules of the empty border around rendered QRs, as required by the QR specification
+	qrQuietZone = 4
+	// Number of modules of the empty border around QRs rendered in the terminal
+	qrTerminalQuietZone = 2
+
+	qrTerminalBlack = "\033[40m  \033[0m"
+	qrTerminalWhite = "\033[47m  \033[0m"
+
+	universalLinkPrefix = "https://irma.app/-/session#"
+	intentPrefix        = "intent://qr/json/"
+	intentSuffix        = "#Intent;package=org.irmacard.cardemu;scheme=irma;end"
+)
+
+// SessionLinks contains links that start the session of a session pointer in the IRMA app,
+// for use on mobile devices on which the session pointer cannot be scanned as a QR.
+type SessionLinks struct {
+	// Universal link (iOS) or app link (Android), which opens the IRMA app if installed,
+	// and otherwise a webpage explaining how to install it
+	Universal string `json:"universal"`
+	// Android intent URL, which opens the IRMA app if installed and otherwise the Play Store
+	Intent string `json:"intent"`
+}
+
+// encodeQr encodes the JSON representation of the session pointer into a QR code.
+func encodeQr(qrptr *irma.Qr) (*qr.Code, error) {
+	bts, err := json.Marshal(qrptr)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "failed to marshal session pointer", 0)
+	}
+	code, err := qr.Encode(string(bts), qr.L)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "failed to encode session pointer as QR", 0)
+	}
+	return code, nil
+}
+
+// QrSizeValid checks that the specified size of a QR image lies within QrMinSize and QrMaxSize.
+func QrSizeValid(size int) error {
+	if size < QrMinSize || size > QrMaxSize {
+		return errors.Errorf("QR size must be between %d and %d pixels", QrMinSize, QrMaxSize)
+	}
+	return nil
+}
+
+// QrPNG renders the session pointer as a PNG image of the specified width and height in pixels.
+// Since each QR module is rendered using a whole number of pixels, the image may be slightly
+// smaller than specified.
+func QrPNG(qrptr *irma.Qr, size int) ([]byte, error) {
+	if err := QrSizeValid(size); err != nil {
+		return nil, err
+	}
+	code, err := encodeQr(qrptr)
+	if err != nil {
+		return nil, err
+	}
+	code.Scale = size / (code.Size + 2*qrQuietZone)
+	if code.Scale < 1 {
+		code.Scale = 1
+	}
+	return code.PNG(), nil
+}
+
+// QrSVG renders the session pointer as an SVG image of the specified width and height in pixels.
+func QrSVG(qrptr *irma.Qr, size int) ([]byte, error) {
+	if err := QrSizeValid(size); err != nil {
+		return nil, err
+	}
+	code, err := encodeQr(qrptr)
+	if err != nil {
+		return nil, err
+	}
+
+	n := code.Size + 2*qrQuietZone
+	var svg bytes.Buffer
+	fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size, n, n)
+	fmt.Fprintf(&svg, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, n, n)
+	for y := 0; y < code.Size; y++ {
+		for x := 0; x < code.Size; x++ {
+			if code.Black(x, y) {
+				fmt.Fprintf(&svg, "M%d %dh1v1h-1z", x+qrQuietZone, y+qrQuietZone)
+			}
+		}
+	}
+	svg.WriteString(`"/></svg>`)
+	return svg.Bytes(), nil
+}
+
+// PrintQrTerminal renders the session pointer as a QR to the specified writer, using ANSI escape
+// codes to draw black and white blocks.
+func PrintQrTerminal(w io.Writer, qrptr *irma.Qr) error {
+	code, err := encodeQr(qrptr)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	for y := -qrTerminalQuietZone; y < code.Size+qrTerminalQuietZone; y++ {
+		for x := -qrTerminalQuietZone; x < code.Size+qrTerminalQuietZone; x++ {
+			// Black returns false outside of the code, rendering the quiet zone white
+			if code.Black(x, y) {
+				out.WriteString(qrTerminalBlack)
+			} else {
+				out.WriteString(qrTerminalWhite)
+			}
+		}
+		out.WriteByte('\n')
+	}
+	_, err = w.Write(out.Bytes())
+	return err
+}
+
+// QrLinks returns the links that start the session of the session pointer in the IRMA app.
+func QrLinks(qrptr *irma.Qr) (*SessionLinks, error) {
+	bts, err := json.Marshal(qrptr)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "failed to marshal session pointer", 0)
+	}
+	escaped := url.PathEscape(string(bts))
+	return &SessionLinks{
+		Universal: universalLinkPrefix + escaped,
+		Intent:    intentPrefix + escaped + intentSuffix,
+	}, nil
+}
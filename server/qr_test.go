@@ -0,0 +1,49 @@
+package server_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/png"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQr(t *testing.T) {
+	qr := &irma.Qr{Type: irma.ActionDisclosing, URL: "https://example.com/irma/session/abc"}
+
+	bts, err := server.QrPNG(qr, 300)
+	require.NoError(t, err)
+	img, err := png.Decode(bytes.NewReader(bts))
+	require.NoError(t, err)
+	require.True(t, img.Bounds().Dx() <= 300 && img.Bounds().Dx() > 200)
+
+	bts, err = server.QrSVG(qr, 300)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(bts), "<svg "))
+	require.Contains(t, string(bts), `width="300" height="300"`)
+
+	_, err = server.QrPNG(qr, server.QrMaxSize+1)
+	require.Error(t, err)
+	_, err = server.QrSVG(qr, server.QrMinSize-1)
+	require.Error(t, err)
+
+	var out bytes.Buffer
+	require.NoError(t, server.PrintQrTerminal(&out, qr))
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	require.Equal(t, len(lines), strings.Count(lines[0], "\033[0m"))
+
+	links, err := server.QrLinks(qr)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(links.Intent, "intent://qr/json/"))
+	require.True(t, strings.HasSuffix(links.Intent, ";end"))
+	fragment, err := url.PathUnescape(strings.TrimPrefix(links.Universal, "https://irma.app/-/session#"))
+	require.NoError(t, err)
+	parsed := &irma.Qr{}
+	require.NoError(t, json.Unmarshal([]byte(fragment), parsed))
+	require.Equal(t, qr, parsed)
+}
@@ -0,0 +1,124 @@
+package requestorserver
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+)
+
+// AdminHandler returns a http.Handler that handles the admin API, with which server administrators
+// can list, inspect and cancel sessions and reload the configuration. All requests must include
+// the admin key in their Authorization header.
+func (s *Server) AdminHandler() http.Handler {
+	router := chi.NewRouter()
+	router.Use(s.adminAuthentication)
+	if s.config().Verbose >= 2 {
+		router.Use(s.logHandler("admin", true, true, true))
+	}
+
+	router.Post("/reload", s.handleReload)
+	router.Get("/sessions", s.handleAdminSessions)
+	router.Delete("/sessions", s.handleAdminCancelSessions)
+	router.Get("/sessions/{token}", s.handleAdminSession)
+	router.Delete("/sessions/{token}", s.handleAdminDelete)
+
+	return router
+}
+
+// adminAuthentication is middleware that allows only requests that include the admin key in
+// their Authorization header.
+func (s *Server) adminAuthentication(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conf := s.config()
+		if len(conf.adminKey) == 0 {
+			server.WriteError(w, server.ErrorUnsupported, "admin API is disabled")
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), conf.adminKey) != 1 {
+			conf.Logger.Warn("Admin request with invalid Authorization header")
+			server.WriteError(w, server.ErrorUnauthorized, "invalid admin key")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	conf := s.config()
+	if conf.ReadConfiguration == nil {
+		server.WriteError(w, server.ErrorUnsupported, "configuration reloading not supported")
+		return
+	}
+	newconf, err := conf.ReadConfiguration()
+	if err == nil {
+		err = s.Reload(newconf)
+	}
+	if err != nil {
+		_ = server.LogError(errors.WrapPrefix(err, "Failed to reload configuration", 0))
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminSessions lists the sessions of all tenants, or only those of the tenant specified in
+// the tenant query parameter and/or of the requestor specified in the requestor query parameter
+// (of the default tenant if no tenant is specified).
+func (s *Server) handleAdminSessions(w http.ResponseWriter, r *http.Request) {
+	requestor, tenant := r.URL.Query().Get("requestor"), r.URL.Query().Get("tenant")
+	all := requestor == "" && tenant == ""
+	sessions := []*server.SessionInfo{}
+	for _, serv := range s.servers() {
+		for _, info := range serv.irmaserv.Sessions() {
+			if all || (info.Tenant == tenant && (requestor == "" || info.Requestor == requestor)) {
+				sessions = append(sessions, info)
+			}
+		}
+	}
+	server.WriteJson(w, sessions)
+}
+
+func (s *Server) handleAdminSession(w http.ResponseWriter, r *http.Request) {
+	serv := s.sessionServer(chi.URLParam(r, "token"))
+	if serv == nil {
+		server.WriteError(w, server.ErrorSessionUnknown, "")
+		return
+	}
+	server.WriteJson(w, serv.irmaserv.SessionInfo(chi.URLParam(r, "token")))
+}
+
+func (s *Server) handleAdminDelete(w http.ResponseWriter, r *http.Request) {
+	serv := s.sessionServer(chi.URLParam(r, "token"))
+	if serv == nil {
+		server.WriteError(w, server.ErrorSessionUnknown, "")
+		return
+	}
+	serv.handleDelete(w, r)
+}
+
+// handleAdminCancelSessions cancels all unfinished sessions of the requestor specified in the
+// requestor query parameter, of the default tenant or of the tenant specified in the tenant
+// query parameter.
+func (s *Server) handleAdminCancelSessions(w http.ResponseWriter, r *http.Request) {
+	requestor, tenant := r.URL.Query().Get("requestor"), r.URL.Query().Get("tenant")
+	if requestor == "" {
+		server.WriteError(w, server.ErrorInvalidRequest, "requestor parameter required")
+		return
+	}
+	serv := s
+	if tenant != "" {
+		if serv = s.tenants[tenant]; serv == nil {
+			server.WriteError(w, server.ErrorInvalidRequest, "unknown tenant")
+			return
+		}
+	}
+	n := serv.irmaserv.CancelRequestorSessions(requestor)
+	s.config().Logger.WithFields(logrus.Fields{"requestor": requestor, "tenant": tenant}).Infof("Cancelled %d sessions on admin request", n)
+	server.WriteJson(w, struct {
+		Cancelled int `json:"cancelled"`
+	}{n})
+}
@@ -1,8 +1,13 @@
 package requestorserver
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
@@ -22,12 +27,12 @@ type Authenticator interface {
 
 	// Authenticate checks, given the HTTP header and POST body, if the authenticator is known
 	// and allowed to submit session requests. It returns whether or not the current authenticator
-	// is applicable to this sesion requests; the request itself; the name of the requestor;
-	// or an error (which is only non-nil if applies is true; i.e. this authenticator applies but
-	// it was not able to successfully authenticate the request).
+	// is applicable to this sesion requests; the request itself, or the session template it refers to;
+	// the name of the requestor; or an error (which is only non-nil if applies is true; i.e. this
+	// authenticator applies but it was not able to successfully authenticate the request).
 	Authenticate(
 		headers http.Header, body []byte,
-	) (applies bool, request irma.RequestorRequest, requestor string, err *irma.RemoteError)
+	) (applies bool, request irma.RequestorRequest, template *TemplateRequest, requestor string, err *irma.RemoteError)
 }
 
 type AuthenticationMethod string
@@ -35,37 +40,54 @@ type AuthenticationMethod string
 // Currently supported requestor authentication methods
 const (
 	AuthenticationMethodHmac      = "hmac"
-	AuthenticationMethodPublicKey = "publickey"
+	AuthenticationMethodPublicKey = "publickey" // RSA keys, with RS256 JWTs
+	AuthenticationMethodECDSA     = "ecdsa"     // ECDSA P-256 keys, with ES256 JWTs
+	AuthenticationMethodEd25519   = "ed25519"   // Ed25519 keys, with EdDSA JWTs
 	AuthenticationMethodToken     = "token"
+	AuthenticationMethodTls       = "tls" // client certificates, with JSON session requests
 	AuthenticationMethodNone      = "none"
 )
 
 type HmacAuthenticator struct {
 	hmackeys      map[string]interface{}
 	maxRequestAge int
+	policy        *jwtPolicy
 }
 type PublicKeyAuthenticator struct {
 	publickeys    map[string]interface{}
 	maxRequestAge int
+	policy        *jwtPolicy
+	method        jwt.SigningMethod // defaults to RS256
 }
 type PresharedKeyAuthenticator struct {
 	presharedkeys map[string]string
 }
+type TlsAuthenticator struct {
+	subjects     map[string]string // Key: subject DN of client certificate, value: requestor name
+	sans         map[string]string // Key: subject alternative name of client certificate
+	fingerprints map[string]string // Key: hex encoded SHA-256 fingerprint of client certificate
+}
 type NilAuthenticator struct{}
 
-var authenticators map[AuthenticationMethod]Authenticator
+// connectionAuthenticator is implemented by authenticators that authenticate requestors using
+// the TLS state of their connection instead of (only) the HTTP headers and body.
+type connectionAuthenticator interface {
+	AuthenticateConnection(
+		state *tls.ConnectionState, headers http.Header, body []byte,
+	) (applies bool, request irma.RequestorRequest, template *TemplateRequest, requestor string, err *irma.RemoteError)
+}
 
 func (NilAuthenticator) Authenticate(
 	headers http.Header, body []byte,
-) (bool, irma.RequestorRequest, string, *irma.RemoteError) {
+) (bool, irma.RequestorRequest, *TemplateRequest, string, *irma.RemoteError) {
 	if headers.Get("Authorization") != "" || !strings.HasPrefix(headers.Get("Content-Type"), "application/json") {
-		return false, nil, "", nil
+		return false, nil, nil, "", nil
 	}
-	request, err := server.ParseSessionRequest(body)
+	request, template, err := parseRequestorRequest(body)
 	if err != nil {
-		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
+		return true, nil, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
 	}
-	return true, request, "", nil
+	return true, request, template, "", nil
 }
 
 func (NilAuthenticator) Initialize(name string, requestor Requestor) error {
@@ -74,8 +96,8 @@ func (NilAuthenticator) Initialize(name string, requestor Requestor) error {
 
 func (hauth *HmacAuthenticator) Authenticate(
 	headers http.Header, body []byte,
-) (applies bool, request irma.RequestorRequest, requestor string, err *irma.RemoteError) {
-	return jwtAuthenticate(headers, body, jwt.SigningMethodHS256.Name, hauth.hmackeys, hauth.maxRequestAge)
+) (applies bool, request irma.RequestorRequest, template *TemplateRequest, requestor string, err *irma.RemoteError) {
+	return jwtAuthenticate(headers, body, jwt.SigningMethodHS256.Name, hauth.hmackeys, hauth.maxRequestAge, hauth.policy)
 }
 
 func (hauth *HmacAuthenticator) Initialize(name string, requestor Requestor) error {
@@ -91,14 +113,22 @@ func (hauth *HmacAuthenticator) Initialize(name string, requestor Requestor) err
 	}
 
 	hauth.hmackeys[name] = bts
+	hauth.policy.initialize(name, requestor)
 	return nil
 
 }
 
 func (pkauth *PublicKeyAuthenticator) Authenticate(
 	headers http.Header, body []byte,
-) (bool, irma.RequestorRequest, string, *irma.RemoteError) {
-	return jwtAuthenticate(headers, body, jwt.SigningMethodRS256.Name, pkauth.publickeys, pkauth.maxRequestAge)
+) (bool, irma.RequestorRequest, *TemplateRequest, string, *irma.RemoteError) {
+	return jwtAuthenticate(headers, body, pkauth.signingMethod().Alg(), pkauth.publickeys, pkauth.maxRequestAge, pkauth.policy)
+}
+
+func (pkauth *PublicKeyAuthenticator) signingMethod() jwt.SigningMethod {
+	if pkauth.method == nil {
+		return jwt.SigningMethodRS256
+	}
+	return pkauth.method
 }
 
 func (pkauth *PublicKeyAuthenticator) Initialize(name string, requestor Requestor) error {
@@ -107,31 +137,35 @@ func (pkauth *PublicKeyAuthenticator) Initialize(name string, requestor Requesto
 		return errors.WrapPrefix(err, "Failed to read key of requestor "+name, 0)
 	}
 
-	pk, err := jwt.ParseRSAPublicKeyFromPEM(bts)
+	pk, method, err := irma.ParseJwtPublicKey(bts)
 	if err != nil {
-		return err
+		return errors.WrapPrefix(err, "Failed to parse key of requestor "+name, 0)
+	}
+	if method != pkauth.signingMethod() {
+		return errors.Errorf("Key of requestor %s is not suitable for %s JWTs", name, pkauth.signingMethod().Alg())
 	}
 	pkauth.publickeys[name] = pk
+	pkauth.policy.initialize(name, requestor)
 
 	return nil
 }
 
 func (pskauth *PresharedKeyAuthenticator) Authenticate(
 	headers http.Header, body []byte,
-) (bool, irma.RequestorRequest, string, *irma.RemoteError) {
+) (bool, irma.RequestorRequest, *TemplateRequest, string, *irma.RemoteError) {
 	auth := headers.Get("Authorization")
 	if auth == "" || !strings.HasPrefix(headers.Get("Content-Type"), "application/json") {
-		return false, nil, "", nil
+		return false, nil, nil, "", nil
 	}
 	requestor, ok := pskauth.presharedkeys[auth]
 	if !ok {
-		return true, nil, "", server.RemoteError(server.ErrorUnauthorized, "")
+		return true, nil, nil, "", server.RemoteError(server.ErrorUnauthorized, "")
 	}
-	request, err := server.ParseSessionRequest(body)
+	request, template, err := parseRequestorRequest(body)
 	if err != nil {
-		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
+		return true, nil, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
 	}
-	return true, request, requestor, nil
+	return true, request, template, requestor, nil
 }
 
 func (pskauth *PresharedKeyAuthenticator) Initialize(name string, requestor Requestor) error {
@@ -143,6 +177,79 @@ func (pskauth *PresharedKeyAuthenticator) Initialize(name string, requestor Requ
 	return nil
 }
 
+// Authenticate never applies, as the TlsAuthenticator needs the TLS state of the connection;
+// see AuthenticateConnection.
+func (tauth *TlsAuthenticator) Authenticate(
+	headers http.Header, body []byte,
+) (bool, irma.RequestorRequest, *TemplateRequest, string, *irma.RemoteError) {
+	return false, nil, nil, "", nil
+}
+
+// AuthenticateConnection authenticates the requestor by the client certificate with which it
+// connected, which has been verified against the configured client CAs during the TLS handshake.
+func (tauth *TlsAuthenticator) AuthenticateConnection(
+	state *tls.ConnectionState, headers http.Header, body []byte,
+) (bool, irma.RequestorRequest, *TemplateRequest, string, *irma.RemoteError) {
+	if headers.Get("Authorization") != "" || !strings.HasPrefix(headers.Get("Content-Type"), "application/json") {
+		return false, nil, nil, "", nil
+	}
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return false, nil, nil, "", nil
+	}
+	requestor, ok := tauth.requestor(state.VerifiedChains[0][0])
+	if !ok {
+		return true, nil, nil, "", server.RemoteError(server.ErrorUnauthorized, "unknown client certificate")
+	}
+	request, template, err := parseRequestorRequest(body)
+	if err != nil {
+		return true, nil, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
+	}
+	return true, request, template, requestor, nil
+}
+
+func (tauth *TlsAuthenticator) requestor(cert *x509.Certificate) (string, bool) {
+	fingerprint := sha256.Sum256(cert.Raw)
+	if requestor, ok := tauth.fingerprints[hex.EncodeToString(fingerprint[:])]; ok {
+		return requestor, true
+	}
+	if requestor, ok := tauth.subjects[cert.Subject.String()]; ok {
+		return requestor, true
+	}
+	sans := append(append([]string{}, cert.DNSNames...), cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	for _, san := range sans {
+		if requestor, ok := tauth.sans[san]; ok {
+			return requestor, true
+		}
+	}
+	return "", false
+}
+
+func (tauth *TlsAuthenticator) Initialize(name string, requestor Requestor) error {
+	if requestor.TlsSubject == "" && requestor.TlsSAN == "" && requestor.TlsFingerprint == "" {
+		return errors.Errorf("Requestor %s uses tls authentication but has no tls_subject, tls_san or tls_fingerprint", name)
+	}
+	fingerprint := strings.ToLower(strings.Replace(requestor.TlsFingerprint, ":", "", -1))
+	for _, m := range []struct {
+		key    string
+		values map[string]string
+	}{{requestor.TlsSubject, tauth.subjects}, {requestor.TlsSAN, tauth.sans}, {fingerprint, tauth.fingerprints}} {
+		if m.key == "" {
+			continue
+		}
+		if other, ok := m.values[m.key]; ok {
+			return errors.Errorf("Requestors %s and %s have the same client certificate %s", other, name, m.key)
+		}
+		m.values[m.key] = name
+	}
+	return nil
+}
+
 // Helper functions
 
 // Given an (unauthenticated) jwt, return the key against which it should be verified using the "kid" header
@@ -167,11 +274,11 @@ func jwtKeyExtractor(publickeys map[string]interface{}) func(token *jwt.Token) (
 
 // jwtAuthenticate is a helper function for JWT-based authenticators that verifies and parses JWTs.
 func jwtAuthenticate(
-	headers http.Header, body []byte, signatureAlg string, keys map[string]interface{}, maxRequestAge int,
-) (bool, irma.RequestorRequest, string, *irma.RemoteError) {
+	headers http.Header, body []byte, signatureAlg string, keys map[string]interface{}, maxRequestAge int, policy *jwtPolicy,
+) (bool, irma.RequestorRequest, *TemplateRequest, string, *irma.RemoteError) {
 	// Read JWT and check its type
 	if headers.Get("Authorization") != "" || !strings.HasPrefix(headers.Get("Content-Type"), "text/plain") {
-		return false, nil, "", nil
+		return false, nil, nil, "", nil
 	}
 	requestorJwt := string(body)
 
@@ -185,7 +292,7 @@ func jwtAuthenticate(
 	if err != nil || alg != signatureAlg {
 		// If err != nil, ie. we failed to determine the JWT signature algorithm, we assume that the
 		// request is not meant for this authenticator. So we don't return err
-		return false, nil, "", nil
+		return false, nil, nil, "", nil
 	}
 
 	// Verify JWT signature. We do not yet store the JWT contents here, because we need to know the session type first
@@ -193,23 +300,121 @@ func jwtAuthenticate(
 	claims := &jwt.StandardClaims{}
 	_, err = jwt.ParseWithClaims(requestorJwt, claims, jwtKeyExtractor(keys))
 	if err != nil {
-		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
+		return true, nil, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
 	}
 	if time.Unix(claims.IssuedAt, 0).Add(time.Duration(maxRequestAge) * time.Second).Before(time.Now()) {
-		return true, nil, "", server.RemoteError(server.ErrorUnauthorized, "jwt too old")
+		return true, nil, nil, "", server.RemoteError(server.ErrorUnauthorized, "jwt too old")
 	}
 	if !claims.VerifyIssuedAt(time.Now().Unix(), true) {
-		return true, nil, "", server.RemoteError(server.ErrorUnauthorized, "jwt not yet valid")
+		return true, nil, nil, "", server.RemoteError(server.ErrorUnauthorized, "jwt not yet valid")
 	}
 
 	// Read JWT contents
-	parsedJwt, err := irma.ParseRequestorJwt(claims.Subject, requestorJwt)
+	var rrequest irma.RequestorRequest
+	var template *TemplateRequest
+	if claims.Subject == "template_request" {
+		template, err = parseTemplateJwt(requestorJwt)
+	} else {
+		var parsedJwt irma.RequestorJwt
+		if parsedJwt, err = irma.ParseRequestorJwt(claims.Subject, requestorJwt); err == nil {
+			rrequest = parsedJwt.RequestorRequest()
+		}
+	}
 	if err != nil {
-		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
+		return true, nil, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
 	}
 
 	requestor := claims.Issuer // presence is ensured by jwtKeyExtractor
-	return true, parsedJwt.RequestorRequest(), requestor, nil
+	if rerr := policy.check(requestor, claims, maxRequestAge); rerr != nil {
+		return true, nil, nil, "", rerr
+	}
+	return true, rrequest, template, requestor, nil
+}
+
+// jwtPolicy contains optional checks on session request JWTs, in addition to the checks on
+// their signature and iat field that jwtAuthenticate always performs. A nil *jwtPolicy performs no checks.
+type jwtPolicy struct {
+	audience    string          // if nonempty, the aud field of JWTs must equal this
+	requireID   bool            // whether all JWTs must have a jti field and may be used only once
+	singleUse   map[string]bool // requestors whose JWTs must have a jti field and may be used only once
+	replayCache *jwtReplayCache
+}
+
+func (policy *jwtPolicy) initialize(name string, requestor Requestor) {
+	if policy != nil && requestor.SingleUseJwts {
+		policy.singleUse[name] = true
+	}
+}
+
+func (policy *jwtPolicy) check(requestor string, claims *jwt.StandardClaims, maxRequestAge int) *irma.RemoteError {
+	if policy == nil {
+		return nil
+	}
+	if policy.audience != "" && !claims.VerifyAudience(policy.audience, true) {
+		return server.RemoteError(server.ErrorUnauthorized, "jwt has invalid aud")
+	}
+	if !policy.requireID && !policy.singleUse[requestor] {
+		return nil
+	}
+	if claims.Id == "" {
+		return server.RemoteError(server.ErrorUnauthorized, "jwt has no jti")
+	}
+	// After this moment the JWT is too old to be accepted anyway, so we can forget it then
+	expiry := time.Unix(claims.IssuedAt, 0).Add(time.Duration(maxRequestAge) * time.Second)
+	return policy.replayCache.use(requestor, claims.Id, expiry)
+}
+
+// jwtReplayCache keeps the jti fields of JWTs that have been used until the JWTs expire,
+// so that they are accepted only once. It holds at most a fixed number of jti fields per
+// requestor, so that requestors using many JWTs do not affect other requestors. It lives in
+// memory only, and is not shared with other servers using the same session store.
+type jwtReplayCache struct {
+	sync.Mutex
+	size int
+	used map[string]map[string]time.Time // Key: requestor, jti; value: expiry of the JWT
+}
+
+func newJwtReplayCache(size int) *jwtReplayCache {
+	return &jwtReplayCache{size: size, used: map[string]map[string]time.Time{}}
+}
+
+// use marks the jti of the requestor as used, or returns an error if it was used before. If the
+// cache of the requestor is full, it refuses new jti fields of the requestor until some of the
+// requestor's jti fields in the cache expire.
+func (c *jwtReplayCache) use(requestor, id string, expiry time.Time) *irma.RemoteError {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	used := c.used[requestor]
+	if used == nil {
+		used = map[string]time.Time{}
+		c.used[requestor] = used
+	}
+	if exp, ok := used[id]; ok && exp.After(now) {
+		return server.RemoteError(server.ErrorUnauthorized, "jwt already used")
+	}
+	if len(used) >= c.size {
+		for k, exp := range used {
+			if !exp.After(now) {
+				delete(used, k)
+			}
+		}
+		if len(used) >= c.size {
+			_ = server.LogWarning(errors.Errorf("JWT replay cache of requestor %s full, refusing session request JWT", requestor))
+			return server.RemoteError(server.ErrorRateLimited, "jwt replay cache full")
+		}
+	}
+	used[id] = expiry
+	return nil
+}
+
+// setSize changes the maximum number of jti fields per requestor in the cache, after the
+// configuration is reloaded.
+func (c *jwtReplayCache) setSize(size int) {
+	c.Lock()
+	defer c.Unlock()
+	c.size = size
 }
 
 func jwtSignatureAlg(j string) (string, error) {
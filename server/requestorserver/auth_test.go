@@ -1,12 +1,24 @@
 package requestorserver
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"github.com/dgrijalva/jwt-go"
 	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
 	"github.com/privacybydesign/irmago/server"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+	"math/big"
 	"testing"
 	"time"
 )
@@ -24,7 +36,7 @@ func TestPresharedKeyAuthenticator_Authenticate(t *testing.T) {
 			"Content-Type":  {"application/json"},
 		}
 
-		applies, parsedRequest, requestor, err := authenticator.Authenticate(requestHeaders, validRequestBody)
+		applies, parsedRequest, _, requestor, err := authenticator.Authenticate(requestHeaders, validRequestBody)
 		if err != nil {
 			require.NoError(t, err)
 		}
@@ -42,7 +54,7 @@ func TestPresharedKeyAuthenticator_Authenticate(t *testing.T) {
 		}
 		invalidRequestBody := []byte(`{}`)
 
-		applies, _, _, err := authenticator.Authenticate(requestHeaders, invalidRequestBody)
+		applies, _, _, _, err := authenticator.Authenticate(requestHeaders, invalidRequestBody)
 		require.Error(t, err)
 		require.True(t, applies)
 	})
@@ -52,7 +64,7 @@ func TestPresharedKeyAuthenticator_Authenticate(t *testing.T) {
 			"Authorization": {"invalid"},
 			"Content-Type":  {"application/json"},
 		}
-		applies, _, _, err := authenticator.Authenticate(requestHeaders, validRequestBody)
+		applies, _, _, _, err := authenticator.Authenticate(requestHeaders, validRequestBody)
 		require.True(t, applies)
 		require.Error(t, err)
 	})
@@ -62,7 +74,7 @@ func TestPresharedKeyAuthenticator_Authenticate(t *testing.T) {
 			"UnusedHeader": {"token"},
 			"Content-Type": {"application/json"},
 		}
-		applies, _, _, err := authenticator.Authenticate(requestHeaders, validRequestBody)
+		applies, _, _, _, err := authenticator.Authenticate(requestHeaders, validRequestBody)
 		require.False(t, applies)
 		if err != nil {
 			require.NoError(t, err)
@@ -73,7 +85,7 @@ func TestPresharedKeyAuthenticator_Authenticate(t *testing.T) {
 		requestHeaders := map[string][]string{
 			"Authorization": {"token"},
 		}
-		applies, _, _, err := authenticator.Authenticate(requestHeaders, validRequestBody)
+		applies, _, _, _, err := authenticator.Authenticate(requestHeaders, validRequestBody)
 		require.False(t, applies)
 		if err != nil {
 			require.NoError(t, err)
@@ -103,7 +115,7 @@ func TestHmacAuthenticator_Authenticate(t *testing.T) {
 	}
 
 	t.Run("valid", func(t *testing.T) {
-		applies, parsedRequest, requestor, err := authenticator.Authenticate(requestHeaders, []byte(validJwtData))
+		applies, parsedRequest, _, requestor, err := authenticator.Authenticate(requestHeaders, []byte(validJwtData))
 		if err != nil {
 			require.NoError(t, err)
 		}
@@ -118,7 +130,7 @@ func TestHmacAuthenticator_Authenticate(t *testing.T) {
 		invalidJwtData, jErr := j.Sign(jwt.SigningMethodHS256, key)
 		require.NoError(t, jErr)
 
-		applies, _, _, err := authenticator.Authenticate(requestHeaders, []byte(invalidJwtData))
+		applies, _, _, _, err := authenticator.Authenticate(requestHeaders, []byte(invalidJwtData))
 		require.True(t, applies)
 		require.Error(t, err)
 	})
@@ -132,7 +144,7 @@ func TestHmacAuthenticator_Authenticate(t *testing.T) {
 		})
 		emptyJwtData, jErr := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(key)
 		require.NoError(t, jErr)
-		applies, _, _, err := authenticator.Authenticate(requestHeaders, []byte(emptyJwtData))
+		applies, _, _, _, err := authenticator.Authenticate(requestHeaders, []byte(emptyJwtData))
 		require.True(t, applies)
 		require.Error(t, err)
 		require.Equal(t, string(server.ErrorInvalidRequest.Type), err.ErrorName)
@@ -143,7 +155,7 @@ func TestHmacAuthenticator_Authenticate(t *testing.T) {
 		j.IssuedAt = (irma.Timestamp)(time.Unix(0, 0))
 		invalidJwtData, jErr := j.Sign(jwt.SigningMethodHS256, key)
 		require.NoError(t, jErr)
-		applies, _, _, err := authenticator.Authenticate(requestHeaders, []byte(invalidJwtData))
+		applies, _, _, _, err := authenticator.Authenticate(requestHeaders, []byte(invalidJwtData))
 		require.True(t, applies)
 		require.Error(t, err)
 		require.Equal(t, string(server.ErrorUnauthorized.Type), err.ErrorName)
@@ -154,7 +166,7 @@ func TestHmacAuthenticator_Authenticate(t *testing.T) {
 		j.IssuedAt = (irma.Timestamp)(time.Now().AddDate(1, 0, 0))
 		invalidJwtData, jErr := j.Sign(jwt.SigningMethodHS256, key)
 		require.NoError(t, jErr)
-		applies, _, _, err := authenticator.Authenticate(requestHeaders, []byte(invalidJwtData))
+		applies, _, _, _, err := authenticator.Authenticate(requestHeaders, []byte(invalidJwtData))
 		require.True(t, applies)
 		require.Error(t, err)
 		require.Equal(t, string(server.ErrorInvalidRequest.Type), err.ErrorName)
@@ -164,8 +176,180 @@ func TestHmacAuthenticator_Authenticate(t *testing.T) {
 		j := irma.NewServiceProviderJwt("my_requestor", disclosureRequest)
 		invalidJwtData, jErr := j.Sign(jwt.SigningMethodHS256, invalidKey)
 		require.NoError(t, jErr)
-		applies, _, _, err := authenticator.Authenticate(requestHeaders, []byte(invalidJwtData))
+		applies, _, _, _, err := authenticator.Authenticate(requestHeaders, []byte(invalidJwtData))
 		require.True(t, applies)
 		require.Error(t, err)
 	})
 }
+
+func TestJwtPolicy(t *testing.T) {
+	key := []byte("953BCAB6F25F3622619A9A16BE895")
+	authenticator := HmacAuthenticator{
+		hmackeys: map[string]interface{}{
+			"my_requestor":      key,
+			"single_use":        key,
+			"another_requestor": key,
+		},
+		maxRequestAge: 500,
+		policy: &jwtPolicy{
+			audience:    "irmaserver",
+			singleUse:   map[string]bool{"single_use": true},
+			replayCache: newJwtReplayCache(2),
+		},
+	}
+	disclosureRequest := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	requestHeaders := map[string][]string{
+		"Content-Type": {"text/plain"},
+	}
+	sign := func(requestor, id, audience string) []byte {
+		j := irma.NewServiceProviderJwt(requestor, disclosureRequest)
+		j.ID = id
+		j.Audience = audience
+		bts, err := j.Sign(jwt.SigningMethodHS256, key)
+		require.NoError(t, err)
+		return []byte(bts)
+	}
+	authenticate := func(jwt []byte) *irma.RemoteError {
+		applies, _, _, _, err := authenticator.Authenticate(requestHeaders, jwt)
+		require.True(t, applies)
+		return err
+	}
+
+	server.Logger.SetLevel(logrus.ErrorLevel)
+	t.Run("audience", func(t *testing.T) {
+		require.Nil(t, authenticate(sign("my_requestor", "", "irmaserver")))
+		require.NotNil(t, authenticate(sign("my_requestor", "", "")))
+		require.NotNil(t, authenticate(sign("my_requestor", "", "another_server")))
+	})
+
+	t.Run("reuse allowed", func(t *testing.T) {
+		j := sign("my_requestor", "", "irmaserver")
+		require.Nil(t, authenticate(j))
+		require.Nil(t, authenticate(j))
+	})
+
+	t.Run("single use", func(t *testing.T) {
+		require.NotNil(t, authenticate(sign("single_use", "", "irmaserver")), "jti should be required")
+		j := sign("single_use", "1", "irmaserver")
+		require.Nil(t, authenticate(j))
+		err := authenticate(j)
+		require.NotNil(t, err)
+		require.Equal(t, string(server.ErrorUnauthorized.Type), err.ErrorName)
+	})
+
+	t.Run("replay cache full", func(t *testing.T) {
+		authenticator.policy.requireID = true
+		defer func() { authenticator.policy.requireID = false }()
+		require.Nil(t, authenticate(sign("another_requestor", "1", "irmaserver")))
+		require.Nil(t, authenticate(sign("another_requestor", "2", "irmaserver")))
+		err := authenticate(sign("another_requestor", "3", "irmaserver"))
+		require.NotNil(t, err)
+		require.Equal(t, string(server.ErrorRateLimited.Type), err.ErrorName)
+
+		// Other requestors have a cache of their own
+		require.Nil(t, authenticate(sign("my_requestor", "1", "irmaserver")))
+	})
+}
+
+func TestPublicKeyAuthenticatorAlgorithms(t *testing.T) {
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	disclosureRequest := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	requestHeaders := map[string][]string{
+		"Content-Type": {"text/plain"},
+	}
+
+	for method, key := range map[string]interface{}{AuthenticationMethodECDSA: ecdsaKey, AuthenticationMethodEd25519: ed25519Key} {
+		t.Run(method, func(t *testing.T) {
+			// Encode keys to PEM and parse them again as they would be from the configuration
+			skbts, err := test.MarshalPKCS8PrivateKey(key)
+			require.NoError(t, err)
+			sk, alg, err := irma.ParseJwtPrivateKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: skbts}))
+			require.NoError(t, err)
+			pkbts, err := test.MarshalPKIXPublicKey(sk.Public())
+			require.NoError(t, err)
+
+			authenticator := &PublicKeyAuthenticator{publickeys: map[string]interface{}{}, maxRequestAge: 500, method: alg}
+			require.NoError(t, authenticator.Initialize("my_requestor", Requestor{
+				AuthenticationKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkbts})),
+			}))
+
+			j, err := irma.NewServiceProviderJwt("my_requestor", disclosureRequest).Sign(alg, sk)
+			require.NoError(t, err)
+			applies, parsedRequest, _, requestor, rerr := authenticator.Authenticate(requestHeaders, []byte(j))
+			require.Nil(t, rerr)
+			require.True(t, applies)
+			require.Equal(t, "my_requestor", requestor)
+			require.Equal(t, "irma-demo.RU.studentCard.studentID", parsedRequest.SessionRequest().Disclosure().Disclose[0][0][0].Type.String())
+
+			// JWTs signed using another algorithm are not for this authenticator
+			j, err = irma.NewServiceProviderJwt("my_requestor", disclosureRequest).Sign(jwt.SigningMethodHS256, []byte("key"))
+			require.NoError(t, err)
+			applies, _, _, _, _ = authenticator.Authenticate(requestHeaders, []byte(j))
+			require.False(t, applies)
+		})
+	}
+
+	t.Run("key of wrong type", func(t *testing.T) {
+		pkbts, err := x509.MarshalPKIXPublicKey(ecdsaKey.Public())
+		require.NoError(t, err)
+		authenticator := &PublicKeyAuthenticator{publickeys: map[string]interface{}{}, method: irma.SigningMethodEdDSA}
+		require.Error(t, authenticator.Initialize("my_requestor", Requestor{
+			AuthenticationKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkbts})),
+		}))
+	})
+}
+
+func TestTlsAuthenticator(t *testing.T) {
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "backend", Organization: []string{"Example"}},
+		DNSNames:     []string{"backend.example.com"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &sk.PublicKey, sk)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	fingerprint := sha256.Sum256(der)
+
+	state := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	requestHeaders := map[string][]string{
+		"Content-Type": {"application/json"},
+	}
+	body := []byte(`{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.RU.studentCard.studentID"]]]}`)
+
+	for name, requestor := range map[string]Requestor{
+		"subject":     {TlsSubject: "CN=backend,O=Example"},
+		"san":         {TlsSAN: "backend.example.com"},
+		"fingerprint": {TlsFingerprint: hex.EncodeToString(fingerprint[:])},
+	} {
+		t.Run(name, func(t *testing.T) {
+			authenticator := &TlsAuthenticator{subjects: map[string]string{}, sans: map[string]string{}, fingerprints: map[string]string{}}
+			require.NoError(t, authenticator.Initialize("my_requestor", requestor))
+
+			applies, _, _, _, _ := authenticator.Authenticate(requestHeaders, body)
+			require.False(t, applies)
+			applies, _, _, _, _ = authenticator.AuthenticateConnection(nil, requestHeaders, body)
+			require.False(t, applies)
+
+			applies, parsedRequest, _, requestor, rerr := authenticator.AuthenticateConnection(state, requestHeaders, body)
+			require.Nil(t, rerr)
+			require.True(t, applies)
+			require.Equal(t, "my_requestor", requestor)
+			require.Equal(t, irma.ActionDisclosing, parsedRequest.SessionRequest().Action())
+		})
+	}
+
+	authenticator := &TlsAuthenticator{subjects: map[string]string{}, sans: map[string]string{}, fingerprints: map[string]string{}}
+	require.NoError(t, authenticator.Initialize("my_requestor", Requestor{TlsSAN: "other.example.com"}))
+	applies, _, _, _, rerr := authenticator.AuthenticateConnection(state, requestHeaders, body)
+	require.True(t, applies)
+	require.NotNil(t, rerr)
+	require.Error(t, authenticator.Initialize("another_requestor", Requestor{TlsSAN: "other.example.com"}))
+}
@@ -0,0 +1,417 @@
+package requestorserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/irmaserver"
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/bbolt"
+)
+
+const (
+	// CallbackSignatureHeader contains the HMAC-SHA256 signature of a result callback, if a callback
+	// key is configured, in the form t=<unix timestamp>,v1=<hex encoded HMAC over "<timestamp>.<body>">.
+	CallbackSignatureHeader = "X-IRMA-Signature"
+	// CallbackSignatureJwtHeader contains a JWT signed with the JWT private key, if it is configured,
+	// whose body_sha256 claim contains the hex encoded SHA256 hash of the body of the result callback.
+	CallbackSignatureJwtHeader = "X-IRMA-Signature-JWT"
+)
+
+// callback is a session result that is to be POSTed to a callback URL. Its body is rendered anew
+// for each attempt, so that the result JWT in it is valid from the moment it is POSTed.
+type callback struct {
+	Token     string
+	Tenant    string `json:",omitempty"`
+	Requestor string
+	URL       string
+	Result    *server.SessionResult // pseudonymized already
+	Validity  int                   `json:",omitempty"` // of the result JWT in seconds
+	Encrypt   bool                  `json:",omitempty"` // whether the result is to be encrypted
+	Attempts  int
+	Next      time.Time
+}
+
+// callbackJwtClaims are the claims of the JWT in the CallbackSignatureJwtHeader.
+type callbackJwtClaims struct {
+	jwt.StandardClaims
+	BodyHash string `json:"body_sha256"`
+}
+
+// callbackOutbox keeps result callbacks until they have been POSTed successfully, retrying failed
+// callbacks with exponential backoff. If configured, the callbacks are also stored in a bbolt
+// database, so that pending callbacks survive a restart of the server.
+type callbackOutbox struct {
+	sync.Mutex
+	conf      *Configuration
+	callbacks map[string]*callback     // Key: session token
+	sending   map[string]chan struct{} // Key: session token of callbacks being POSTed, closed once done
+	workers   chan struct{}            // limits the number of callbacks POSTed at once
+	db        *bbolt.DB
+	trigger   chan struct{}
+	stop      chan struct{}
+	stopped   chan struct{}
+}
+
+const (
+	callbackOutboxBucket = "callbacks" // Key: session token, value: *callback
+	callbackWorkers      = 16          // Maximum number of callbacks POSTed at once
+)
+
+func newCallbackOutbox(conf *Configuration) (*callbackOutbox, error) {
+	o := &callbackOutbox{
+		conf:      conf,
+		callbacks: map[string]*callback{},
+		sending:   map[string]chan struct{}{},
+		workers:   make(chan struct{}, callbackWorkers),
+		trigger:   make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	if conf.CallbackOutboxPath != "" {
+		var err error
+		o.db, err = bbolt.Open(conf.CallbackOutboxPath, 0600, &bbolt.Options{Timeout: 1 * time.Second})
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "failed to open callback outbox", 0)
+		}
+		if err = o.load(); err != nil {
+			_ = o.db.Close()
+			return nil, errors.WrapPrefix(err, "failed to load callbacks from callback outbox", 0)
+		}
+	}
+	go o.run()
+	return o, nil
+}
+
+// load reads all pending callbacks from the database into memory.
+func (o *callbackOutbox) load() error {
+	return o.db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(callbackOutboxBucket))
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			cb := &callback{}
+			if err := json.Unmarshal(v, cb); err != nil {
+				return err
+			}
+			o.callbacks[cb.Token] = cb
+			return nil
+		})
+	})
+}
+
+// add schedules the callback to be POSTed as soon as possible.
+func (o *callbackOutbox) add(cb *callback) {
+	o.Lock()
+	o.callbacks[cb.Token] = cb
+	o.save(cb)
+	o.Unlock()
+
+	select {
+	case o.trigger <- struct{}{}:
+	default: // the outbox will already be processed
+	}
+}
+
+func (o *callbackOutbox) run() {
+	defer close(o.stopped)
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-o.stop:
+			return
+		case <-o.trigger:
+		case <-ticker.C:
+		}
+		o.process(false, time.Time{})
+	}
+}
+
+// flush POSTs all pending callbacks once, regardless of when their next attempt is due, until
+// the deadline has passed. Callbacks that fail remain in the outbox.
+func (o *callbackOutbox) flush(deadline time.Time) {
+	o.process(true, deadline)
+	o.wait(deadline)
+}
+
+// process starts POSTing all callbacks whose next attempt is due, or all callbacks if all is true,
+// that are not being POSTed already. The callbacks are POSTed concurrently, at most callbackWorkers
+// at once, so that slow callback URLs do not hold up other callbacks. If the deadline is not zero,
+// no callbacks are POSTed after it.
+func (o *callbackOutbox) process(all bool, deadline time.Time) {
+	now := time.Now()
+	o.Lock()
+	defer o.Unlock()
+	for token, cb := range o.callbacks {
+		if o.sending[token] == nil && (all || !cb.Next.After(now)) {
+			o.sending[token] = make(chan struct{})
+			go o.post(o.conf, cb, deadline)
+		}
+	}
+}
+
+// post POSTs the callback as soon as the number of callbacks being POSTed allows it, and
+// reschedules or removes the callback depending on the outcome.
+func (o *callbackOutbox) post(conf *Configuration, cb *callback, deadline time.Time) {
+	var err error
+	sent := false
+	select {
+	case o.workers <- struct{}{}:
+		select {
+		case <-o.stop:
+		default:
+			if deadline.IsZero() || time.Now().Before(deadline) {
+				err = o.send(conf, cb)
+				sent = true
+			}
+		}
+		<-o.workers
+	case <-o.stop:
+	}
+
+	o.Lock()
+	defer o.Unlock()
+	close(o.sending[cb.Token])
+	delete(o.sending, cb.Token)
+	if !sent {
+		return
+	}
+	logger := conf.Logger.WithFields(logrus.Fields{"session": cb.Token, "callbackUrl": cb.URL, "attempts": cb.Attempts + 1})
+	if err == nil {
+		delete(o.callbacks, cb.Token)
+		o.delete(cb)
+		return
+	}
+	metricCallbackFailures.Inc()
+	cb.Attempts++
+	if cb.Attempts > conf.CallbackMaxRetries {
+		logger.Error(errors.WrapPrefix(err, "Failed to POST session result to callback URL, giving up", 0))
+		delete(o.callbacks, cb.Token)
+		o.delete(cb)
+	} else {
+		logger.Warn(errors.WrapPrefix(err, "Failed to POST session result to callback URL, retrying later", 0))
+		cb.Next = time.Now().Add(backoff(conf, cb.Attempts))
+		o.save(cb)
+	}
+}
+
+// wait waits until the callbacks that are being POSTed are done, or until the deadline has
+// passed if it is not zero.
+func (o *callbackOutbox) wait(deadline time.Time) {
+	o.Lock()
+	var sending []chan struct{}
+	for _, done := range o.sending {
+		sending = append(sending, done)
+	}
+	o.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for _, done := range sending {
+		select {
+		case <-done:
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// backoff returns the time to wait after the specified number of failed attempts.
+func backoff(conf *Configuration, attempts int) time.Duration {
+	max := time.Duration(conf.CallbackMaxBackoff) * time.Second
+	if attempts > 30 { // prevent overflow
+		return max
+	}
+	if backoff := time.Duration(1<<uint(attempts)) * time.Second; backoff < max {
+		return backoff
+	}
+	return max
+}
+
+func (o *callbackOutbox) send(conf *Configuration, cb *callback) error {
+	if conf = conf.tenant(cb.Tenant); conf == nil {
+		return errors.Errorf("unknown tenant %s", cb.Tenant)
+	}
+	var x string // dummy for the server's return value that we don't care about
+	return conf.postResult(cb.Requestor, cb.URL, cb.Result, cb.Validity, cb.Encrypt, &x)
+}
+
+// postResult POSTs the session result of the requestor to the URL, rendered by resultBody() and
+// signed by the headers of callbackTransport(), and unmarshals the response into dest.
+func (conf *Configuration) postResult(requestor, url string, result *server.SessionResult, validity int, encrypt bool, dest interface{}) error {
+	body, err := conf.resultBody(requestor, result, validity, encrypt)
+	if err != nil {
+		return err
+	}
+	transport, err := conf.callbackTransport(url, requestor, body)
+	if err != nil {
+		return err
+	}
+	return transport.Post("", dest, body)
+}
+
+// callbackTransport returns a transport for POSTing the body to the URL of the requestor, with
+// the headers signing the body set.
+func (conf *Configuration) callbackTransport(url, requestor, body string) (*irma.HTTPTransport, error) {
+	transport := irma.NewHTTPTransport(url)
+	if key := conf.callbackKey(requestor); key != nil {
+		timestamp := time.Now().Unix()
+		mac := hmac.New(sha256.New, key)
+		_, _ = fmt.Fprintf(mac, "%d.%s", timestamp, body)
+		transport.SetHeader(CallbackSignatureHeader, fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil))))
+	}
+	if conf.jwtPrivateKey != nil {
+		hash := sha256.Sum256([]byte(body))
+		token, err := conf.signJwt(callbackJwtClaims{
+			StandardClaims: jwt.StandardClaims{
+				Issuer:   conf.JwtIssuer,
+				IssuedAt: time.Now().Unix(),
+				Subject:  "callback",
+			},
+			BodyHash: hex.EncodeToString(hash[:]),
+		})
+		if err != nil {
+			return nil, err
+		}
+		transport.SetHeader(CallbackSignatureJwtHeader, token)
+	}
+	return transport, nil
+}
+
+// save stores the callback in the database, if any. The caller must hold the lock.
+func (o *callbackOutbox) save(cb *callback) {
+	if o.db == nil {
+		return
+	}
+	bts, err := json.Marshal(cb)
+	if err != nil {
+		_ = server.LogError(errors.WrapPrefix(err, "failed to serialize callback", 0))
+		return
+	}
+	err = o.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(callbackOutboxBucket)).Put([]byte(cb.Token), bts)
+	})
+	if err != nil {
+		_ = server.LogError(errors.WrapPrefix(err, "failed to store callback", 0))
+	}
+}
+
+// delete removes the callback from the database, if any. The caller must hold the lock.
+func (o *callbackOutbox) delete(cb *callback) {
+	if o.db == nil {
+		return
+	}
+	err := o.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(callbackOutboxBucket)).Delete([]byte(cb.Token))
+	})
+	if err != nil {
+		_ = server.LogError(errors.WrapPrefix(err, "failed to delete callback", 0))
+	}
+}
+
+// setConfiguration replaces the configuration of the outbox, after it is reloaded.
+func (o *callbackOutbox) setConfiguration(conf *Configuration) {
+	o.Lock()
+	defer o.Unlock()
+	o.conf = conf
+}
+
+func (o *callbackOutbox) close() {
+	close(o.stop)
+	<-o.stopped
+	o.wait(time.Time{})
+	if o.db == nil {
+		return
+	}
+	if err := o.db.Close(); err != nil {
+		_ = server.LogError(errors.WrapPrefix(err, "failed to close callback outbox", 0))
+	}
+}
+
+func (s *Server) doResultCallback(requestor string, result *server.SessionResult) {
+	base := s.irmaserv.GetRequest(result.Token).Base()
+	callbackUrl := base.CallbackURL
+	if callbackUrl == "" {
+		return
+	}
+
+	conf := s.config()
+	logResultPost(conf.Logger.WithFields(logrus.Fields{"session": result.Token, "callbackUrl": callbackUrl}), callbackUrl)
+	s.callbacks.add(&callback{
+		Token:     result.Token,
+		Tenant:    s.tenant,
+		Requestor: requestor,
+		URL:       callbackUrl,
+		Result:    conf.pseudonymize(requestor, result),
+		Validity:  base.ResultJwtValidity,
+		Encrypt:   base.EncryptResult,
+	})
+}
+
+// postSessionResult POSTs the session result of the requestor to the URL at once, like result
+// callbacks are POSTed (i.e. pseudonymized, signed and possibly encrypted), and unmarshals the
+// response into dest.
+func (s *Server) postSessionResult(requestor, url string, result *server.SessionResult, dest interface{}) error {
+	conf := s.config()
+	logResultPost(conf.Logger.WithFields(logrus.Fields{"session": result.Token, "url": url}), url)
+	base := s.irmaserv.GetRequest(result.Token).Base()
+	return conf.postResult(requestor, url, conf.pseudonymize(requestor, result), base.ResultJwtValidity, base.EncryptResult, dest)
+}
+
+// logResultPost logs that a session result is POSTed to the URL, warning if this is done without TLS.
+func logResultPost(logger *logrus.Entry, url string) {
+	if !strings.HasPrefix(url, "https") {
+		logger.Warn("POSTing session result without TLS: attributes are unencrypted in traffic")
+	} else {
+		logger.Debug("POSTing session result")
+	}
+}
+
+// resultBody returns the session result of the requestor as POSTed to callback URLs: as a JWT
+// that expires after the specified number of seconds if a JWT private key is configured and as
+// JSON otherwise, encrypted to the result encryption key of the requestor if encrypt is true.
+func (conf *Configuration) resultBody(requestor string, result *server.SessionResult, validity int, encrypt bool) (string, error) {
+	var res, cty string
+	if conf.jwtPrivateKey != nil {
+		var err error
+		if res, err = conf.resultJwt(result, validity); err != nil {
+			return "", err
+		}
+		cty = "JWT"
+	} else {
+		bts, err := json.Marshal(result)
+		if err != nil {
+			return "", err
+		}
+		res = string(bts)
+	}
+	key, err := conf.requestorResultEncryptionKey(requestor, encrypt)
+	if err != nil {
+		return "", err
+	}
+	res, _, err = encryptResultTo(key, []byte(res), cty)
+	return res, err
+}
+
+// resultCallback returns a handler that performs the result callback of sessions of the specified requestor.
+func (s *Server) resultCallback(requestor string) irmaserver.SessionHandler {
+	return func(result *server.SessionResult) {
+		s.doResultCallback(requestor, result)
+	}
+}
@@ -0,0 +1,117 @@
+package requestorserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/privacybydesign/irmago/server"
+	"github.com/stretchr/testify/require"
+)
+
+func testCallbackConfiguration() *Configuration {
+	return &Configuration{
+		Configuration:      &server.Configuration{Logger: server.NewLogger(0, true, false)},
+		CallbackMaxRetries: 2,
+		CallbackMaxBackoff: 1,
+		callbackKeys:       map[string][]byte{"requestor": []byte("secret")},
+	}
+}
+
+func TestCallbackRetry(t *testing.T) {
+	type request struct {
+		header http.Header
+		body   string
+	}
+	received := make(chan request, 2)
+	var attempts int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- request{r.Header, string(body)}
+	}))
+	defer ts.Close()
+
+	outbox, err := newCallbackOutbox(testCallbackConfiguration())
+	require.NoError(t, err)
+	defer outbox.close()
+	outbox.add(&callback{Token: "token", Requestor: "requestor", URL: ts.URL, Result: &server.SessionResult{Token: "token"}})
+
+	select {
+	case r := <-received:
+		require.Equal(t, 2, attempts)
+		require.Equal(t, server.ToJson(&server.SessionResult{Token: "token"}), r.body)
+
+		// Check the signature
+		var timestamp int64
+		var signature string
+		_, err := fmt.Sscanf(strings.Replace(r.header.Get(CallbackSignatureHeader), ",", " ", 1), "t=%d v1=%s", &timestamp, &signature)
+		require.NoError(t, err)
+		mac := hmac.New(sha256.New, []byte("secret"))
+		_, _ = fmt.Fprintf(mac, "%d.%s", timestamp, r.body)
+		require.Equal(t, hex.EncodeToString(mac.Sum(nil)), signature)
+	case <-time.After(5 * time.Second):
+		t.Fatal("callback not retried")
+	}
+}
+
+func TestCallbackOutboxPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "callbacks")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	conf := testCallbackConfiguration()
+	conf.CallbackOutboxPath = filepath.Join(dir, "outbox.db")
+	outbox, err := newCallbackOutbox(conf)
+	require.NoError(t, err)
+	outbox.add(&callback{Token: "token", URL: "http://localhost:1", Result: &server.SessionResult{Token: "token"}, Next: time.Now().Add(time.Hour)})
+	outbox.close()
+
+	outbox, err = newCallbackOutbox(conf)
+	require.NoError(t, err)
+	defer outbox.close()
+	outbox.Lock()
+	defer outbox.Unlock()
+	require.Contains(t, outbox.callbacks, "token")
+	require.Equal(t, "token", outbox.callbacks["token"].Result.Token)
+}
+
+func TestCallbackSlowReceiver(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	received := make(chan struct{}, 1)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+	}))
+	defer fast.Close()
+
+	outbox, err := newCallbackOutbox(testCallbackConfiguration())
+	require.NoError(t, err)
+	defer outbox.close()
+	outbox.add(&callback{Token: "slow", URL: slow.URL, Result: &server.SessionResult{Token: "slow"}})
+	outbox.add(&callback{Token: "fast", URL: fast.URL, Result: &server.SessionResult{Token: "fast"}})
+
+	// The callback to the fast receiver does not wait for the slow receiver
+	select {
+	case <-received:
+	case <-time.After(2 * time.Second):
+		t.Fatal("callback held up by slow receiver")
+	}
+	close(release)
+}
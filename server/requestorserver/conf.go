@@ -1,8 +1,9 @@
 package requestorserver
 
 import (
-	"crypto/rsa"
+	"crypto"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"regexp"
@@ -36,6 +37,10 @@ type Configuration struct {
 	TlsCertificateFile string `json:"tls_cert_file" mapstructure:"tls_cert_file"`
 	TlsPrivateKey      string `json:"tls_privkey" mapstructure:"tls_privkey"`
 	TlsPrivateKeyFile  string `json:"tls_privkey_file" mapstructure:"tls_privkey_file"`
+	// CA certificate(s) against which client certificates are verified, of requestors that use the tls
+	// authentication method. Requires TLS to be enabled.
+	TlsClientCA     string `json:"tls_client_ca" mapstructure:"tls_client_ca"`
+	TlsClientCAFile string `json:"tls_client_ca_file" mapstructure:"tls_client_ca_file"`
 
 	// If specified, start a separate server for the IRMA app at his port
 	ClientPort int `json:"client_port" mapstructure:"client_port"`
@@ -54,9 +59,42 @@ type Configuration struct {
 	// Used in the "iss" field of result JWTs from /result-jwt and /getproof
 	JwtIssuer string `json:"jwt_issuer" mapstructure:"jwt_issuer"`
 
-	// Private key to sign result JWTs with. If absent, /result-jwt and /getproof are disabled.
+	// Require the aud field of session request JWTs to equal jwt_issuer
+	JwtRequireAudience bool `json:"jwt_require_audience" mapstructure:"jwt_require_audience"`
+	// Require all session request JWTs to have a jti field, and accept each JWT only once.
+	// Requestors can also be configured individually to do this using single_use_jwts.
+	// Used JWTs are remembered only in the memory of this server, so a JWT may be used again after
+	// a restart, or at another server sharing the session store, until max_request_age has passed.
+	JwtRequireID bool `json:"jwt_require_id" mapstructure:"jwt_require_id"`
+	// Maximum number of used JWTs per requestor that are remembered until they expire, for rejecting
+	// JWTs that are used twice. When full, new JWTs of the requestor are refused until some expire
+	// (default value 0 means 100000).
+	JwtReplayCacheSize int `json:"jwt_replay_cache_size" mapstructure:"jwt_replay_cache_size"`
+
+	// Private key to sign result JWTs with: an RSA, ECDSA (P-256) or Ed25519 key, with which JWTs are
+	// signed using RS256, ES256 or EdDSA respectively. If absent, /result-jwt and /getproof are disabled.
 	JwtPrivateKey     string `json:"jwt_privkey" mapstructure:"jwt_privkey"`
 	JwtPrivateKeyFile string `json:"jwt_privkey_file" mapstructure:"jwt_privkey_file"`
+	// Key ID of the JWT private key, included in the kid header of JWTs signed with it
+	// (default: the JWK thumbprint of the key, see RFC 7638)
+	JwtKeyID string `json:"jwt_kid" mapstructure:"jwt_kid"`
+	// Keys with which JWTs signed by this server can be verified but that are not used to sign new JWTs,
+	// listed by their kid at /.well-known/jwks.json along with the JWT private key. Used for rotating the
+	// JWT private key by reloading the configuration: first add the new key here, then after verifiers
+	// have fetched it, swap it with the JWT private key, and remove the old key once its JWTs expired.
+	JwtVerificationKeys map[string]JwtKey `json:"jwt_verification_keys" mapstructure:"jwt_verification_keys"`
+
+	// Key (base64 encoded) with which result callbacks are signed using HMAC-SHA256, for requestors
+	// that have no callback key of their own
+	CallbackKey     string `json:"callback_key" mapstructure:"callback_key"`
+	CallbackKeyFile string `json:"callback_key_file" mapstructure:"callback_key_file"`
+	// Failed result callbacks are retried with exponential backoff at most this many times (default value 0 means 10)
+	CallbackMaxRetries int `json:"callback_max_retries" mapstructure:"callback_max_retries"`
+	// Maximum time in seconds between two attempts of a result callback (default value 0 means 3600)
+	CallbackMaxBackoff int `json:"callback_max_backoff" mapstructure:"callback_max_backoff"`
+	// Database file in which pending result callbacks are kept, so that they survive restarts.
+	// If absent, pending result callbacks are kept only in memory.
+	CallbackOutboxPath string `json:"callback_outbox_path" mapstructure:"callback_outbox_path"`
 
 	// Max age in seconds of a session request JWT (using iat field)
 	MaxRequestAge int `json:"max_request_age" mapstructure:"max_request_age"`
@@ -68,8 +106,63 @@ type Configuration struct {
 
 	StaticSessions map[string]interface{} `json:"static_sessions"`
 
-	staticSessions map[string]irma.RequestorRequest
-	jwtPrivateKey  *rsa.PrivateKey
+	// When draining the server before shutting it down, wait at most this many seconds for running
+	// sessions to finish and pending result callbacks to be sent (default value 0 means 60)
+	DrainTimeout int `json:"drain_timeout" mapstructure:"drain_timeout"`
+
+	// Maximum number of requests per minute to the IRMA app endpoints from a single IP address
+	// (default value 0 means unlimited). Note that the IRMA app polls the session status while
+	// a session is running, so this should allow for a few dozen requests per session.
+	ClientRateLimit int `json:"client_rate_limit" mapstructure:"client_rate_limit"`
+
+	// If specified, start a server at this port that exposes operational metrics in the Prometheus
+	// text exposition format at /metrics. The metrics are not authenticated and include requestor
+	// names, so this port should not be publicly reachable.
+	MetricsPort int `json:"metrics_port" mapstructure:"metrics_port"`
+	// If metrics_port is specified, the metrics server listens at this address
+	MetricsListenAddress string `json:"metrics_listen_addr" mapstructure:"metrics_listen_addr"`
+
+	// If specified, start a server for the admin API at this port
+	AdminPort int `json:"admin_port" mapstructure:"admin_port"`
+	// If admin_port is specified, the admin server listens at this address
+	AdminListenAddress string `json:"admin_listen_addr" mapstructure:"admin_listen_addr"`
+	// Token with which requests to the admin API must authenticate in the Authorization header
+	AdminKey     string `json:"admin_key" mapstructure:"admin_key"`
+	AdminKeyFile string `json:"admin_key_file" mapstructure:"admin_key_file"`
+
+	// OpenID Connect clients, keyed by client ID. If specified, an OpenID Connect provider is served
+	// at /oidc alongside the IRMA app endpoints, which requires a JWT private key to sign ID tokens with.
+	OidcClients map[string]OidcClient `json:"oidc_clients" mapstructure:"oidc_clients"`
+	// Issuer identifier (external URL) of the OpenID Connect provider (default: url with irma/ replaced by oidc)
+	OidcIssuer string `json:"oidc_issuer" mapstructure:"oidc_issuer"`
+	// Lifetime in seconds of ID tokens and access tokens (default value 0 means 300)
+	OidcTokenLifetime int `json:"oidc_token_lifetime" mapstructure:"oidc_token_lifetime"`
+
+	// Tenants hosted by this server in addition to the default tenant, keyed by tenant name
+	Tenants map[string]*Tenant `json:"tenants" mapstructure:"tenants"`
+
+	// If set, called by the /reload endpoint of the admin API to obtain the configuration to reload
+	ReadConfiguration func() (*Configuration, error) `json:"-"`
+
+	staticSessions       map[string]irma.RequestorRequest
+	jwtPrivateKey        crypto.Signer
+	jwtSigningMethod     jwt.SigningMethod
+	jwtKeyID             string
+	jwks                 *jwks
+	callbackKeys         map[string][]byte                      // Key: requestor name, or "" for the global callback key
+	resultEncryptionKeys map[string]*resultEncryptionKey        // Key: requestor name
+	pseudonymizers       map[string]*pseudonymizer              // Key: requestor name
+	issuancePolicies     map[string]*issuancePolicy             // Key: requestor name
+	sessionTemplates     map[string]map[string]*sessionTemplate // Keys: requestor name, template name
+	oidcClients          map[string]*oidcClient                 // Key: client ID
+	oidcIssuer           string
+	tenants              map[string]*Configuration // Key: tenant name
+	authenticators       map[AuthenticationMethod]Authenticator
+	adminKey             []byte
+	jwtReplayCache       *jwtReplayCache
+	tlsCertificate       *tls.Certificate
+	clientTlsCertificate *tls.Certificate
+	tlsClientCAs         *x509.CertPool
 }
 
 // Permissions specify which attributes or credential a requestor may verify or issue.
@@ -77,6 +170,13 @@ type Permissions struct {
 	Disclosing []string `json:"disclose_perms" mapstructure:"disclose_perms"`
 	Signing    []string `json:"sign_perms" mapstructure:"sign_perms"`
 	Issuing    []string `json:"issue_perms" mapstructure:"issue_perms"`
+
+	// Values that may be requested for attributes in disclosure or signature requests, per attribute
+	// (wildcards are allowed as in disclose_perms; the most specific match applies). Attributes with
+	// a nonempty list must be requested with one of its values, while an empty list forbids
+	// requesting a value for the attribute. Attributes matching none of these may be requested
+	// with any value, or none.
+	Values map[string][]string `json:"value_perms" mapstructure:"value_perms"`
 }
 
 // Requestor contains all configuration (disclosure or verification permissions and authentication)
@@ -87,6 +187,54 @@ type Requestor struct {
 	AuthenticationMethod  AuthenticationMethod `json:"auth_method" mapstructure:"auth_method"`
 	AuthenticationKey     string               `json:"key" mapstructure:"key"`
 	AuthenticationKeyFile string               `json:"key_file" mapstructure:"key_file"`
+
+	// Default callback URL for sessions of this requestor whose session request specifies none
+	CallbackURL string `json:"callback_url" mapstructure:"callback_url"`
+	// Key (base64 encoded) with which result callbacks to this requestor are signed using HMAC-SHA256
+	CallbackKey     string `json:"callback_key" mapstructure:"callback_key"`
+	CallbackKeyFile string `json:"callback_key_file" mapstructure:"callback_key_file"`
+
+	// For the tls authentication method: the client certificate of this requestor, identified by its
+	// subject distinguished name (e.g. "CN=backend,O=Example"), one of its subject alternative names,
+	// or its hex encoded SHA-256 fingerprint
+	TlsSubject     string `json:"tls_subject" mapstructure:"tls_subject"`
+	TlsSAN         string `json:"tls_san" mapstructure:"tls_san"`
+	TlsFingerprint string `json:"tls_fingerprint" mapstructure:"tls_fingerprint"`
+
+	// Public key (RSA or P-256, PEM encoded) to which session results of this requestor are encrypted
+	// as a JWE, if the session request asks for it with encryptResult or if encrypt_results is enabled
+	ResultEncryptionKey     string `json:"result_encryption_key" mapstructure:"result_encryption_key"`
+	ResultEncryptionKeyFile string `json:"result_encryption_key_file" mapstructure:"result_encryption_key_file"`
+	// Encrypt all session results of this requestor, regardless of the session request
+	EncryptResults bool `json:"encrypt_results" mapstructure:"encrypt_results"`
+
+	// Attributes (e.g. "irma-demo.MijnOverheid.root.BSN") whose disclosed values this requestor receives
+	// only as a pseudonym: a keyed hash (HMAC-SHA256) of the value, using a secret specific to this requestor
+	PseudonymousAttributes []string `json:"pseudonymous_attributes" mapstructure:"pseudonymous_attributes"`
+	// Key (base64 encoded, at least 32 bytes) with which the pseudonyms of this requestor are computed
+	PseudonymKey     string `json:"pseudonym_key" mapstructure:"pseudonym_key"`
+	PseudonymKeyFile string `json:"pseudonym_key_file" mapstructure:"pseudonym_key_file"`
+
+	// Require the session request JWTs of this requestor to have a jti field, and accept each JWT only once
+	// (per server process, see jwt_require_id)
+	SingleUseJwts bool `json:"single_use_jwts" mapstructure:"single_use_jwts"`
+
+	// Maximum number of sessions this requestor may start per minute (default value 0 means unlimited)
+	MaxSessionsPerMinute int `json:"max_sessions_per_minute" mapstructure:"max_sessions_per_minute"`
+	// Maximum number of unfinished sessions this requestor may have at once (default value 0 means unlimited)
+	MaxConcurrentSessions int `json:"max_concurrent_sessions" mapstructure:"max_concurrent_sessions"`
+	// Maximum number of credentials this requestor may issue per day, counting the credentials of
+	// issuance sessions as they are started, except those of sessions that are cancelled or time out
+	// (default value 0 means unlimited)
+	MaxIssuancePerDay int `json:"max_issuance_per_day" mapstructure:"max_issuance_per_day"`
+
+	// Restrictions on the validity, key counters and attribute values of credentials this requestor issues
+	IssuancePolicy *IssuancePolicy `json:"issue_policy" mapstructure:"issue_policy"`
+
+	// Session requests that this requestor may start by POSTing just the template name and its parameters,
+	// keyed by template name. Parameters occur as {{name}} placeholders in the string values of the
+	// session request, e.g. in attribute values, the message to be signed or the callback URL.
+	SessionTemplates map[string]interface{} `json:"session_templates" mapstructure:"session_templates"`
 }
 
 // CanIssue returns whether or not the specified requestor may issue the specified credentials.
@@ -131,15 +279,20 @@ func (conf *Configuration) CanVerifyOrSign(requestor string, action irma.Action,
 	}
 
 	err := disjunctions.Iterate(func(attr *irma.AttributeRequest) error {
-		if contains(permissions, "*") ||
+		if !(contains(permissions, "*") ||
 			contains(permissions, attr.Type.Root()+".*") ||
 			contains(permissions, attr.Type.CredentialTypeIdentifier().IssuerIdentifier().String()+".*") ||
 			contains(permissions, attr.Type.CredentialTypeIdentifier().String()+".*") ||
-			contains(permissions, attr.Type.String()) {
-			return nil
-		} else {
+			contains(permissions, attr.Type.String())) {
 			return errors.New(attr.Type.String())
 		}
+		if !conf.canRequestValue(requestor, attr.Type, attr.Value) {
+			if attr.Value == nil {
+				return errors.Errorf("%s (value must be requested)", attr.Type)
+			}
+			return errors.Errorf("%s (requested value not allowed)", attr.Type)
+		}
+		return nil
 	})
 	if err != nil {
 		return false, err.Error()
@@ -147,13 +300,77 @@ func (conf *Configuration) CanVerifyOrSign(requestor string, action irma.Action,
 	return true, ""
 }
 
+// canRequestValue returns whether or not the specified requestor may request the specified value
+// for the attribute type, according to the most specific matching value permission of the requestor,
+// or else of the global permissions. If that permission lists any values, then a value must be
+// requested (value must not be nil).
+func (conf *Configuration) canRequestValue(requestor string, typ irma.AttributeTypeIdentifier, value *string) bool {
+	patterns := []string{
+		typ.String(),
+		typ.CredentialTypeIdentifier().String() + ".*",
+		typ.CredentialTypeIdentifier().IssuerIdentifier().String() + ".*",
+		typ.Root() + ".*",
+		"*",
+	}
+	for _, values := range []map[string][]string{conf.Requestors[requestor].Values, conf.Values} {
+		for _, pattern := range patterns {
+			if allowed, ok := values[pattern]; ok {
+				if value == nil {
+					return len(allowed) == 0
+				}
+				return contains(allowed, *value)
+			}
+		}
+	}
+	return true
+}
+
 func (conf *Configuration) initialize() error {
 	if err := conf.readPrivateKey(); err != nil {
 		return err
 	}
+	if err := conf.readJwks(); err != nil {
+		return err
+	}
+
+	if err := conf.readCallbackKeys(); err != nil {
+		return err
+	}
+	if err := conf.readResultEncryptionKeys(); err != nil {
+		return err
+	}
+	if err := conf.readPseudonymizers(); err != nil {
+		return err
+	}
+	if err := conf.readIssuancePolicies(); err != nil {
+		return err
+	}
+	if conf.CallbackMaxRetries < 0 || conf.CallbackMaxBackoff < 0 {
+		return errors.New("callback_max_retries and callback_max_backoff must not be negative")
+	}
+	if conf.CallbackMaxRetries == 0 {
+		conf.CallbackMaxRetries = 10
+	}
+	if conf.CallbackMaxBackoff == 0 {
+		conf.CallbackMaxBackoff = 3600
+	}
+	if conf.ClientRateLimit < 0 {
+		return errors.New("client_rate_limit must not be negative")
+	}
+	for name, requestor := range conf.Requestors {
+		if requestor.MaxSessionsPerMinute < 0 || requestor.MaxConcurrentSessions < 0 || requestor.MaxIssuancePerDay < 0 {
+			return errors.Errorf("Requestor %s: rate limits and quotas must not be negative", name)
+		}
+	}
+	if conf.DrainTimeout < 0 {
+		return errors.New("drain_timeout must not be negative")
+	}
+	if conf.DrainTimeout == 0 {
+		conf.DrainTimeout = 60
+	}
 
 	if conf.DisableRequestorAuthentication {
-		authenticators = map[AuthenticationMethod]Authenticator{AuthenticationMethodNone: NilAuthenticator{}}
+		conf.authenticators = map[AuthenticationMethod]Authenticator{AuthenticationMethodNone: NilAuthenticator{}}
 		conf.Logger.Warn("Authentication of incoming session requests disabled: anyone who can reach this server can use it")
 		havekeys, err := conf.HavePrivateKeys()
 		if err != nil {
@@ -167,21 +384,47 @@ func (conf *Configuration) initialize() error {
 			}
 		}
 	} else {
-		if len(conf.Requestors) == 0 {
+		if len(conf.Requestors) == 0 && len(conf.Tenants) == 0 {
 			return errors.New("No requestors configured; either configure one or more requestors or disable requestor authentication")
 		}
-		authenticators = map[AuthenticationMethod]Authenticator{
-			AuthenticationMethodHmac:      &HmacAuthenticator{hmackeys: map[string]interface{}{}, maxRequestAge: conf.MaxRequestAge},
-			AuthenticationMethodPublicKey: &PublicKeyAuthenticator{publickeys: map[string]interface{}{}, maxRequestAge: conf.MaxRequestAge},
+		if conf.JwtReplayCacheSize < 0 {
+			return errors.New("jwt_replay_cache_size must not be negative")
+		}
+		if conf.JwtReplayCacheSize == 0 {
+			conf.JwtReplayCacheSize = 100000
+		}
+		if conf.jwtReplayCache == nil {
+			conf.jwtReplayCache = newJwtReplayCache(conf.JwtReplayCacheSize)
+		} else { // keep remembering used JWTs after a reload
+			conf.jwtReplayCache.setSize(conf.JwtReplayCacheSize)
+		}
+		policy := &jwtPolicy{
+			requireID:   conf.JwtRequireID,
+			singleUse:   map[string]bool{},
+			replayCache: conf.jwtReplayCache,
+		}
+		if conf.JwtRequireAudience {
+			if conf.JwtIssuer == "" {
+				return errors.New("jwt_require_audience requires jwt_issuer")
+			}
+			policy.audience = conf.JwtIssuer
+		}
+		conf.authenticators = map[AuthenticationMethod]Authenticator{
+			AuthenticationMethodHmac:      &HmacAuthenticator{hmackeys: map[string]interface{}{}, maxRequestAge: conf.MaxRequestAge, policy: policy},
+			AuthenticationMethodPublicKey: &PublicKeyAuthenticator{publickeys: map[string]interface{}{}, maxRequestAge: conf.MaxRequestAge, policy: policy},
+			AuthenticationMethodECDSA:     &PublicKeyAuthenticator{publickeys: map[string]interface{}{}, maxRequestAge: conf.MaxRequestAge, policy: policy, method: jwt.SigningMethodES256},
+			AuthenticationMethodEd25519:   &PublicKeyAuthenticator{publickeys: map[string]interface{}{}, maxRequestAge: conf.MaxRequestAge, policy: policy, method: irma.SigningMethodEdDSA},
 			AuthenticationMethodToken:     &PresharedKeyAuthenticator{presharedkeys: map[string]string{}},
+			AuthenticationMethodTls:       &TlsAuthenticator{subjects: map[string]string{}, sans: map[string]string{}, fingerprints: map[string]string{}},
 		}
 
 		// Initialize authenticators
 		for name, requestor := range conf.Requestors {
-			authenticator, ok := authenticators[requestor.AuthenticationMethod]
+			authenticator, ok := conf.authenticators[requestor.AuthenticationMethod]
 			if !ok {
-				return errors.Errorf("Requestor %s has unsupported authentication type %s (supported methods: %s, %s, %s)",
-					name, requestor.AuthenticationMethod, AuthenticationMethodToken, AuthenticationMethodHmac, AuthenticationMethodPublicKey)
+				return errors.Errorf("Requestor %s has unsupported authentication type %s (supported methods: %s, %s, %s, %s, %s, %s)",
+					name, requestor.AuthenticationMethod, AuthenticationMethodToken, AuthenticationMethodHmac,
+					AuthenticationMethodPublicKey, AuthenticationMethodECDSA, AuthenticationMethodEd25519, AuthenticationMethodTls)
 			}
 			if err := authenticator.Initialize(name, requestor); err != nil {
 				return err
@@ -202,6 +445,30 @@ func (conf *Configuration) initialize() error {
 	if conf.ClientListenAddress != "" && conf.ClientPort == 0 {
 		return errors.New("client_listen_addr must be combined with a nonzero client_port")
 	}
+	if conf.AdminPort < 0 || conf.AdminPort > 65535 {
+		return errors.Errorf("admin_port must be between 0 and 65535 (was %d)", conf.AdminPort)
+	}
+	if conf.AdminPort != 0 && (conf.AdminPort == conf.Port || conf.AdminPort == conf.ClientPort) {
+		return errors.New("If admin_port is given it must be different from port and client_port")
+	}
+	if conf.AdminListenAddress != "" && conf.AdminPort == 0 {
+		return errors.New("admin_listen_addr must be combined with a nonzero admin_port")
+	}
+	if conf.MetricsPort < 0 || conf.MetricsPort > 65535 {
+		return errors.Errorf("metrics_port must be between 0 and 65535 (was %d)", conf.MetricsPort)
+	}
+	if conf.MetricsPort != 0 && (conf.MetricsPort == conf.Port || conf.MetricsPort == conf.ClientPort || conf.MetricsPort == conf.AdminPort) {
+		return errors.New("If metrics_port is given it must be different from port, client_port and admin_port")
+	}
+	if conf.MetricsListenAddress != "" && conf.MetricsPort == 0 {
+		return errors.New("metrics_listen_addr must be combined with a nonzero metrics_port")
+	}
+	if conf.AdminPort != 0 {
+		var err error
+		if conf.adminKey, err = fs.ReadKey(conf.AdminKey, conf.AdminKeyFile); err != nil {
+			return errors.WrapPrefix(err, "Failed to read admin key, which is required when admin_port is given", 0)
+		}
+	}
 
 	tlsConf, err := conf.tlsConfig()
 	if err != nil {
@@ -211,10 +478,30 @@ func (conf *Configuration) initialize() error {
 	if err != nil {
 		return errors.WrapPrefix(err, "Failed to read client TLS configuration", 0)
 	}
+	if tlsConf != nil {
+		conf.tlsCertificate = &tlsConf.Certificates[0]
+	}
+	if clientTlsConf != nil {
+		conf.clientTlsCertificate = &clientTlsConf.Certificates[0]
+	}
+	if err = conf.readTlsClientCAs(); err != nil {
+		return err
+	}
+	if conf.tlsClientCAs != nil && tlsConf == nil {
+		return errors.New("tls_client_ca requires TLS to be enabled")
+	}
+	for name, requestor := range conf.Requestors {
+		if requestor.AuthenticationMethod == AuthenticationMethodTls && conf.tlsClientCAs == nil {
+			return errors.Errorf("Requestor %s uses tls authentication, which requires tls_client_ca", name)
+		}
+	}
 
 	if err := conf.validatePermissions(); err != nil {
 		return err
 	}
+	if err := conf.readSessionTemplates(); err != nil {
+		return err
+	}
 
 	if conf.StaticPath != "" {
 		if err := fs.AssertPathExists(conf.StaticPath); err != nil {
@@ -251,8 +538,8 @@ func (conf *Configuration) initialize() error {
 		}
 	}
 
-	if len(conf.StaticSessions) != 0 && conf.jwtPrivateKey == nil {
-		conf.Logger.Warn("Static sessions enabled and no JWT private key installed. Ensure that POSTs to the callback URLs of static sessions are trustworthy by keeping the callback URLs secret and by using HTTPS.")
+	if len(conf.StaticSessions) != 0 && !conf.canSignCallbacks("") {
+		conf.Logger.Warn("Static sessions enabled and no JWT private key or callback key installed. Ensure that POSTs to the callback URLs of static sessions are trustworthy by keeping the callback URLs secret and by using HTTPS.")
 	}
 	conf.staticSessions = make(map[string]irma.RequestorRequest)
 	for name, r := range conf.StaticSessions {
@@ -274,9 +561,22 @@ func (conf *Configuration) initialize() error {
 		if rrequest.Base().CallbackURL == "" {
 			return errors.Errorf("static session %s has no callback URL", name)
 		}
+		if rrequest.Base().EncryptResult {
+			return errors.Errorf("static session %s cannot encrypt its result, as it has no requestor", name)
+		}
+		if rrequest.Base().NextSession != nil {
+			return errors.Errorf("static session %s cannot have a next session, as it has no requestor", name)
+		}
 		conf.staticSessions[name] = rrequest
 	}
 
+	if err := conf.readOidcClients(); err != nil {
+		return err
+	}
+	if err := conf.readTenants(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -301,8 +601,12 @@ func (conf *Configuration) validatePermissionSet(requestor string, requestorperm
 		"issuing":    requestorperms.Issuing,
 		"signing":    requestorperms.Signing,
 		"disclosing": requestorperms.Disclosing,
+		"value":      nil,
 	}
-	permissionlength := map[string]int{"issuing": 3, "signing": 4, "disclosing": 4}
+	for pattern := range requestorperms.Values {
+		perms["value"] = append(perms["value"], pattern)
+	}
+	permissionlength := map[string]int{"issuing": 3, "signing": 4, "disclosing": 4, "value": 4}
 
 	for typ, typeperms := range perms {
 		for _, permission := range typeperms {
@@ -357,6 +661,23 @@ func (conf *Configuration) tlsConfig() (*tls.Config, error) {
 	return conf.readTlsConf(conf.TlsCertificate, conf.TlsCertificateFile, conf.TlsPrivateKey, conf.TlsPrivateKeyFile)
 }
 
+func (conf *Configuration) readTlsClientCAs() error {
+	conf.tlsClientCAs = nil
+	if conf.TlsClientCA == "" && conf.TlsClientCAFile == "" {
+		return nil
+	}
+	bts, err := fs.ReadKey(conf.TlsClientCA, conf.TlsClientCAFile)
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to read TLS client CA", 0)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bts) {
+		return errors.New("Failed to parse TLS client CA: no PEM encoded certificates found")
+	}
+	conf.tlsClientCAs = pool
+	return nil
+}
+
 func (conf *Configuration) readTlsConf(cert, certfile, key, keyfile string) (*tls.Config, error) {
 	if cert == "" && certfile == "" && key == "" && keyfile == "" {
 		return nil, nil
@@ -396,14 +717,71 @@ func (conf *Configuration) readPrivateKey() error {
 		return nil
 	}
 
+	sk, method, err := conf.parsePrivateKey()
+	if err != nil {
+		return err
+	}
+	conf.jwtPrivateKey = sk
+	conf.jwtSigningMethod = method
+	conf.Logger.Infof("Private key parsed, JWT endpoints enabled (using %s)", method.Alg())
+	return nil
+}
+
+// parsePrivateKey parses the JWT private key, which may be an RSA, ECDSA (P-256) or Ed25519 key,
+// returning it along with the signing method with which JWTs are to be signed.
+func (conf *Configuration) parsePrivateKey() (crypto.Signer, jwt.SigningMethod, error) {
 	keybytes, err := fs.ReadKey(conf.JwtPrivateKey, conf.JwtPrivateKeyFile)
 	if err != nil {
-		return errors.WrapPrefix(err, "failed to read private key", 0)
+		return nil, nil, errors.WrapPrefix(err, "failed to read private key", 0)
+	}
+	return irma.ParseJwtPrivateKey(keybytes)
+}
+
+// signJwt signs a JWT containing the specified claims using the JWT private key.
+func (conf *Configuration) signJwt(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(conf.jwtSigningMethod, claims)
+	token.Header["kid"] = conf.jwtKeyID
+	return token.SignedString(conf.jwtPrivateKey)
+}
+
+func (conf *Configuration) readCallbackKeys() error {
+	conf.callbackKeys = map[string][]byte{}
+	keys := map[string][2]string{"": {conf.CallbackKey, conf.CallbackKeyFile}}
+	for name, requestor := range conf.Requestors {
+		keys[name] = [2]string{requestor.CallbackKey, requestor.CallbackKeyFile}
 	}
+	for name, key := range keys {
+		if key[0] == "" && key[1] == "" {
+			continue
+		}
+		bts, err := fs.ReadKey(key[0], key[1])
+		if err == nil {
+			bts, err = fs.Base64Decode(bts)
+		}
+		if err != nil {
+			if name == "" {
+				return errors.WrapPrefix(err, "failed to read callback key", 0)
+			}
+			return errors.WrapPrefix(err, "failed to read callback key of requestor "+name, 0)
+		}
+		conf.callbackKeys[name] = bts
+	}
+	return nil
+}
+
+// callbackKey returns the key with which result callbacks to the specified requestor are signed
+// using HMAC, if any.
+func (conf *Configuration) callbackKey(requestor string) []byte {
+	if key, ok := conf.callbackKeys[requestor]; ok {
+		return key
+	}
+	return conf.callbackKeys[""]
+}
 
-	conf.jwtPrivateKey, err = jwt.ParseRSAPrivateKeyFromPEM(keybytes)
-	conf.Logger.Info("Private key parsed, JWT endpoints enabled")
-	return err
+// canSignCallbacks returns whether or not result callbacks to the specified requestor are signed,
+// either with the JWT private key or with a callback key.
+func (conf *Configuration) canSignCallbacks(requestor string) bool {
+	return conf.jwtPrivateKey != nil || conf.callbackKey(requestor) != nil
 }
 
 func (conf *Configuration) separateClientServer() bool {
@@ -219,3 +219,54 @@ func TestCanVerifyOrSign(t *testing.T) {
 		}
 	}
 }
+
+func TestCanVerifyOrSignValues(t *testing.T) {
+	confJSON := `{
+		"disclose_perms": [ "*" ],
+		"value_perms": {
+			"irma-demo.MijnOverheid.*": []
+		},
+		"requestors": {
+			"myapp": {
+				"disclose_perms": [ "irma-demo.*" ],
+				"value_perms": {
+					"irma-demo.MijnOverheid.ageLower.over18": [ "yes" ]
+				},
+				"auth_method": "token",
+				"key": "eGE2PSomOT84amVVdTU"
+			}
+		}
+	}`
+	var conf Configuration
+	require.NoError(t, json.Unmarshal([]byte(confJSON), &conf))
+
+	request := func(attr string, value *string) irma.AttributeConDisCon {
+		return irma.AttributeConDisCon{{{{Type: irma.NewAttributeTypeIdentifier(attr), Value: value}}}}
+	}
+	yes, no := "yes", "no"
+
+	cases := []struct {
+		description string
+		requestor   string
+		attr        string
+		value       *string
+		result      bool
+	}{
+		{"allowed value", "myapp", "irma-demo.MijnOverheid.ageLower.over18", &yes, true},
+		{"disallowed value", "myapp", "irma-demo.MijnOverheid.ageLower.over18", &no, false},
+		{"missing value", "myapp", "irma-demo.MijnOverheid.ageLower.over18", nil, false},
+		{"no value where values are forbidden", "myapp", "irma-demo.MijnOverheid.ageLower.over12", nil, true},
+		{"values forbidden by global wildcard", "myapp", "irma-demo.MijnOverheid.ageLower.over12", &yes, false},
+		{"values forbidden for other requestor", "other", "irma-demo.MijnOverheid.ageLower.over18", &yes, false},
+		{"unconstrained attribute", "myapp", "irma-demo.RU.studentCard.studentID", &no, true},
+	}
+	for _, c := range cases {
+		t.Run(c.description, func(t *testing.T) {
+			result, message := conf.CanVerifyOrSign(c.requestor, irma.ActionDisclosing, request(c.attr, c.value))
+			require.Equal(t, c.result, result)
+			if !c.result {
+				require.Contains(t, message, c.attr)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package requestorserver
+
+import (
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/irmaserver"
+)
+
+// credentialsURL returns the URL from which the credentials of a dynamic issuance session are
+// obtained, if any.
+func credentialsURL(rrequest irma.RequestorRequest) string {
+	if ipr, ok := rrequest.(*irma.IdentityProviderRequest); ok {
+		return ipr.CredentialsURL
+	}
+	return ""
+}
+
+// dynamicCredentials returns a handler that computes the credentials of dynamic issuance sessions
+// of the specified requestor: the credentialsUrl of the session request responds to the session
+// result with the credentials, which are checked against the issuance policy of the requestor.
+func (s *Server) dynamicCredentials(requestor string) irmaserver.CredentialsHandler {
+	return func(result *server.SessionResult, request *irma.IssuanceRequest) ([]*irma.CredentialRequest, error) {
+		url := credentialsURL(s.irmaserv.GetRequest(result.Token))
+		if url == "" {
+			return nil, errors.New("no credentialsUrl specified")
+		}
+
+		var creds []*irma.CredentialRequest
+		if err := s.postSessionResult(requestor, url, result, &creds); err != nil {
+			return nil, errors.WrapPrefix(err, "failed to POST session result to credentials URL", 0)
+		}
+
+		// Check the credentials as they will be issued against the issuance policy
+		if err := request.CheckDynamicCredentials(creds); err != nil {
+			return nil, err
+		}
+		computed := *request
+		computed.Credentials = creds
+		if err := s.config().CheckIssuancePolicy(requestor, &computed); err != nil {
+			return nil, errors.WrapPrefix(err, "dynamic credentials violate issuance policy", 0)
+		}
+		return creds, nil
+	}
+}
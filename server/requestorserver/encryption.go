@@ -0,0 +1,132 @@
+package requestorserver
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/fs"
+	"github.com/privacybydesign/irmago/server"
+)
+
+// resultEncryptionKey is a public key of a requestor to which its session results are encrypted.
+type resultEncryptionKey struct {
+	key crypto.PublicKey
+	kid string // RFC 7638 thumbprint of the key
+}
+
+// readResultEncryptionKeys parses the result encryption keys of the requestors.
+func (conf *Configuration) readResultEncryptionKeys() error {
+	conf.resultEncryptionKeys = map[string]*resultEncryptionKey{}
+	for name, requestor := range conf.Requestors {
+		if requestor.ResultEncryptionKey == "" && requestor.ResultEncryptionKeyFile == "" {
+			if requestor.EncryptResults {
+				return errors.Errorf("Requestor %s has encrypt_results enabled but no result_encryption_key", name)
+			}
+			continue
+		}
+		bts, err := fs.ReadKey(requestor.ResultEncryptionKey, requestor.ResultEncryptionKeyFile)
+		if err != nil {
+			return errors.WrapPrefix(err, "failed to read result encryption key of requestor "+name, 0)
+		}
+		pk, _, err := irma.ParseJwtPublicKey(bts)
+		if err != nil {
+			return errors.WrapPrefix(err, "failed to parse result encryption key of requestor "+name, 0)
+		}
+		switch pk.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey:
+		default:
+			return errors.Errorf("result encryption key of requestor %s must be an RSA or P-256 key", name)
+		}
+		k, err := newJwk(pk, "")
+		if err != nil {
+			return errors.WrapPrefix(err, "failed to parse result encryption key of requestor "+name, 0)
+		}
+		conf.resultEncryptionKeys[name] = &resultEncryptionKey{key: pk, kid: k.Kid}
+	}
+	return nil
+}
+
+// resultEncryptionKey returns the key to which the results of the specified session must be
+// encrypted, or nil if its results need not be encrypted.
+func (s *Server) resultEncryptionKey(token string) (*resultEncryptionKey, error) {
+	info := s.irmaserv.SessionInfo(token)
+	if info == nil {
+		return nil, nil
+	}
+	return s.config().requestorResultEncryptionKey(info.Requestor, info.Request != nil && info.Request.Base().EncryptResult)
+}
+
+// requestorResultEncryptionKey returns the key to which the session results of the specified
+// requestor must be encrypted if encrypt is true, or nil otherwise. Unlike resultEncryptionKey,
+// it does not access the session, so it may be used while the session is locked.
+func (conf *Configuration) requestorResultEncryptionKey(requestor string, encrypt bool) (*resultEncryptionKey, error) {
+	if !encrypt {
+		return nil, nil
+	}
+	key := conf.resultEncryptionKeys[requestor]
+	if key == nil {
+		return nil, errors.Errorf("session result must be encrypted but requestor %s has no result encryption key", requestor)
+	}
+	return key, nil
+}
+
+// encryptResult encrypts the payload to the result encryption key of the requestor of the session
+// if its session request requires so, returning the compact JWE, or the payload as is otherwise.
+// The cty parameter specifies the content type of the payload in the JWE header.
+func (s *Server) encryptResult(token string, payload []byte, cty string) (string, bool, error) {
+	key, err := s.resultEncryptionKey(token)
+	if err != nil {
+		return "", false, err
+	}
+	return encryptResultTo(key, payload, cty)
+}
+
+// encryptResultTo encrypts the payload to the specified result encryption key, if not nil.
+func encryptResultTo(key *resultEncryptionKey, payload []byte, cty string) (string, bool, error) {
+	if key == nil {
+		return string(payload), false, nil
+	}
+	jwe, err := irma.EncryptJwe(payload, key.key, key.kid, cty)
+	if err != nil {
+		return "", false, err
+	}
+	return jwe, true, nil
+}
+
+// writeResult writes the session result JSON or JWT payload to the response, encrypted as a JWE
+// if the session request requires so.
+func (s *Server) writeResult(w http.ResponseWriter, token string, payload []byte, cty string) {
+	res, encrypted, err := s.encryptResult(token, payload, cty)
+	if err != nil {
+		s.config().Logger.Error("Failed to encrypt session result")
+		_ = server.LogError(err)
+		server.WriteError(w, server.ErrorUnknown, err.Error())
+		return
+	}
+	switch {
+	case encrypted:
+		w.Header().Set("Content-Type", "application/jose")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(res))
+	case cty == "JWT":
+		server.WriteString(w, res)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(payload)
+	}
+}
+
+// marshalResult returns the JSON serialization of the session result, in the legacy format if
+// the session was a legacy session.
+func marshalResult(res *server.SessionResult) ([]byte, error) {
+	if res.LegacySession {
+		return json.Marshal(res.Legacy())
+	}
+	return json.Marshal(res)
+}
@@ -0,0 +1,139 @@
+package requestorserver
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"sort"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/fs"
+	"github.com/privacybydesign/irmago/server"
+	"golang.org/x/crypto/ed25519"
+)
+
+// JwtKey is a public or private key with which JWTs signed by the server can be verified.
+type JwtKey struct {
+	Key     string `json:"key" mapstructure:"key"`
+	KeyFile string `json:"key_file" mapstructure:"key_file"`
+}
+
+// jwk is a public key in JSON Web Key format (RFC 7517).
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// jwks is a JSON Web Key Set, as served at /.well-known/jwks.json.
+type jwks struct {
+	Keys []*jwk `json:"keys"`
+}
+
+// newJwk converts the public key to a JWK. If kid is empty, the RFC 7638 thumbprint of the key
+// is used as its kid.
+func newJwk(pk crypto.PublicKey, kid string) (*jwk, error) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	var k *jwk
+	switch pk := pk.(type) {
+	case *rsa.PublicKey:
+		k = &jwk{Kty: "RSA", Alg: "RS256", N: b64(pk.N.Bytes()), E: b64(big.NewInt(int64(pk.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		size := (pk.Curve.Params().BitSize + 7) / 8
+		k = &jwk{Kty: "EC", Alg: "ES256", Crv: pk.Curve.Params().Name, X: b64(irma.JwkPad(pk.X.Bytes(), size)), Y: b64(irma.JwkPad(pk.Y.Bytes(), size))}
+	case ed25519.PublicKey:
+		k = &jwk{Kty: "OKP", Alg: irma.SigningMethodEdDSA.Alg(), Crv: "Ed25519", X: b64(pk)}
+	default:
+		return nil, errors.New("unsupported public key type")
+	}
+	k.Use = "sig"
+	k.Kid = kid
+	if k.Kid == "" {
+		k.Kid = k.thumbprint()
+	}
+	return k, nil
+}
+
+// thumbprint computes the JWK thumbprint (RFC 7638) of the key: the hash of a JSON object containing
+// only the required members of the JWK, in lexicographical order (which json.Marshal ensures for maps).
+func (k *jwk) thumbprint() string {
+	members := map[string]string{"kty": k.Kty}
+	switch k.Kty {
+	case "RSA":
+		members["n"], members["e"] = k.N, k.E
+	case "EC":
+		members["crv"], members["x"], members["y"] = k.Crv, k.X, k.Y
+	case "OKP":
+		members["crv"], members["x"] = k.Crv, k.X
+	}
+	bts, _ := json.Marshal(members) // can't fail
+	hash := sha256.Sum256(bts)
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// readJwks computes the kid of the JWT private key, and the JWKS containing the public key of the
+// JWT private key along with the keys from jwt_verification_keys.
+func (conf *Configuration) readJwks() error {
+	conf.jwks = &jwks{Keys: []*jwk{}}
+	conf.jwtKeyID = ""
+	if conf.jwtPrivateKey != nil {
+		k, err := newJwk(conf.jwtPrivateKey.Public(), conf.JwtKeyID)
+		if err != nil {
+			return err
+		}
+		conf.jwtKeyID = k.Kid
+		conf.jwks.Keys = append(conf.jwks.Keys, k)
+	}
+
+	kids := make([]string, 0, len(conf.JwtVerificationKeys))
+	for kid := range conf.JwtVerificationKeys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+	for _, kid := range kids {
+		key := conf.JwtVerificationKeys[kid]
+		if kid == conf.jwtKeyID {
+			return errors.Errorf("jwt_verification_keys: kid %s is already used by the JWT private key", kid)
+		}
+		bts, err := fs.ReadKey(key.Key, key.KeyFile)
+		if err != nil {
+			return errors.WrapPrefix(err, "failed to read JWT verification key "+kid, 0)
+		}
+		// Accept both public and private keys
+		pk, _, err := irma.ParseJwtPublicKey(bts)
+		if err != nil {
+			sk, _, skErr := irma.ParseJwtPrivateKey(bts)
+			if skErr != nil {
+				return errors.WrapPrefix(err, "failed to parse JWT verification key "+kid, 0)
+			}
+			pk = sk.Public()
+		}
+		k, err := newJwk(pk, kid)
+		if err != nil {
+			return errors.WrapPrefix(err, "failed to parse JWT verification key "+kid, 0)
+		}
+		conf.jwks.Keys = append(conf.jwks.Keys, k)
+	}
+	return nil
+}
+
+func (s *Server) handleJwks(w http.ResponseWriter, r *http.Request) {
+	conf := s.config()
+	if len(conf.jwks.Keys) == 0 {
+		server.WriteError(w, server.ErrorUnsupported, "")
+		return
+	}
+	server.WriteJson(w, conf.jwks)
+}
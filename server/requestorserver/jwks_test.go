@@ -0,0 +1,59 @@
+package requestorserver
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestJwkThumbprint(t *testing.T) {
+	// Example from RFC 8037, appendix A.3
+	x, err := base64.RawURLEncoding.DecodeString("11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo")
+	require.NoError(t, err)
+	k, err := newJwk(ed25519.PublicKey(x), "")
+	require.NoError(t, err)
+	require.Equal(t, "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k", k.Kid)
+}
+
+func TestJwks(t *testing.T) {
+	pemKey := func() (string, ed25519.PublicKey) {
+		pk, sk, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		bts, err := test.MarshalPKCS8PrivateKey(sk)
+		require.NoError(t, err)
+		return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: bts})), pk
+	}
+	current, currentPk := pemKey()
+	retiring, _ := pemKey()
+
+	conf := &Configuration{
+		Configuration:       &server.Configuration{Logger: server.NewLogger(0, true, false)},
+		JwtPrivateKey:       current,
+		JwtKeyID:            "current",
+		JwtVerificationKeys: map[string]JwtKey{"retiring": {Key: retiring}},
+	}
+	require.NoError(t, conf.readPrivateKey())
+	require.NoError(t, conf.readJwks())
+	require.Len(t, conf.jwks.Keys, 2)
+	require.Equal(t, "current", conf.jwks.Keys[0].Kid)
+	require.Equal(t, base64.RawURLEncoding.EncodeToString(currentPk), conf.jwks.Keys[0].X)
+	require.Equal(t, "retiring", conf.jwks.Keys[1].Kid)
+
+	// Signed JWTs refer to the current key
+	j, err := conf.signJwt(jwt.StandardClaims{Subject: "test"})
+	require.NoError(t, err)
+	token, err := jwt.Parse(j, func(*jwt.Token) (interface{}, error) { return currentPk, nil })
+	require.NoError(t, err)
+	require.Equal(t, "current", token.Header["kid"])
+
+	// A kid may not be used twice
+	conf.JwtVerificationKeys["current"] = JwtKey{Key: retiring}
+	require.Error(t, conf.readJwks())
+}
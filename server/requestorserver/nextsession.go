@@ -0,0 +1,42 @@
+package requestorserver
+
+import (
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/irmaserver"
+)
+
+// nextSession returns a handler that obtains the follow-up session of sessions of the specified
+// requestor from the nextSession URL of the session request, which responds to the session result
+// with the follow-up session request, if any. That request is authorized like any other.
+func (s *Server) nextSession(requestor string) irmaserver.NextSessionHandler {
+	return func(result *server.SessionResult) (interface{}, error) {
+		next := s.irmaserv.GetRequest(result.Token).Base().NextSession
+		if next == nil || next.URL == "" {
+			return nil, nil
+		}
+
+		var response string
+		if err := s.postSessionResult(requestor, next.URL, result, &response); err != nil {
+			return nil, errors.WrapPrefix(err, "failed to POST session result to next session URL", 0)
+		}
+		if strings.TrimSpace(response) == "" {
+			return nil, nil
+		}
+
+		rrequest, err := server.ParseSessionRequest(response)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "failed to parse next session request", 0)
+		}
+		if rerr := s.authorizeRequest(requestor, rrequest); rerr != nil {
+			return nil, rerr
+		}
+		if _, limit, _ := s.requestorLimit(requestor, rrequest.SessionRequest(), false); limit != "" {
+			metricRateLimited.Inc(limit)
+			return nil, errors.Errorf("requestor exceeded rate limit %s", limit)
+		}
+		return rrequest, nil
+	}
+}
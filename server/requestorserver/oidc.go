@@ -0,0 +1,522 @@
+package requestorserver
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-chi/chi"
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+)
+
+// OidcClient is a relying party of the OpenID Connect provider, which authenticates its users
+// by letting them disclose attributes with their IRMA app.
+type OidcClient struct {
+	// Client secret with which the client authenticates at the token endpoint
+	Secret string `json:"secret" mapstructure:"secret"`
+	// Redirect URIs that the client may specify in authentication requests
+	RedirectURIs []string `json:"redirect_uris" mapstructure:"redirect_uris"`
+	// Disclosure request that users of this client perform to log in
+	Request interface{} `json:"request" mapstructure:"request"`
+	// Claims of the ID token and userinfo response, mapping claim names to attribute types of the
+	// disclosure request. If the sub claim is not mapped to an attribute, a random transient
+	// subject identifier is used on each login.
+	Claims map[string]string `json:"claims" mapstructure:"claims"`
+}
+
+// oidcClient is a parsed OidcClient.
+type oidcClient struct {
+	*OidcClient
+	request []byte // JSON serialization of the disclosure request, parsed anew for each login
+	claims  map[string]irma.AttributeTypeIdentifier
+}
+
+const (
+	oidcLoginLifetime = 15 * time.Minute
+	oidcCodeLifetime  = 1 * time.Minute
+)
+
+// oidcReservedClaims are the ID token claims set by the provider, that cannot be mapped to attributes.
+var oidcReservedClaims = []string{"iss", "aud", "exp", "iat", "auth_time", "nonce", "azp", "at_hash"}
+
+// oidcLogin is an authentication request of an OIDC client, during which the user performs
+// an IRMA session and afterwards the client exchanges the authorization code for tokens.
+type oidcLogin struct {
+	clientID     string
+	redirectURI  string
+	state        string
+	nonce        string
+	sessionToken string
+	sessionPtr   *irma.Qr
+	authTime     int64
+	claims       map[string]string // set once the IRMA session has finished successfully
+	expires      time.Time
+}
+
+// oidcProvider keeps the state of the OpenID Connect provider.
+type oidcProvider struct {
+	sync.Mutex
+	logins map[string]*oidcLogin // Key: login ID
+	codes  map[string]*oidcLogin // Key: authorization code
+	tokens map[string]*oidcLogin // Key: access token
+}
+
+func newOidcProvider() *oidcProvider {
+	return &oidcProvider{
+		logins: map[string]*oidcLogin{},
+		codes:  map[string]*oidcLogin{},
+		tokens: map[string]*oidcLogin{},
+	}
+}
+
+// purge removes all expired logins, codes and tokens. The caller must hold the lock.
+func (p *oidcProvider) purge() {
+	now := time.Now()
+	for _, m := range []map[string]*oidcLogin{p.logins, p.codes, p.tokens} {
+		for key, login := range m {
+			if now.After(login.expires) {
+				delete(m, key)
+			}
+		}
+	}
+}
+
+// take removes and returns the unexpired login under the specified key in the map, if any.
+func (p *oidcProvider) take(m map[string]*oidcLogin, key string) *oidcLogin {
+	p.Lock()
+	defer p.Unlock()
+	login := m[key]
+	delete(m, key)
+	if login == nil || time.Now().After(login.expires) {
+		return nil
+	}
+	return login
+}
+
+func (p *oidcProvider) get(m map[string]*oidcLogin, key string) *oidcLogin {
+	p.Lock()
+	defer p.Unlock()
+	login := m[key]
+	if login == nil || time.Now().After(login.expires) {
+		return nil
+	}
+	return login
+}
+
+func (p *oidcProvider) put(m map[string]*oidcLogin, login *oidcLogin) string {
+	key := oidcRandom()
+	p.Lock()
+	defer p.Unlock()
+	p.purge()
+	m[key] = login
+	return key
+}
+
+func oidcRandom() string {
+	bts := make([]byte, 32)
+	if _, err := rand.Read(bts); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(bts)
+}
+
+// readOidcClients parses and checks the OIDC clients, and determines the issuer identifier of the
+// OIDC provider.
+func (conf *Configuration) readOidcClients() error {
+	conf.oidcClients = map[string]*oidcClient{}
+	conf.oidcIssuer = ""
+	if len(conf.OidcClients) == 0 {
+		return nil
+	}
+	if conf.jwtPrivateKey == nil {
+		return errors.New("oidc_clients requires a JWT private key to sign ID tokens with")
+	}
+	conf.oidcIssuer = strings.TrimSuffix(conf.OidcIssuer, "/")
+	if conf.oidcIssuer == "" {
+		if conf.URL == "" {
+			return errors.New("oidc_clients requires oidc_issuer or url to be set")
+		}
+		conf.oidcIssuer = strings.TrimSuffix(conf.URL, "irma/") + "oidc"
+	}
+	if u, err := url.Parse(conf.oidcIssuer); err != nil || !u.IsAbs() || u.RawQuery != "" || u.Fragment != "" {
+		return errors.Errorf("oidc_issuer %s is not an absolute URL without query or fragment", conf.oidcIssuer)
+	}
+	if conf.OidcTokenLifetime < 0 {
+		return errors.New("oidc_token_lifetime must not be negative")
+	}
+	if conf.OidcTokenLifetime == 0 {
+		conf.OidcTokenLifetime = 300
+	}
+
+	for id, c := range conf.OidcClients {
+		c := c
+		if c.Secret == "" {
+			return errors.Errorf("OIDC client %s has no secret", id)
+		}
+		if len(c.RedirectURIs) == 0 {
+			return errors.Errorf("OIDC client %s has no redirect_uris", id)
+		}
+		for _, uri := range c.RedirectURIs {
+			if u, err := url.Parse(uri); err != nil || !u.IsAbs() || u.Fragment != "" {
+				return errors.Errorf("OIDC client %s redirect URI %s is not an absolute URL without fragment", id, uri)
+			}
+		}
+
+		j, err := json.Marshal(c.Request)
+		if err != nil {
+			return errors.WrapPrefix(err, "failed to parse disclosure request of OIDC client "+id, 0)
+		}
+		rrequest, err := server.ParseSessionRequest(j)
+		if err != nil {
+			return errors.WrapPrefix(err, "failed to parse disclosure request of OIDC client "+id, 0)
+		}
+		if rrequest.SessionRequest().Action() != irma.ActionDisclosing {
+			return errors.Errorf("request of OIDC client %s must be a disclosure request", id)
+		}
+		requested := map[irma.AttributeTypeIdentifier]bool{}
+		_ = rrequest.SessionRequest().Disclosure().Disclose.Iterate(func(attr *irma.AttributeRequest) error {
+			requested[attr.Type] = true
+			return nil
+		})
+
+		client := &oidcClient{OidcClient: &c, request: j, claims: map[string]irma.AttributeTypeIdentifier{}}
+		for claim, attr := range c.Claims {
+			if contains(oidcReservedClaims, claim) {
+				return errors.Errorf("OIDC client %s: claim %s is reserved", id, claim)
+			}
+			attrid := irma.NewAttributeTypeIdentifier(attr)
+			if !requested[attrid] {
+				return errors.Errorf("OIDC client %s: attribute %s of claim %s is not in the disclosure request", id, attr, claim)
+			}
+			client.claims[claim] = attrid
+		}
+		conf.oidcClients[id] = client
+	}
+	return nil
+}
+
+func (s *Server) attachOidcEndpoints(router chi.Router) {
+	if len(s.config().oidcClients) == 0 {
+		return
+	}
+	router.Route("/oidc", func(r chi.Router) {
+		r.Get("/.well-known/openid-configuration", s.handleOidcDiscovery)
+		r.Get("/jwks", s.handleJwks)
+		r.With(s.clientRateLimit).Get("/authorize", s.handleOidcAuthorize)
+		r.Get("/login/{id}", s.handleOidcLoginPage)
+		r.Get("/login/{id}/session", s.handleOidcLoginSession)
+		r.Get("/login/{id}/finish", s.handleOidcLoginFinish)
+		r.Post("/token", s.handleOidcToken)
+		r.Get("/userinfo", s.handleOidcUserinfo)
+		r.Post("/userinfo", s.handleOidcUserinfo)
+	})
+}
+
+func (s *Server) handleOidcDiscovery(w http.ResponseWriter, r *http.Request) {
+	conf := s.config()
+	claims := []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce"}
+	for _, client := range conf.oidcClients {
+		for claim := range client.claims {
+			if !contains(claims, claim) {
+				claims = append(claims, claim)
+			}
+		}
+	}
+	sort.Strings(claims)
+	server.WriteJson(w, map[string]interface{}{
+		"issuer":                                conf.oidcIssuer,
+		"authorization_endpoint":                conf.oidcIssuer + "/authorize",
+		"token_endpoint":                        conf.oidcIssuer + "/token",
+		"userinfo_endpoint":                     conf.oidcIssuer + "/userinfo",
+		"jwks_uri":                              conf.oidcIssuer + "/jwks",
+		"scopes_supported":                      []string{"openid"},
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{conf.jwtSigningMethod.Alg()},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+		"claims_supported":                      claims,
+	})
+}
+
+func (s *Server) handleOidcAuthorize(w http.ResponseWriter, r *http.Request) {
+	conf := s.config()
+	query := r.URL.Query()
+	clientID, redirectURI, state := query.Get("client_id"), query.Get("redirect_uri"), query.Get("state")
+
+	// Errors concerning the client or redirect URI are shown to the user instead of being redirected
+	client := conf.oidcClients[clientID]
+	if client == nil || !contains(client.RedirectURIs, redirectURI) {
+		server.WriteError(w, server.ErrorInvalidRequest, "unknown client_id or redirect_uri")
+		return
+	}
+	if query.Get("response_type") != "code" {
+		oidcRedirect(w, r, redirectURI, url.Values{"error": {"unsupported_response_type"}, "state": {state}})
+		return
+	}
+	if !contains(strings.Fields(query.Get("scope")), "openid") {
+		oidcRedirect(w, r, redirectURI, url.Values{"error": {"invalid_scope"}, "state": {state}})
+		return
+	}
+
+	rrequest, err := server.ParseSessionRequest(client.request)
+	if err == nil {
+		var qr *irma.Qr
+		var token string
+		qr, token, err = s.irmaserv.StartSessionWithHandlers(rrequest, "oidc:"+clientID, s.sessionHandlers("oidc:"+clientID))
+		if err == nil {
+			id := s.oidc.put(s.oidc.logins, &oidcLogin{
+				clientID:     clientID,
+				redirectURI:  redirectURI,
+				state:        state,
+				nonce:        query.Get("nonce"),
+				sessionToken: token,
+				sessionPtr:   qr,
+				expires:      time.Now().Add(oidcLoginLifetime),
+			})
+			http.Redirect(w, r, conf.oidcIssuer+"/login/"+id, http.StatusFound)
+			return
+		}
+	}
+	conf.Logger.WithFields(logrus.Fields{"client": clientID}).Error("Failed to start session for OIDC login")
+	_ = server.LogError(err)
+	oidcRedirect(w, r, redirectURI, url.Values{"error": {"server_error"}, "state": {state}})
+}
+
+// oidcRedirect redirects the user agent to the redirect URI of the client with the specified parameters.
+func oidcRedirect(w http.ResponseWriter, r *http.Request, redirectURI string, params url.Values) {
+	if params.Get("state") == "" {
+		params.Del("state")
+	}
+	u, _ := url.Parse(redirectURI) // already checked when reading the configuration
+	query := u.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	u.RawQuery = query.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+var oidcLoginTemplate = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Log in with IRMA</title>
+</head>
+<body style="font-family: sans-serif; text-align: center">
+<h1>Log in with IRMA</h1>
+<p>Scan the QR code below with your IRMA app.</p>
+<img src="data:image/png;base64,{{.QR}}" alt="IRMA QR code" width="300" height="300">
+<script>
+(function poll() {
+	fetch("{{.ID}}/session").then(function (res) { return res.json(); }).then(function (session) {
+		if (["DONE", "CANCELLED", "TIMEOUT"].indexOf(session.status) >= 0) {
+			window.location = "{{.ID}}/finish";
+		} else {
+			setTimeout(poll, 1000);
+		}
+	}).catch(function () { setTimeout(poll, 1000); });
+})();
+</script>
+</body>
+</html>
+`))
+
+func (s *Server) handleOidcLoginPage(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	login := s.oidc.get(s.oidc.logins, id)
+	if login == nil {
+		server.WriteError(w, server.ErrorSessionUnknown, "")
+		return
+	}
+	png, err := server.QrPNG(login.sessionPtr, server.QrDefaultSize)
+	if err == nil {
+		var page bytes.Buffer
+		err = oidcLoginTemplate.Execute(&page, map[string]string{
+			"ID": id,
+			"QR": base64.StdEncoding.EncodeToString(png),
+		})
+		if err == nil {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write(page.Bytes())
+			return
+		}
+	}
+	_ = server.LogError(err)
+	server.WriteError(w, server.ErrorUnknown, err.Error())
+}
+
+// handleOidcLoginSession returns the session pointer and status of the IRMA session of the login.
+func (s *Server) handleOidcLoginSession(w http.ResponseWriter, r *http.Request) {
+	login := s.oidc.get(s.oidc.logins, chi.URLParam(r, "id"))
+	if login == nil {
+		server.WriteError(w, server.ErrorSessionUnknown, "")
+		return
+	}
+	res := s.irmaserv.GetSessionResult(login.sessionToken)
+	if res == nil {
+		server.WriteError(w, server.ErrorSessionUnknown, "")
+		return
+	}
+	server.WriteJson(w, struct {
+		SessionPtr *irma.Qr      `json:"sessionPtr"`
+		Status     server.Status `json:"status"`
+	}{login.sessionPtr, res.Status})
+}
+
+// handleOidcLoginFinish redirects the user agent back to the client after the IRMA session of
+// the login has finished, with an authorization code if the attributes were disclosed successfully.
+func (s *Server) handleOidcLoginFinish(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	login := s.oidc.get(s.oidc.logins, id)
+	if login == nil {
+		server.WriteError(w, server.ErrorSessionUnknown, "")
+		return
+	}
+	res := s.irmaserv.GetSessionResult(login.sessionToken)
+	if res != nil && !res.Status.Finished() {
+		http.Redirect(w, r, s.config().oidcIssuer+"/login/"+id, http.StatusFound)
+		return
+	}
+	if login = s.oidc.take(s.oidc.logins, id); login == nil {
+		server.WriteError(w, server.ErrorSessionUnknown, "")
+		return
+	}
+	if res == nil || res.Status != server.StatusDone || res.ProofStatus != irma.ProofStatusValid {
+		oidcRedirect(w, r, login.redirectURI, url.Values{"error": {"access_denied"}, "state": {login.state}})
+		return
+	}
+
+	client := s.config().oidcClients[login.clientID]
+	if client == nil { // removed by a configuration reload
+		oidcRedirect(w, r, login.redirectURI, url.Values{"error": {"access_denied"}, "state": {login.state}})
+		return
+	}
+	disclosed := map[irma.AttributeTypeIdentifier]string{}
+	for _, set := range res.Disclosed {
+		for _, attr := range set {
+			if attr.RawValue != nil {
+				disclosed[attr.Identifier] = *attr.RawValue
+			}
+		}
+	}
+	login.claims = map[string]string{}
+	for claim, attr := range client.claims {
+		if value, ok := disclosed[attr]; ok {
+			login.claims[claim] = value
+		}
+	}
+	if login.claims["sub"] == "" {
+		login.claims["sub"] = oidcRandom()
+	}
+	login.authTime = time.Now().Unix()
+	login.expires = time.Now().Add(oidcCodeLifetime)
+
+	code := s.oidc.put(s.oidc.codes, login)
+	oidcRedirect(w, r, login.redirectURI, url.Values{"code": {code}, "state": {login.state}})
+}
+
+// oidcError writes an OAuth 2.0 error response (RFC 6749 section 5.2).
+func oidcError(w http.ResponseWriter, status int, typ, description string) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Basic")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	bts, _ := json.Marshal(map[string]string{"error": typ, "error_description": description})
+	_, _ = w.Write(bts)
+}
+
+func (s *Server) handleOidcToken(w http.ResponseWriter, r *http.Request) {
+	conf := s.config()
+	if err := r.ParseForm(); err != nil {
+		oidcError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	// Authenticate the client using client_secret_basic or client_secret_post
+	clientID, secret, ok := r.BasicAuth()
+	if ok {
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	client := conf.oidcClients[clientID]
+	if client == nil || subtle.ConstantTimeCompare([]byte(client.Secret), []byte(secret)) != 1 {
+		oidcError(w, http.StatusUnauthorized, "invalid_client", "")
+		return
+	}
+
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		oidcError(w, http.StatusBadRequest, "unsupported_grant_type", "")
+		return
+	}
+	login := s.oidc.take(s.oidc.codes, r.PostForm.Get("code"))
+	if login == nil || login.clientID != clientID || login.redirectURI != r.PostForm.Get("redirect_uri") {
+		oidcError(w, http.StatusBadRequest, "invalid_grant", "")
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":       conf.oidcIssuer,
+		"aud":       clientID,
+		"iat":       now.Unix(),
+		"exp":       now.Unix() + int64(conf.OidcTokenLifetime),
+		"auth_time": login.authTime,
+	}
+	if login.nonce != "" {
+		claims["nonce"] = login.nonce
+	}
+	for claim, value := range login.claims {
+		claims[claim] = value
+	}
+	idToken, err := conf.signJwt(claims)
+	if err != nil {
+		_ = server.LogError(errors.WrapPrefix(err, "Failed to sign OIDC ID token", 0))
+		oidcError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	login.expires = now.Add(time.Duration(conf.OidcTokenLifetime) * time.Second)
+	accessToken := s.oidc.put(s.oidc.tokens, login)
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	server.WriteJson(w, map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   conf.OidcTokenLifetime,
+		"id_token":     idToken,
+	})
+}
+
+func (s *Server) handleOidcUserinfo(w http.ResponseWriter, r *http.Request) {
+	var login *oidcLogin
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		login = s.oidc.get(s.oidc.tokens, strings.TrimPrefix(auth, "Bearer "))
+	}
+	if login == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	server.WriteJson(w, login.claims)
+}
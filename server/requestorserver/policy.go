@@ -0,0 +1,110 @@
+package requestorserver
+
+import (
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+)
+
+// IssuancePolicy restricts the credentials a requestor may issue, beyond the credential types
+// allowed by its issue_perms.
+type IssuancePolicy struct {
+	// Maximum validity of issued credentials in days from now (default value 0 means unlimited)
+	MaxValidityDays int `json:"max_validity_days" mapstructure:"max_validity_days"`
+	// Key counters that issuance requests may specify (if empty, any key counter is allowed)
+	KeyCounters []int `json:"key_counters" mapstructure:"key_counters"`
+	// Regular expressions that the values of attributes must match entirely, per attribute type
+	// (e.g. "irma-demo.MijnOverheid.fullName.firstname")
+	Attributes map[string]string `json:"attributes" mapstructure:"attributes"`
+	// Maximum number of credentials per issuance session (default value 0 means unlimited)
+	MaxCredentials int `json:"max_credentials" mapstructure:"max_credentials"`
+}
+
+// issuancePolicy is a parsed IssuancePolicy.
+type issuancePolicy struct {
+	*IssuancePolicy
+	attributes map[irma.AttributeTypeIdentifier]*regexp.Regexp
+}
+
+// readIssuancePolicies parses the issuance policies of the requestors.
+func (conf *Configuration) readIssuancePolicies() error {
+	conf.issuancePolicies = map[string]*issuancePolicy{}
+	for name, requestor := range conf.Requestors {
+		if requestor.IssuancePolicy == nil {
+			continue
+		}
+		p := requestor.IssuancePolicy
+		if p.MaxValidityDays < 0 || p.MaxCredentials < 0 {
+			return errors.Errorf("Requestor %s issuance policy: max_validity_days and max_credentials must not be negative", name)
+		}
+		policy := &issuancePolicy{IssuancePolicy: p, attributes: map[irma.AttributeTypeIdentifier]*regexp.Regexp{}}
+		for attr, pattern := range p.Attributes {
+			id := irma.NewAttributeTypeIdentifier(attr)
+			if conf.IrmaConfiguration.AttributeTypes[id] == nil {
+				return errors.Errorf("Requestor %s issuance policy attribute %s: unknown attribute type", name, attr)
+			}
+			re, err := regexp.Compile("^(?:" + pattern + ")$")
+			if err != nil {
+				return errors.WrapPrefix(err, "Requestor "+name+" issuance policy attribute "+attr, 0)
+			}
+			policy.attributes[id] = re
+		}
+		conf.issuancePolicies[name] = policy
+	}
+	return nil
+}
+
+// CheckIssuancePolicy checks that the issuance request conforms to the issuance policy of the
+// specified requestor, if any. The returned error specifies the offending field of the request.
+func (conf *Configuration) CheckIssuancePolicy(requestor string, request *irma.IssuanceRequest) error {
+	policy := conf.issuancePolicies[requestor]
+	if policy == nil {
+		return nil
+	}
+	if policy.MaxCredentials != 0 && len(request.Credentials) > policy.MaxCredentials {
+		return errors.Errorf("credentials: at most %d credentials may be issued per session", policy.MaxCredentials)
+	}
+
+	var maxValidity irma.Timestamp
+	if policy.MaxValidityDays != 0 {
+		maxValidity = irma.Timestamp(time.Now().AddDate(0, 0, policy.MaxValidityDays))
+	}
+	for i, cred := range request.Credentials {
+		if policy.MaxValidityDays != 0 {
+			if cred.Validity == nil {
+				return errors.Errorf("credentials[%d].validity: required, at most %d days", i, policy.MaxValidityDays)
+			}
+			if maxValidity.Before(*cred.Validity) {
+				return errors.Errorf("credentials[%d].validity: exceeds maximum of %d days", i, policy.MaxValidityDays)
+			}
+		}
+		if len(policy.KeyCounters) != 0 && !containsInt(policy.KeyCounters, cred.KeyCounter) {
+			return errors.Errorf("credentials[%d].keyCounter: key counter %d not allowed", i, cred.KeyCounter)
+		}
+
+		names := make([]string, 0, len(cred.Attributes))
+		for name := range cred.Attributes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			id := irma.NewAttributeTypeIdentifier(cred.CredentialTypeID.String() + "." + name)
+			if re := policy.attributes[id]; re != nil && !re.MatchString(cred.Attributes[name]) {
+				return errors.Errorf("credentials[%d].attributes.%s: value not allowed", i, name)
+			}
+		}
+	}
+	return nil
+}
+
+func containsInt(ints []int, query int) bool {
+	for _, i := range ints {
+		if i == query {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package requestorserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckIssuancePolicy(t *testing.T) {
+	municipality := irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.address.city")
+	conf := &Configuration{
+		Configuration: &server.Configuration{IrmaConfiguration: &irma.Configuration{
+			AttributeTypes: map[irma.AttributeTypeIdentifier]*irma.AttributeType{municipality: {}},
+		}},
+		Requestors: map[string]Requestor{
+			"municipality": {IssuancePolicy: &IssuancePolicy{
+				MaxValidityDays: 30,
+				KeyCounters:     []int{0, 2},
+				Attributes:      map[string]string{municipality.String(): "Nijmegen|Arnhem"},
+				MaxCredentials:  1,
+			}},
+		},
+	}
+	require.NoError(t, conf.readIssuancePolicies())
+
+	validity := func(days int) *irma.Timestamp {
+		ts := irma.Timestamp(time.Now().AddDate(0, 0, days))
+		return &ts
+	}
+	newRequest := func(modify func(cred *irma.CredentialRequest)) *irma.IssuanceRequest {
+		cred := &irma.CredentialRequest{
+			Validity:         validity(10),
+			CredentialTypeID: municipality.CredentialTypeIdentifier(),
+			Attributes:       map[string]string{"street": "Toernooiveld", "city": "Nijmegen"},
+		}
+		if modify != nil {
+			modify(cred)
+		}
+		return irma.NewIssuanceRequest([]*irma.CredentialRequest{cred})
+	}
+
+	require.NoError(t, conf.CheckIssuancePolicy("municipality", newRequest(nil)))
+	require.NoError(t, conf.CheckIssuancePolicy("other", newRequest(func(cred *irma.CredentialRequest) { cred.Validity = nil })))
+
+	for field, modify := range map[string]func(cred *irma.CredentialRequest){
+		"credentials[0].validity":        func(cred *irma.CredentialRequest) { cred.Validity = validity(31) },
+		"credentials[0].keyCounter":      func(cred *irma.CredentialRequest) { cred.KeyCounter = 1 },
+		"credentials[0].attributes.city": func(cred *irma.CredentialRequest) { cred.Attributes["city"] = "Nijmegen2" },
+	} {
+		err := conf.CheckIssuancePolicy("municipality", newRequest(modify))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), field)
+	}
+
+	request := newRequest(nil)
+	request.Credentials = append(request.Credentials, request.Credentials[0])
+	err := conf.CheckIssuancePolicy("municipality", request)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "credentials:")
+}
@@ -0,0 +1,132 @@
+package requestorserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/fs"
+	"github.com/privacybydesign/irmago/server"
+)
+
+// pseudonymizer replaces the values of disclosed attributes by pseudonyms specific to a requestor.
+type pseudonymizer struct {
+	key        []byte
+	attributes map[irma.AttributeTypeIdentifier]struct{}
+}
+
+// readPseudonymizers parses the pseudonymous attributes and pseudonym keys of the requestors.
+func (conf *Configuration) readPseudonymizers() error {
+	conf.pseudonymizers = map[string]*pseudonymizer{}
+	for name, requestor := range conf.Requestors {
+		if len(requestor.PseudonymousAttributes) == 0 {
+			if requestor.PseudonymKey != "" || requestor.PseudonymKeyFile != "" {
+				return errors.Errorf("Requestor %s has a pseudonym_key but no pseudonymous_attributes", name)
+			}
+			continue
+		}
+		bts, err := fs.ReadKey(requestor.PseudonymKey, requestor.PseudonymKeyFile)
+		if err == nil {
+			bts, err = fs.Base64Decode(bts)
+		}
+		if err != nil {
+			return errors.WrapPrefix(err, "failed to read pseudonym key of requestor "+name, 0)
+		}
+		if len(bts) < 32 {
+			return errors.Errorf("pseudonym key of requestor %s must be at least 32 bytes", name)
+		}
+		p := &pseudonymizer{key: bts, attributes: map[irma.AttributeTypeIdentifier]struct{}{}}
+		for _, attr := range requestor.PseudonymousAttributes {
+			id := irma.NewAttributeTypeIdentifier(attr)
+			if conf.IrmaConfiguration.AttributeTypes[id] == nil {
+				return errors.Errorf("Requestor %s pseudonymous attribute %s: unknown attribute type", name, attr)
+			}
+			p.attributes[id] = struct{}{}
+		}
+		conf.pseudonymizers[name] = p
+	}
+	return nil
+}
+
+// checkPseudonymous checks that the session request does not reveal the values of the
+// pseudonymous attributes of the requestor: signature sessions would contain them in the attribute-
+// based signature, and requested attribute values allow the requestor to confirm a guessed value.
+func (conf *Configuration) checkPseudonymous(requestor string, action irma.Action, condiscon irma.AttributeConDisCon) error {
+	p := conf.pseudonymizers[requestor]
+	if p == nil {
+		return nil
+	}
+	for _, discon := range condiscon {
+		for _, con := range discon {
+			for _, attr := range con {
+				if _, ok := p.attributes[attr.Type]; !ok {
+					continue
+				}
+				if action == irma.ActionSigning {
+					return errors.Errorf("pseudonymous attribute %s cannot be used in signature sessions", attr.Type)
+				}
+				if attr.Value != nil {
+					return errors.Errorf("pseudonymous attribute %s cannot be requested with a specific value", attr.Type)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// pseudonymize returns a copy of the session result in which the values of the pseudonymous
+// attributes of the specified requestor have been replaced by their pseudonyms. If the requestor
+// has no pseudonymous attributes, the result is returned as is.
+func (conf *Configuration) pseudonymize(requestor string, result *server.SessionResult) *server.SessionResult {
+	p := conf.pseudonymizers[requestor]
+	if p == nil || result == nil || len(result.Disclosed) == 0 {
+		return result
+	}
+
+	res := *result
+	res.Disclosed = make([][]*irma.DisclosedAttribute, len(result.Disclosed))
+	for i, set := range result.Disclosed {
+		res.Disclosed[i] = make([]*irma.DisclosedAttribute, len(set))
+		for j, attr := range set {
+			res.Disclosed[i][j] = attr
+			if _, ok := p.attributes[attr.Identifier]; !ok || attr.RawValue == nil {
+				continue
+			}
+			pseudonym := p.pseudonym(attr.Identifier, *attr.RawValue)
+			value := make(irma.TranslatedString, len(attr.Value))
+			for lang := range attr.Value {
+				value[lang] = pseudonym
+			}
+			copied := *attr
+			copied.RawValue, copied.Value = &pseudonym, value
+			res.Disclosed[i][j] = &copied
+		}
+	}
+	return &res
+}
+
+// pseudonym computes the hex encoded HMAC-SHA256 over the attribute type identifier and value,
+// which is stable across sessions of the requestor but unlinkable across requestors.
+func (p *pseudonymizer) pseudonym(id irma.AttributeTypeIdentifier, value string) string {
+	mac := hmac.New(sha256.New, p.key)
+	_, _ = mac.Write([]byte(id.String()))
+	_, _ = mac.Write([]byte{0})
+	_, _ = mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sessionResult returns the result of the specified session as the requestor of the session
+// may see it, i.e. with its pseudonymous attributes replaced by pseudonyms.
+func (s *Server) sessionResult(token string) *server.SessionResult {
+	res := s.irmaserv.GetSessionResult(token)
+	if res == nil {
+		return nil
+	}
+	info := s.irmaserv.SessionInfo(token)
+	if info == nil {
+		return res
+	}
+	return s.config().pseudonymize(info.Requestor, res)
+}
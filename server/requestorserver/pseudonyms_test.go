@@ -0,0 +1,58 @@
+package requestorserver
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPseudonymize(t *testing.T) {
+	bsn := irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN")
+	studentID := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	newConf := func(key string) *Configuration {
+		conf := &Configuration{
+			Configuration: &server.Configuration{IrmaConfiguration: &irma.Configuration{
+				AttributeTypes: map[irma.AttributeTypeIdentifier]*irma.AttributeType{bsn: {}, studentID: {}},
+			}},
+			Requestors: map[string]Requestor{
+				"requestor": {PseudonymousAttributes: []string{bsn.String()}, PseudonymKey: key},
+			},
+		}
+		require.NoError(t, conf.readPseudonymizers())
+		return conf
+	}
+	key1 := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	key2 := base64.StdEncoding.EncodeToString(append(make([]byte, 31), 1))
+	conf1, conf2 := newConf(key1), newConf(key2)
+
+	value, studentValue := "123456789", "456"
+	result := &server.SessionResult{Disclosed: [][]*irma.DisclosedAttribute{{
+		{Identifier: bsn, RawValue: &value, Value: irma.TranslatedString{"": value, "en": value}},
+		{Identifier: studentID, RawValue: &studentValue, Value: irma.TranslatedString{"": studentValue}},
+	}}}
+
+	res := conf1.pseudonymize("requestor", result)
+	pseudonym := *res.Disclosed[0][0].RawValue
+	require.NotEqual(t, value, pseudonym)
+	require.Equal(t, irma.TranslatedString{"": pseudonym, "en": pseudonym}, res.Disclosed[0][0].Value)
+	require.Equal(t, studentValue, *res.Disclosed[0][1].RawValue)
+
+	// The original result is not modified
+	require.Equal(t, value, *result.Disclosed[0][0].RawValue)
+
+	// Pseudonyms are stable, differ per requestor key, and are not applied to other requestors
+	require.Equal(t, pseudonym, *conf1.pseudonymize("requestor", result).Disclosed[0][0].RawValue)
+	require.NotEqual(t, pseudonym, *conf2.pseudonymize("requestor", result).Disclosed[0][0].RawValue)
+	require.Equal(t, value, *conf1.pseudonymize("other", result).Disclosed[0][0].RawValue)
+
+	// Pseudonymous attributes can't be used in signature sessions or with a requested value
+	condiscon := irma.AttributeConDisCon{{{{Type: bsn}}}}
+	require.NoError(t, conf1.checkPseudonymous("requestor", irma.ActionDisclosing, condiscon))
+	require.Error(t, conf1.checkPseudonymous("requestor", irma.ActionSigning, condiscon))
+	condiscon[0][0][0].Value = &value
+	require.Error(t, conf1.checkPseudonymous("requestor", irma.ActionDisclosing, condiscon))
+	require.NoError(t, conf1.checkPseudonymous("other", irma.ActionDisclosing, condiscon))
+}
@@ -0,0 +1,234 @@
+package requestorserver
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/metrics"
+	"github.com/privacybydesign/irmago/server"
+)
+
+// concurrentSessionsRetryAfter is the Retry-After returned to requestors that have reached their
+// maximum number of concurrent sessions. As we cannot know when their sessions will finish, we
+// just let them try again after a while.
+const concurrentSessionsRetryAfter = 10 * time.Second
+
+var metricRateLimited = metrics.NewCounterVec("irma_rate_limited_total",
+	"Number of requests that were refused because a rate limit or quota was exceeded.", "limit")
+
+// rateWindows counts events per key in fixed time windows of the specified period.
+// It is not safe for concurrent use.
+type rateWindows struct {
+	period    time.Duration
+	windows   map[string]*rateWindow
+	lastPurge time.Time
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+func newRateWindows(period time.Duration) *rateWindows {
+	return &rateWindows{period: period, windows: map[string]*rateWindow{}, lastPurge: time.Now()}
+}
+
+// retryAfter returns how long to wait until n more events for the key fit within the limit, or 0
+// if they fit already. A nonpositive limit means unlimited.
+func (rw *rateWindows) retryAfter(key string, n, limit int, now time.Time) time.Duration {
+	if limit <= 0 {
+		return 0
+	}
+	w := rw.window(key, now)
+	if w.count+n <= limit {
+		return 0
+	}
+	return w.start.Add(rw.period).Sub(now)
+}
+
+// add records n events for the key.
+func (rw *rateWindows) add(key string, n int, now time.Time) {
+	rw.window(key, now).count += n
+}
+
+// remove forgets n events for the key that were recorded at the specified time, if that was
+// within the current window.
+func (rw *rateWindows) remove(key string, n int, at, now time.Time) {
+	if w := rw.windows[key]; w != nil && !at.Before(w.start) && now.Sub(w.start) < rw.period {
+		if w.count -= n; w.count < 0 {
+			w.count = 0
+		}
+	}
+}
+
+func (rw *rateWindows) window(key string, now time.Time) *rateWindow {
+	// Forget expired windows every now and then, so that we don't keep them forever
+	if now.Sub(rw.lastPurge) > rw.period {
+		for k, w := range rw.windows {
+			if now.Sub(w.start) >= rw.period {
+				delete(rw.windows, k)
+			}
+		}
+		rw.lastPurge = now
+	}
+
+	w := rw.windows[key]
+	if w == nil || now.Sub(w.start) >= rw.period {
+		w = &rateWindow{start: now}
+		rw.windows[key] = w
+	}
+	return w
+}
+
+// rateLimiter enforces the rate limits and quotas of requestors, and the rate limit of clients
+// per IP address.
+type rateLimiter struct {
+	sync.Mutex
+	sessions *rateWindows   // Key: requestor, counts started sessions per minute
+	issuance *rateWindows   // Key: requestor, counts credentials of issuance sessions per day
+	clients  *rateWindows   // Key: IP address, counts requests per minute
+	starting map[string]int // Key: requestor, counts sessions that are being started
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		sessions: newRateWindows(time.Minute),
+		issuance: newRateWindows(24 * time.Hour),
+		clients:  newRateWindows(time.Minute),
+		starting: map[string]int{},
+	}
+}
+
+// reservation is what requestorLimit() counted against the limits of a requestor for a session.
+type reservation struct {
+	requestor   string
+	credentials int
+	time        time.Time
+	starting    bool // whether the session is counted in rateLimiter.starting
+}
+
+// requestorLimit checks if the requestor may start the specified session, and if so, reserves
+// it against the requestor's session rate limit, and its credentials against the requestor's
+// issuance quota. Otherwise it returns the name of the exceeded limit and how long the requestor
+// should wait before trying again.
+//
+// If starting is true, the session also needs a slot among the requestor's maximum number of
+// concurrent sessions, which it holds until startedSession() is called once it has been started.
+// Follow-up sessions are checked with starting false, as they take over the slot of the session
+// they follow. The credentials are refunded if the session fails to start (see
+// refundRequestorLimit()) or finishes without being done (see refundIssuance()).
+func (s *Server) requestorLimit(requestor string, request irma.SessionRequest, starting bool) (*reservation, string, time.Duration) {
+	r := s.config().Requestors[requestor]
+	res := &reservation{requestor: requestor, time: time.Now(), starting: starting}
+	if request.Action() == irma.ActionIssuing {
+		res.credentials = len(request.(*irma.IssuanceRequest).Credentials)
+	}
+
+	s.limiter.Lock()
+	defer s.limiter.Unlock()
+	// Sessions that are being started are not yet counted among the unfinished sessions
+	if starting && r.MaxConcurrentSessions > 0 &&
+		s.irmaserv.UnfinishedSessions(requestor)+s.limiter.starting[requestor] >= r.MaxConcurrentSessions {
+		return nil, "max_concurrent_sessions", concurrentSessionsRetryAfter
+	}
+	if d := s.limiter.sessions.retryAfter(requestor, 1, r.MaxSessionsPerMinute, res.time); d > 0 {
+		return nil, "max_sessions_per_minute", d
+	}
+	if res.credentials > 0 {
+		if d := s.limiter.issuance.retryAfter(requestor, res.credentials, r.MaxIssuancePerDay, res.time); d > 0 {
+			return nil, "max_issuance_per_day", d
+		}
+	}
+
+	s.limiter.sessions.add(requestor, 1, res.time)
+	s.limiter.issuance.add(requestor, res.credentials, res.time)
+	if starting {
+		s.limiter.starting[requestor]++
+	}
+	return res, "", 0
+}
+
+// startedSession releases the concurrent session slot of the reservation, now that the session
+// has been started and is counted among the unfinished sessions of the requestor.
+func (s *Server) startedSession(res *reservation) {
+	s.limiter.Lock()
+	defer s.limiter.Unlock()
+	s.limiter.release(res)
+}
+
+// refundRequestorLimit undoes requestorLimit() for a session that failed to start.
+func (s *Server) refundRequestorLimit(res *reservation) {
+	s.limiter.Lock()
+	defer s.limiter.Unlock()
+	s.limiter.release(res)
+	now := time.Now()
+	s.limiter.sessions.remove(res.requestor, 1, res.time, now)
+	s.limiter.issuance.remove(res.requestor, res.credentials, res.time, now)
+}
+
+// release releases the concurrent session slot of the reservation. The caller must hold the lock.
+func (l *rateLimiter) release(res *reservation) {
+	if !res.starting {
+		return
+	}
+	res.starting = false
+	if l.starting[res.requestor]--; l.starting[res.requestor] <= 0 {
+		delete(l.starting, res.requestor)
+	}
+}
+
+// refundIssuance refunds the credentials of an issuance session that has finished without
+// being done (i.e. it was cancelled or timed out) to the issuance quota of the requestor.
+func (s *Server) refundIssuance(requestor string, result *server.SessionResult) {
+	if result.Type != irma.ActionIssuing || result.Status == server.StatusDone {
+		return
+	}
+	info := s.irmaserv.SessionInfo(result.Token)
+	if info == nil {
+		return
+	}
+	request, ok := s.irmaserv.GetRequest(result.Token).SessionRequest().(*irma.IssuanceRequest)
+	if !ok {
+		return
+	}
+	s.limiter.Lock()
+	defer s.limiter.Unlock()
+	s.limiter.issuance.remove(requestor, len(request.Credentials), info.Created, time.Now())
+}
+
+// clientRateLimit is middleware that limits the number of requests per minute from each IP address.
+func (s *Server) clientRateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conf := s.config()
+		if conf.ClientRateLimit > 0 {
+			ip, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				ip = r.RemoteAddr
+			}
+			s.limiter.Lock()
+			now := time.Now()
+			d := s.limiter.clients.retryAfter(ip, 1, conf.ClientRateLimit, now)
+			if d == 0 {
+				s.limiter.clients.add(ip, 1, now)
+			}
+			s.limiter.Unlock()
+			if d > 0 {
+				conf.Logger.WithField("ip", ip).Debug("Client exceeded rate limit")
+				writeRateLimitError(w, "client_rate_limit", d)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeRateLimitError(w http.ResponseWriter, limit string, retryAfter time.Duration) {
+	metricRateLimited.Inc(limit)
+	w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(retryAfter.Seconds()))))
+	server.WriteError(w, server.ErrorRateLimited, limit)
+}
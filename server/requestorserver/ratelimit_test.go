@@ -0,0 +1,34 @@
+package requestorserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateWindows(t *testing.T) {
+	rw := newRateWindows(time.Minute)
+	now := time.Now()
+
+	require.Zero(t, rw.retryAfter("a", 2, 3, now))
+	rw.add("a", 2, now)
+	require.Zero(t, rw.retryAfter("a", 1, 3, now))
+	require.Equal(t, 30*time.Second, rw.retryAfter("a", 2, 3, now.Add(30*time.Second)))
+	require.Zero(t, rw.retryAfter("b", 3, 3, now), "keys should be counted separately")
+	require.Zero(t, rw.retryAfter("a", 100, 0, now), "limit 0 should mean unlimited")
+
+	// Removed events no longer count, but only if they were recorded within the current window
+	rw.remove("a", 1, now, now)
+	require.Zero(t, rw.retryAfter("a", 2, 3, now))
+	rw.remove("a", 5, now, now.Add(time.Minute))
+	rw.remove("a", 5, now.Add(-time.Second), now)
+	require.Equal(t, 1, rw.windows["a"].count)
+
+	// After the window has passed, the count starts anew
+	require.Zero(t, rw.retryAfter("a", 3, 3, now.Add(time.Minute)))
+
+	// Expired windows are purged
+	rw.window("c", now.Add(3*time.Minute))
+	require.NotContains(t, rw.windows, "b")
+}
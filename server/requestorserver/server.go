@@ -14,7 +14,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
@@ -23,6 +25,7 @@ import (
 	"github.com/go-chi/cors"
 	"github.com/go-errors/errors"
 	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/metrics"
 	"github.com/privacybydesign/irmago/server"
 	"github.com/privacybydesign/irmago/server/irmaserver"
 	"github.com/sirupsen/logrus"
@@ -30,22 +33,31 @@ import (
 
 // Server is a requestor server instance.
 type Server struct {
-	conf     *Configuration
-	irmaserv *irmaserver.Server
-	stop     chan struct{}
-	stopped  chan struct{}
+	conf      *Configuration
+	confLock  sync.RWMutex
+	irmaserv  *irmaserver.Server
+	callbacks *callbackOutbox
+	limiter   *rateLimiter
+	oidc      *oidcProvider
+	stop      chan struct{}
+	stopped   chan struct{}
+
+	tenant  string             // name of the tenant of this server, empty for the default tenant
+	parent  *Server            // for tenants: the server of the default tenant
+	tenants map[string]*Server // Key: tenant name
 }
 
 // Start the server. If successful then it will not return until Stop() is called.
 func (s *Server) Start(config *Configuration) error {
-	if s.conf.LogJSON {
-		s.conf.Logger.WithField("configuration", s.conf).Debug("Configuration")
+	conf := s.config()
+	if conf.LogJSON {
+		conf.Logger.WithField("configuration", conf).Debug("Configuration")
 	} else {
-		bts, _ := json.MarshalIndent(s.conf, "", "   ")
-		s.conf.Logger.Debug("Configuration: ", string(bts), "\n")
+		bts, _ := json.MarshalIndent(conf, "", "   ")
+		conf.Logger.Debug("Configuration: ", string(bts), "\n")
 	}
 
-	// We start either one or two servers, depending on whether a separate client server is enabled, such that:
+	// We start one to four servers, depending on whether a separate client server, an admin server and a metrics server are enabled, such that:
 	// - if any of them returns, the other is also stopped (neither of them is of use without the other)
 	// - if any of them returns an unexpected error (ie. other than http.ErrServerClosed), the error is logged and returned
 	// - we have a way of stopping all servers from outside (with Stop())
@@ -53,22 +65,25 @@ func (s *Server) Start(config *Configuration) error {
 	// - any unexpected error is dealt with here instead of when stopping using Stop().
 	// Inspired by https://dave.cheney.net/practical-go/presentations/qcon-china.html#_never_start_a_goroutine_without_when_it_will_stop
 
-	count := 1
-	if s.conf.separateClientServer() {
-		count = 2
+	servers := []func() error{s.startRequestorServer}
+	if conf.separateClientServer() {
+		servers = append(servers, s.startClientServer)
 	}
-	done := make(chan error, count)
+	if conf.AdminPort != 0 {
+		servers = append(servers, s.startAdminServer)
+	}
+	if conf.MetricsPort != 0 {
+		servers = append(servers, s.startMetricsServer)
+	}
+	done := make(chan error, len(servers))
 	s.stop = make(chan struct{})
-	s.stopped = make(chan struct{}, count)
+	s.stopped = make(chan struct{}, len(servers))
 
-	if s.conf.separateClientServer() {
-		go func() {
-			done <- s.startClientServer()
-		}()
+	for _, start := range servers {
+		go func(start func() error) {
+			done <- start()
+		}(start)
 	}
-	go func() {
-		done <- s.startRequestorServer()
-	}()
 
 	var stopped bool
 	var err error
@@ -86,18 +101,66 @@ func (s *Server) Start(config *Configuration) error {
 }
 
 func (s *Server) startRequestorServer() error {
-	tlsConf, _ := s.conf.tlsConfig()
-	return s.startServer(s.Handler(), "Server", s.conf.ListenAddress, s.conf.Port, tlsConf)
+	conf := s.config()
+	tlsConf, _ := conf.tlsConfig()
+	if tlsConf != nil {
+		// Fetch the certificate from the current configuration, so that it can be reloaded
+		tlsConf.Certificates = nil
+		tlsConf.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return s.config().tlsCertificate, nil
+		}
+		// Likewise for the CAs against which client certificates are verified
+		base := tlsConf.Clone()
+		tlsConf.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c := base.Clone()
+			if c.ClientCAs = s.config().tlsClientCAs; c.ClientCAs != nil {
+				c.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+			return c, nil
+		}
+	}
+	return s.startServer(s.Handler(), "Server", conf.ListenAddress, conf.Port, tlsConf)
 }
 
 func (s *Server) startClientServer() error {
-	tlsConf, _ := s.conf.clientTlsConfig()
-	return s.startServer(s.ClientHandler(), "Client server", s.conf.ClientListenAddress, s.conf.ClientPort, tlsConf)
+	conf := s.config()
+	tlsConf, _ := conf.clientTlsConfig()
+	if tlsConf != nil {
+		tlsConf.Certificates = nil
+		tlsConf.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return s.config().clientTlsCertificate, nil
+		}
+	}
+	return s.startServer(s.ClientHandler(), "Client server", conf.ClientListenAddress, conf.ClientPort, tlsConf)
+}
+
+func (s *Server) startAdminServer() error {
+	conf := s.config()
+	tlsConf, _ := conf.tlsConfig()
+	if tlsConf != nil {
+		tlsConf.Certificates = nil
+		tlsConf.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return s.config().tlsCertificate, nil
+		}
+	}
+	return s.startServer(s.AdminHandler(), "Admin server", conf.AdminListenAddress, conf.AdminPort, tlsConf)
+}
+
+func (s *Server) startMetricsServer() error {
+	conf := s.config()
+	tlsConf, _ := conf.tlsConfig()
+	if tlsConf != nil {
+		tlsConf.Certificates = nil
+		tlsConf.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return s.config().tlsCertificate, nil
+		}
+	}
+	return s.startServer(s.MetricsHandler(), "Metrics server", conf.MetricsListenAddress, conf.MetricsPort, tlsConf)
 }
 
 func (s *Server) startServer(handler http.Handler, name, addr string, port int, tlsConf *tls.Config) error {
 	fulladdr := fmt.Sprintf("%s:%d", addr, port)
-	s.conf.Logger.Info(name, " listening at ", fulladdr)
+	s.config().Logger.Info(name, " listening at ", fulladdr)
 
 	serv := &http.Server{
 		Addr:      fulladdr,
@@ -118,7 +181,7 @@ func (s *Server) startServer(handler http.Handler, name, addr string, port int,
 	if tlsConf != nil {
 		// Disable HTTP/2 (see package documentation of http): it breaks server side events :(
 		serv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
-		s.conf.Logger.Info(name, " TLS enabled")
+		s.config().Logger.Info(name, " TLS enabled")
 		return filterStopError(serv.ListenAndServeTLS("", ""))
 	} else {
 		return filterStopError(serv.ListenAndServe())
@@ -134,13 +197,91 @@ func filterStopError(err error) error {
 
 func (s *Server) Stop() {
 	s.irmaserv.Stop()
+	s.callbacks.close()
 	s.stop <- struct{}{}
-	<-s.stopped
-	if s.conf.separateClientServer() {
+	for i := 0; i < cap(s.stopped); i++ {
 		<-s.stopped
 	}
 }
 
+// Drain gracefully stops the server: new sessions are refused while running sessions may finish,
+// after which pending result callbacks are sent. Once that is done, or when drain_timeout has passed,
+// the server is stopped.
+func (s *Server) Drain() {
+	conf := s.config()
+	conf.Logger.Info("Draining server")
+	deadline := time.Now().Add(time.Duration(conf.DrainTimeout) * time.Second)
+	s.irmaserv.Drain(deadline)
+	s.callbacks.flush(deadline)
+	s.Stop()
+}
+
+// Reload replaces the configuration of the server with the specified configuration while
+// running sessions continue. Only the requestor server settings are reloaded (i.e. requestors,
+// permissions, keys and TLS certificates); the embedded server.Configuration of the running
+// server is kept, as are the addresses and ports at which the server listens.
+func (s *Server) Reload(config *Configuration) error {
+	current := s.config()
+	if config.Configuration != nil && serverConfigurationChanged(config.Configuration, current.Configuration) {
+		current.Logger.Warn("Changes to url or privkeys require a restart")
+	}
+	config.Configuration = current.Configuration
+	config.jwtReplayCache = current.jwtReplayCache
+	config.tenants = current.tenants // from which the tenants keep their JWT replay caches
+	if err := config.initialize(); err != nil {
+		return err
+	}
+	if config.ListenAddress != current.ListenAddress || config.Port != current.Port ||
+		config.ClientListenAddress != current.ClientListenAddress || config.ClientPort != current.ClientPort ||
+		config.AdminListenAddress != current.AdminListenAddress || config.AdminPort != current.AdminPort ||
+		config.MetricsListenAddress != current.MetricsListenAddress || config.MetricsPort != current.MetricsPort ||
+		(config.tlsCertificate == nil) != (current.tlsCertificate == nil) ||
+		(config.clientTlsCertificate == nil) != (current.clientTlsCertificate == nil) {
+		config.Logger.Warn("Changes to listen addresses, ports or enabling or disabling TLS require a restart")
+	}
+	if config.CallbackOutboxPath != current.CallbackOutboxPath {
+		config.Logger.Warn("Changes to callback_outbox_path require a restart")
+	}
+	// As for the default tenant, keep the server.Configuration of the running tenants
+	if len(config.tenants) != len(current.tenants) {
+		return errors.New("Adding or removing tenants requires a restart")
+	}
+	for name, tconf := range config.tenants {
+		running := current.tenants[name]
+		if running == nil {
+			return errors.New("Adding or removing tenants requires a restart")
+		}
+		if serverConfigurationChanged(tconf.Configuration, running.Configuration) {
+			config.Logger.WithField("tenant", name).Warn("Changes to the url or privkeys of tenants require a restart")
+		}
+		tconf.Configuration = running.Configuration
+	}
+
+	s.confLock.Lock()
+	s.conf = config
+	s.confLock.Unlock()
+	s.callbacks.setConfiguration(config)
+	config.Logger.Info("Configuration reloaded")
+	return nil
+}
+
+// serverConfigurationChanged returns whether the url or privkeys of the reloaded
+// server.Configuration differ from those of the running one, which Reload() keeps.
+func serverConfigurationChanged(reloaded, running *server.Configuration) bool {
+	return strings.TrimSuffix(reloaded.URL, "/") != strings.TrimSuffix(running.URL, "/") ||
+		reloaded.IssuerPrivateKeysPath != running.IssuerPrivateKeysPath
+}
+
+// config returns the current configuration of the server.
+func (s *Server) config() *Configuration {
+	if s.parent != nil {
+		return s.parent.config().tenants[s.tenant]
+	}
+	s.confLock.RLock()
+	defer s.confLock.RUnlock()
+	return s.conf
+}
+
 func New(config *Configuration) (*Server, error) {
 	irmaserv, err := irmaserver.New(config.Configuration)
 	if err != nil {
@@ -149,12 +290,29 @@ func New(config *Configuration) (*Server, error) {
 	if err := config.initialize(); err != nil {
 		return nil, err
 	}
-	return &Server{
-		conf:     config,
-		irmaserv: irmaserv,
-	}, nil
+	callbacks, err := newCallbackOutbox(config)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		conf:      config,
+		irmaserv:  irmaserv,
+		callbacks: callbacks,
+		limiter:   newRateLimiter(),
+		oidc:      newOidcProvider(),
+	}
+	if err := s.newTenants(); err != nil {
+		return nil, err
+	}
+	for _, serv := range s.servers() {
+		serv.irmaserv.SetRestoredHandlers(serv.sessionHandlers)
+	}
+	return s, nil
 }
 
+var metricCallbackFailures = metrics.NewCounterVec("irma_callback_failures_total",
+	"Number of session results that could not be POSTed to the callback URL.")
+
 var corsOptions = cors.Options{
 	AllowedOrigins: []string{"*"},
 	AllowedHeaders: []string{"Accept", "Authorization", "Content-Type", "Cache-Control"},
@@ -165,29 +323,33 @@ func (s *Server) ClientHandler() http.Handler {
 	router := chi.NewRouter()
 	router.Use(cors.New(corsOptions).Handler)
 	s.attachClientEndpoints(router)
-	return router
+	return s.tenantHandler(router, (*Server).ClientHandler)
 }
 
 func (s *Server) attachClientEndpoints(router *chi.Mux) {
-	router.Mount("/irma/", s.irmaserv.HandlerFunc())
-	if s.conf.StaticPath != "" {
-		router.Mount(s.conf.StaticPrefix, s.StaticFilesHandler())
+	conf := s.config()
+	router.Mount("/irma/", s.clientRateLimit(s.irmaserv.HandlerFunc()))
+	if conf.StaticPath != "" {
+		router.Mount(conf.StaticPrefix, s.StaticFilesHandler())
 	}
 	router.Group(func(r chi.Router) {
-		if s.conf.Verbose >= 2 {
+		r.Use(s.clientRateLimit)
+		if conf.Verbose >= 2 {
 			r.Use(s.logHandler("staticsession", true, true, true))
 		}
 		r.Post("/irma/session/{name}", s.handleCreateStatic)
 	})
+	s.attachOidcEndpoints(router)
 }
 
 // Handler returns a http.Handler that handles all IRMA requestor messages
 // and IRMA client messages.
 func (s *Server) Handler() http.Handler {
+	conf := s.config()
 	router := chi.NewRouter()
 	router.Use(cors.New(corsOptions).Handler)
 
-	if !s.conf.separateClientServer() {
+	if !conf.separateClientServer() {
 		// Mount server for irmaclient
 		s.attachClientEndpoints(router)
 	}
@@ -199,7 +361,7 @@ func (s *Server) Handler() http.Handler {
 	// while not adding it to the endpoints already added above (which do their own logging).
 	router.Group(func(r chi.Router) {
 		r.Use(cors.New(corsOptions).Handler)
-		if s.conf.Verbose >= 2 {
+		if conf.Verbose >= 2 {
 			r.Use(s.logHandler("requestor", true, true, true))
 		}
 
@@ -208,15 +370,34 @@ func (s *Server) Handler() http.Handler {
 		r.Delete("/session/{token}", s.handleDelete)
 		r.Get("/session/{token}/status", s.handleStatus)
 		r.Get("/session/{token}/statusevents", s.handleStatusEvents)
+		r.Get("/session/{token}/statussocket", s.handleStatusWebSocket)
 		r.Get("/session/{token}/result", s.handleResult)
 
+		// Routes for rendering the session pointer as a QR image, or as links to the IRMA app
+		r.Get("/session/{token}/qr.png", s.handleQr(server.QrPNG, "image/png"))
+		r.Get("/session/{token}/qr.svg", s.handleQr(server.QrSVG, "image/svg+xml"))
+		r.Get("/session/{token}/links", s.handleLinks)
+
 		// Routes for getting signed JWTs containing the session result. Only work if configuration has a private key
 		r.Get("/session/{token}/result-jwt", s.handleJwtResult)
 		r.Get("/session/{token}/getproof", s.handleJwtProofs) // irma_api_server-compatible JWT
 
 		r.Get("/publickey", s.handlePublicKey)
+		r.Get("/.well-known/jwks.json", s.handleJwks)
 	})
 
+	// Routes for health checks by e.g. orchestrators; these are not logged
+	router.Get("/health", s.handleHealth)
+	router.Get("/ready", s.handleReady)
+
+	return s.tenantHandler(router, (*Server).Handler)
+}
+
+// MetricsHandler returns a http.Handler that exposes the operational metrics of the server, of
+// all tenants together, in the Prometheus text exposition format at /metrics.
+func (s *Server) MetricsHandler() http.Handler {
+	router := chi.NewRouter()
+	router.Get("/metrics", metrics.Handler().ServeHTTP)
 	return router
 }
 
@@ -270,21 +451,23 @@ func (s *Server) logHandler(typ string, logResponse, logHeaders, logFrom bool) f
 }
 
 func (s *Server) StaticFilesHandler() http.Handler {
-	if len(s.conf.URL) > 6 {
-		url := s.conf.URL[:len(s.conf.URL)-6] + s.conf.StaticPrefix
-		s.conf.Logger.Infof("Hosting files at %s under %s", s.conf.StaticPath, url)
+	conf := s.config()
+	if len(conf.URL) > 6 {
+		url := conf.URL[:len(conf.URL)-6] + conf.StaticPrefix
+		conf.Logger.Infof("Hosting files at %s under %s", conf.StaticPath, url)
 	} else { // URL not known, don't log it but otherwise continue
-		s.conf.Logger.Infof("Hosting files at %s", s.conf.StaticPath)
+		conf.Logger.Infof("Hosting files at %s", conf.StaticPath)
 	}
-	return http.StripPrefix(s.conf.StaticPrefix, s.logHandler("static", false, false, false)(
-		http.FileServer(http.Dir(s.conf.StaticPath))),
+	return http.StripPrefix(conf.StaticPrefix, s.logHandler("static", false, false, false)(
+		http.FileServer(http.Dir(conf.StaticPath))),
 	)
 }
 
 func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request) {
+	conf := s.config()
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		s.conf.Logger.Error("Could not read session request HTTP POST body")
+		conf.Logger.Error("Could not read session request HTTP POST body")
 		_ = server.LogError(err)
 		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
 		return
@@ -295,13 +478,18 @@ func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request) {
 	// one of them is applicable and able to authenticate the request.
 	var (
 		rrequest  irma.RequestorRequest
+		template  *TemplateRequest
 		request   irma.SessionRequest
 		requestor string
 		rerr      *irma.RemoteError
 		applies   bool
 	)
-	for _, authenticator := range authenticators { // rrequest abbreviates "requestor request"
-		applies, rrequest, requestor, rerr = authenticator.Authenticate(r.Header, body)
+	for _, authenticator := range conf.authenticators { // rrequest abbreviates "requestor request"
+		if cauth, ok := authenticator.(connectionAuthenticator); ok {
+			applies, rrequest, template, requestor, rerr = cauth.AuthenticateConnection(r.TLS, r.Header, body)
+		} else {
+			applies, rrequest, template, requestor, rerr = authenticator.Authenticate(r.Header, body)
+		}
 		if applies || rerr != nil {
 			break
 		}
@@ -312,46 +500,45 @@ func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if !applies {
-		s.conf.Logger.Warnf("Session request uses unknown authentication method, HTTP headers: %s, HTTP POST body: %s",
+		conf.Logger.Warnf("Session request uses unknown authentication method, HTTP headers: %s, HTTP POST body: %s",
 			server.ToJson(r.Header), string(body))
 		server.WriteError(w, server.ErrorInvalidRequest, "Request could not be authorized")
 		return
 	}
 
-	// Authorize request: check if the requestor is allowed to verify or issue
-	// the requested attributes or credentials
-	request = rrequest.SessionRequest()
-	if request.Action() == irma.ActionIssuing {
-		allowed, reason := s.conf.CanIssue(requestor, request.(*irma.IssuanceRequest).Credentials)
-		if !allowed {
-			s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor, "id": reason}).
-				Warn("Requestor not authorized to issue credential; full request: ", server.ToJson(request))
-			server.WriteError(w, server.ErrorUnauthorized, reason)
+	// Obtain the session request from the session template of the requestor, if one is referred to.
+	// The filled in session request is authorized below like any other.
+	if template != nil {
+		if rrequest, err = conf.fillSessionTemplate(requestor, template); err != nil {
+			conf.Logger.WithFields(logrus.Fields{"requestor": requestor, "template": template.Template}).Warn(err.Error())
+			server.WriteError(w, server.ErrorInvalidRequest, err.Error())
 			return
 		}
 	}
-	condiscon := request.Disclosure().Disclose
-	if len(condiscon) > 0 {
-		allowed, reason := s.conf.CanVerifyOrSign(requestor, request.Action(), condiscon)
-		if !allowed {
-			s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor, "id": reason}).
-				Warn("Requestor not authorized to verify attribute; full request: ", server.ToJson(request))
-			server.WriteError(w, server.ErrorUnauthorized, reason)
-			return
-		}
+
+	if rerr = s.authorizeRequest(requestor, rrequest); rerr != nil {
+		server.WriteResponse(w, nil, rerr)
+		return
 	}
-	if rrequest.Base().CallbackURL != "" && s.conf.jwtPrivateKey == nil {
-		s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor}).Warn("Requestor provided callbackUrl but no JWT private key is installed")
-		server.WriteError(w, server.ErrorUnsupported, "")
+	request = rrequest.SessionRequest()
+
+	// Check that the requestor stays within its rate limits and quotas
+	res, limit, retryAfter := s.requestorLimit(requestor, request, true)
+	if limit != "" {
+		conf.Logger.WithFields(logrus.Fields{"requestor": requestor, "limit": limit, "retryAfter": retryAfter}).
+			Warn("Requestor exceeded rate limit or quota")
+		writeRateLimitError(w, limit, retryAfter)
 		return
 	}
 
 	// Everything is authenticated and parsed, we're good to go!
-	qr, token, err := s.irmaserv.StartSession(rrequest, s.doResultCallback)
+	qr, token, err := s.irmaserv.StartSessionWithHandlers(rrequest, requestor, s.sessionHandlers(requestor))
 	if err != nil {
-		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		s.refundRequestorLimit(res)
+		writeStartSessionError(w, err)
 		return
 	}
+	s.startedSession(res)
 
 	server.WriteJson(w, server.SessionPackage{
 		SessionPtr: qr,
@@ -359,22 +546,139 @@ func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// authorizeRequest checks if the requestor is allowed to verify or issue the requested attributes
+// or credentials, and applies the requestor's defaults to the request.
+func (s *Server) authorizeRequest(requestor string, rrequest irma.RequestorRequest) *irma.RemoteError {
+	conf := s.config()
+	request := rrequest.SessionRequest()
+	if request.Action() == irma.ActionIssuing {
+		allowed, reason := conf.CanIssue(requestor, request.(*irma.IssuanceRequest).Credentials)
+		if !allowed {
+			conf.Logger.WithFields(logrus.Fields{"requestor": requestor, "id": reason}).
+				Warn("Requestor not authorized to issue credential; full request: ", server.ToJson(request))
+			return server.RemoteError(server.ErrorUnauthorized, reason)
+		}
+		if err := conf.CheckIssuancePolicy(requestor, request.(*irma.IssuanceRequest)); err != nil {
+			conf.Logger.WithFields(logrus.Fields{"requestor": requestor, "reason": err.Error()}).
+				Warn("Issuance request violates issuance policy of requestor; full request: ", server.ToJson(request))
+			return server.RemoteError(server.ErrorUnauthorized, err.Error())
+		}
+	}
+	condiscon := request.Disclosure().Disclose
+	if len(condiscon) > 0 {
+		allowed, reason := conf.CanVerifyOrSign(requestor, request.Action(), condiscon)
+		if !allowed {
+			conf.Logger.WithFields(logrus.Fields{"requestor": requestor, "id": reason}).
+				Warn("Requestor not authorized to verify attribute; full request: ", server.ToJson(request))
+			return server.RemoteError(server.ErrorUnauthorized, reason)
+		}
+		if err := conf.checkPseudonymous(requestor, request.Action(), condiscon); err != nil {
+			conf.Logger.WithFields(logrus.Fields{"requestor": requestor}).Warn(err.Error())
+			return server.RemoteError(server.ErrorUnauthorized, err.Error())
+		}
+	}
+	applyRequestorDefaults(rrequest, conf.Requestors[requestor])
+	if rrequest.Base().EncryptResult && conf.resultEncryptionKeys[requestor] == nil {
+		conf.Logger.WithFields(logrus.Fields{"requestor": requestor}).Warn("Requestor requested result encryption but has no result encryption key")
+		return server.RemoteError(server.ErrorUnsupported, "no result encryption key configured for requestor")
+	}
+	if rrequest.Base().CallbackURL != "" && !conf.canSignCallbacks(requestor) {
+		conf.Logger.WithFields(logrus.Fields{"requestor": requestor}).Warn("Requestor provided callbackUrl but no JWT private key or callback key is installed")
+		return server.RemoteError(server.ErrorUnsupported, "")
+	}
+	if next := rrequest.Base().NextSession; next != nil && next.URL != "" && !conf.canSignCallbacks(requestor) {
+		conf.Logger.WithFields(logrus.Fields{"requestor": requestor}).Warn("Requestor provided nextSession URL but no JWT private key or callback key is installed")
+		return server.RemoteError(server.ErrorUnsupported, "")
+	}
+	if ir, ok := request.(*irma.IssuanceRequest); ok && ir.Dynamic {
+		if credentialsURL(rrequest) == "" {
+			return server.RemoteError(server.ErrorInvalidRequest, "dynamic issuance requires a credentialsUrl")
+		}
+		if !conf.canSignCallbacks(requestor) {
+			conf.Logger.WithFields(logrus.Fields{"requestor": requestor}).Warn("Requestor requested dynamic issuance but no JWT private key or callback key is installed")
+			return server.RemoteError(server.ErrorUnsupported, "")
+		}
+	}
+	return nil
+}
+
+// applyRequestorDefaults sets the callback URL and result encryption of the request to the
+// defaults configured for the requestor, unless the request specifies a callback URL itself.
+func applyRequestorDefaults(rrequest irma.RequestorRequest, requestor Requestor) {
+	var base *irma.RequestorBaseRequest
+	switch r := rrequest.(type) {
+	case *irma.ServiceProviderRequest:
+		base = &r.RequestorBaseRequest
+	case *irma.SignatureRequestorRequest:
+		base = &r.RequestorBaseRequest
+	case *irma.IdentityProviderRequest:
+		base = &r.RequestorBaseRequest
+	default:
+		return
+	}
+	if base.CallbackURL == "" {
+		base.CallbackURL = requestor.CallbackURL
+	}
+	if requestor.EncryptResults {
+		base.EncryptResult = true
+	}
+}
+
 func (s *Server) handleCreateStatic(w http.ResponseWriter, r *http.Request) {
 	name := chi.URLParam(r, "name")
-	rrequest := s.conf.staticSessions[name]
+	rrequest := s.config().staticSessions[name]
 	if rrequest == nil {
 		server.WriteError(w, server.ErrorInvalidRequest, "unknown static session")
 		return
 	}
-	qr, _, err := s.irmaserv.StartSession(rrequest, s.doResultCallback)
+	qr, _, err := s.irmaserv.StartSession(rrequest, s.resultCallback(""))
 	if err != nil {
-		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		writeStartSessionError(w, err)
 		return
 	}
 	server.WriteJson(w, qr)
 }
 
+// sessionHandlers returns the handlers of the sessions of the requestor, also when these are
+// restored from the session store.
+func (s *Server) sessionHandlers(requestor string) irmaserver.SessionHandlers {
+	if strings.HasPrefix(requestor, "oidc:") {
+		return irmaserver.SessionHandlers{}
+	}
+	return irmaserver.SessionHandlers{
+		Result:      s.resultCallback(requestor),
+		Next:        s.nextSession(requestor),
+		Credentials: s.dynamicCredentials(requestor),
+		Finished: func(result *server.SessionResult) {
+			s.refundIssuance(requestor, result)
+		},
+	}
+}
+
+func writeStartSessionError(w http.ResponseWriter, err error) {
+	if err == irmaserver.ErrDraining {
+		w.Header().Set("Retry-After", "5")
+		server.WriteError(w, server.ErrorShuttingDown, "")
+		return
+	}
+	if rerr, ok := err.(*irma.RemoteError); ok { // rejected by a hook
+		server.WriteResponse(w, nil, rerr)
+		return
+	}
+	server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+}
+
 func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if wait := r.URL.Query().Get("wait"); wait != "" {
+		// Long-polling: block until the status differs from the one the requestor already knows
+		status, err := s.irmaserv.WaitStatus(chi.URLParam(r, "token"), true, server.Status(wait))
+		if err != nil {
+			irmaserver.WriteStatusError(w, err)
+			return
+		}
+		server.WriteJson(w, status)
+		return
+	}
 	res := s.irmaserv.GetSessionResult(chi.URLParam(r, "token"))
 	if res == nil {
 		server.WriteError(w, server.ErrorSessionUnknown, "")
@@ -385,7 +689,7 @@ func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) handleStatusEvents(w http.ResponseWriter, r *http.Request) {
 	token := chi.URLParam(r, "token")
-	s.conf.Logger.WithFields(logrus.Fields{"session": token}).Debug("new client subscribed to server sent events")
+	s.config().Logger.WithFields(logrus.Fields{"session": token}).Debug("new client subscribed to server sent events")
 	if err := s.irmaserv.SubscribeServerSentEvents(w, r, token, true); err != nil {
 		server.WriteResponse(w, nil, &irma.RemoteError{
 			Status:      server.ErrorUnsupported.Status,
@@ -395,6 +699,12 @@ func (s *Server) handleStatusEvents(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *Server) handleStatusWebSocket(w http.ResponseWriter, r *http.Request) {
+	if err := s.irmaserv.SubscribeStatusWebSocket(w, r, chi.URLParam(r, "token"), true); err != nil {
+		irmaserver.WriteStatusError(w, err)
+	}
+}
+
 func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
 	err := s.irmaserv.CancelSession(chi.URLParam(r, "token"))
 	if err != nil {
@@ -403,27 +713,77 @@ func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleResult(w http.ResponseWriter, r *http.Request) {
-	res := s.irmaserv.GetSessionResult(chi.URLParam(r, "token"))
+	res := s.sessionResult(chi.URLParam(r, "token"))
 	if res == nil {
 		server.WriteError(w, server.ErrorSessionUnknown, "")
 		return
 	}
-	if res.LegacySession {
-		server.WriteJson(w, res.Legacy())
-	} else {
-		server.WriteJson(w, res)
+	bts, err := marshalResult(res)
+	if err != nil {
+		server.WriteError(w, server.ErrorUnknown, err.Error())
+		return
+	}
+	s.writeResult(w, res.Token, bts, "")
+}
+
+// handleQr returns a handler that renders the session pointer of the session as a QR image
+// of the size specified by the size query parameter.
+func (s *Server) handleQr(render func(*irma.Qr, int) ([]byte, error), contentType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		qr := s.irmaserv.SessionPointer(chi.URLParam(r, "token"))
+		if qr == nil {
+			server.WriteError(w, server.ErrorSessionUnknown, "")
+			return
+		}
+		size := server.QrDefaultSize
+		if param := r.URL.Query().Get("size"); param != "" {
+			var err error
+			if size, err = strconv.Atoi(param); err != nil {
+				server.WriteError(w, server.ErrorInvalidRequest, "size must be an integer")
+				return
+			}
+		}
+		if err := server.QrSizeValid(size); err != nil {
+			server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+			return
+		}
+		bts, err := render(qr, size)
+		if err != nil {
+			_ = server.LogError(err)
+			server.WriteError(w, server.ErrorUnknown, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(bts)
 	}
 }
 
+func (s *Server) handleLinks(w http.ResponseWriter, r *http.Request) {
+	qr := s.irmaserv.SessionPointer(chi.URLParam(r, "token"))
+	if qr == nil {
+		server.WriteError(w, server.ErrorSessionUnknown, "")
+		return
+	}
+	links, err := server.QrLinks(qr)
+	if err != nil {
+		_ = server.LogError(err)
+		server.WriteError(w, server.ErrorUnknown, err.Error())
+		return
+	}
+	server.WriteJson(w, links)
+}
+
 func (s *Server) handleJwtResult(w http.ResponseWriter, r *http.Request) {
-	if s.conf.jwtPrivateKey == nil {
-		s.conf.Logger.Warn("Session result JWT requested but no JWT private key is configured")
+	conf := s.config()
+	if conf.jwtPrivateKey == nil {
+		conf.Logger.Warn("Session result JWT requested but no JWT private key is configured")
 		server.WriteError(w, server.ErrorUnknown, "JWT signing not supported")
 		return
 	}
 
 	sessiontoken := chi.URLParam(r, "token")
-	res := s.irmaserv.GetSessionResult(sessiontoken)
+	res := s.sessionResult(sessiontoken)
 	if res == nil {
 		server.WriteError(w, server.ErrorSessionUnknown, "")
 		return
@@ -431,23 +791,24 @@ func (s *Server) handleJwtResult(w http.ResponseWriter, r *http.Request) {
 
 	j, err := s.resultJwt(res)
 	if err != nil {
-		s.conf.Logger.Error("Failed to sign session result JWT")
+		conf.Logger.Error("Failed to sign session result JWT")
 		_ = server.LogError(err)
 		server.WriteError(w, server.ErrorUnknown, err.Error())
 		return
 	}
-	server.WriteString(w, j)
+	s.writeResult(w, sessiontoken, []byte(j), "JWT")
 }
 
 func (s *Server) handleJwtProofs(w http.ResponseWriter, r *http.Request) {
-	if s.conf.jwtPrivateKey == nil {
-		s.conf.Logger.Warn("Session result JWT requested but no JWT private key is configured")
+	conf := s.config()
+	if conf.jwtPrivateKey == nil {
+		conf.Logger.Warn("Session result JWT requested but no JWT private key is configured")
 		server.WriteError(w, server.ErrorUnknown, "JWT signing not supported")
 		return
 	}
 
 	sessiontoken := chi.URLParam(r, "token")
-	res := s.irmaserv.GetSessionResult(sessiontoken)
+	res := s.sessionResult(sessiontoken)
 	if res == nil {
 		server.WriteError(w, server.ErrorSessionUnknown, "")
 		return
@@ -468,8 +829,8 @@ func (s *Server) handleJwtProofs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	claims["iat"] = time.Now().Unix()
-	if s.conf.JwtIssuer != "" {
-		claims["iss"] = s.conf.JwtIssuer
+	if conf.JwtIssuer != "" {
+		claims["iss"] = conf.JwtIssuer
 	}
 	claims["status"] = res.ProofStatus
 	validity := s.irmaserv.GetRequest(sessiontoken).Base().ResultJwtValidity
@@ -490,24 +851,53 @@ func (s *Server) handleJwtProofs(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Sign the jwt and return it
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	resultJwt, err := token.SignedString(s.conf.jwtPrivateKey)
+	resultJwt, err := conf.signJwt(claims)
 	if err != nil {
-		s.conf.Logger.Error("Failed to sign session result JWT")
+		conf.Logger.Error("Failed to sign session result JWT")
 		_ = server.LogError(err)
 		server.WriteError(w, server.ErrorUnknown, err.Error())
 		return
 	}
-	server.WriteString(w, resultJwt)
+	s.writeResult(w, sessiontoken, []byte(resultJwt), "JWT")
+}
+
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	server.WriteString(w, "OK")
+}
+
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	conf := s.config()
+	readiness := s.irmaserv.Readiness()
+	if conf.JwtPrivateKey != "" || conf.JwtPrivateKeyFile != "" {
+		readiness.JwtPrivateKey = &server.ComponentStatus{Ready: true}
+		if _, _, err := conf.parsePrivateKey(); err != nil {
+			readiness.JwtPrivateKey = &server.ComponentStatus{Error: err.Error()}
+			readiness.Ready = false
+		}
+	}
+
+	bts, err := json.Marshal(readiness)
+	if err != nil {
+		server.WriteError(w, server.ErrorUnknown, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if readiness.Ready {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_, _ = w.Write(bts)
 }
 
 func (s *Server) handlePublicKey(w http.ResponseWriter, r *http.Request) {
-	if s.conf.jwtPrivateKey == nil {
+	conf := s.config()
+	if conf.jwtPrivateKey == nil {
 		server.WriteError(w, server.ErrorUnsupported, "")
 		return
 	}
 
-	bts, err := x509.MarshalPKIXPublicKey(&s.conf.jwtPrivateKey.PublicKey)
+	bts, err := x509.MarshalPKIXPublicKey(conf.jwtPrivateKey.Public())
 	if err != nil {
 		server.WriteError(w, server.ErrorUnknown, err.Error())
 		return
@@ -520,12 +910,17 @@ func (s *Server) handlePublicKey(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) resultJwt(sessionresult *server.SessionResult) (string, error) {
+	validity := s.irmaserv.GetRequest(sessionresult.Token).Base().ResultJwtValidity
+	return s.config().resultJwt(sessionresult, validity)
+}
+
+// resultJwt returns the session result as a JWT that expires after the specified number of seconds.
+func (conf *Configuration) resultJwt(sessionresult *server.SessionResult, validity int) (string, error) {
 	standardclaims := jwt.StandardClaims{
-		Issuer:   s.conf.JwtIssuer,
+		Issuer:   conf.JwtIssuer,
 		IssuedAt: time.Now().Unix(),
 		Subject:  string(sessionresult.Type) + "_result",
 	}
-	validity := s.irmaserv.GetRequest(sessionresult.Token).Base().ResultJwtValidity
 	standardclaims.ExpiresAt = time.Now().Unix() + int64(validity)
 
 	var claims jwt.Claims
@@ -542,43 +937,5 @@ func (s *Server) resultJwt(sessionresult *server.SessionResult) (string, error)
 	}
 
 	// Sign the jwt and return it
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	return token.SignedString(s.conf.jwtPrivateKey)
-}
-
-func (s *Server) doResultCallback(result *server.SessionResult) {
-	callbackUrl := s.irmaserv.GetRequest(result.Token).Base().CallbackURL
-	if callbackUrl == "" {
-		return
-	}
-
-	logger := s.conf.Logger.WithFields(logrus.Fields{"session": result.Token, "callbackUrl": callbackUrl})
-	if !strings.HasPrefix(callbackUrl, "https") {
-		logger.Warn("POSTing session result to callback URL without TLS: attributes are unencrypted in traffic")
-	} else {
-		logger.Debug("POSTing session result")
-	}
-
-	var res string
-	if s.conf.jwtPrivateKey != nil {
-		var err error
-		res, err = s.resultJwt(result)
-		if err != nil {
-			_ = server.LogError(errors.WrapPrefix(err, "Failed to create JWT for result callback", 0))
-			return
-		}
-	} else {
-		bts, err := json.Marshal(result)
-		if err != nil {
-			_ = server.LogError(errors.WrapPrefix(err, "Failed to marshal session result for result callback", 0))
-			return
-		}
-		res = string(bts)
-	}
-
-	var x string // dummy for the server's return value that we don't care about
-	if err := irma.NewHTTPTransport(callbackUrl).Post("", &x, res); err != nil {
-		// not our problem, log it and go on
-		logger.Warn(errors.WrapPrefix(err, "Failed to POST session result to callback URL", 0))
-	}
+	return conf.signJwt(claims)
 }
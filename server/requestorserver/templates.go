@@ -0,0 +1,223 @@
+package requestorserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+)
+
+// A TemplateRequest refers to a session template that is configured for the requestor, which
+// handleCreate fills in with the parameters to obtain the session request. Requestors POST it
+// instead of a session request, either as JSON or as the templaterequest field of a JWT.
+type TemplateRequest struct {
+	Template   string            `json:"template"`
+	Parameters map[string]string `json:"parameters,omitempty"`
+}
+
+// templateJwt is a requestor JWT referring to a session template.
+type templateJwt struct {
+	irma.ServerJwt
+	Request *TemplateRequest `json:"templaterequest"`
+}
+
+func (r *TemplateRequest) Validate() error {
+	if r.Template == "" {
+		return errors.New("Not a TemplateRequest")
+	}
+	return nil
+}
+
+func (claims *templateJwt) Valid() error {
+	if claims.Type != "template_request" {
+		return errors.New("Template jwt has invalid subject")
+	}
+	if time.Time(claims.IssuedAt).After(time.Now()) {
+		return errors.New("Template jwt not yet valid")
+	}
+	return nil
+}
+
+// templatePlaceholder matches the {{name}} placeholders of session template parameters.
+var templatePlaceholder = regexp.MustCompile(`{{([a-zA-Z0-9_]+)}}`)
+
+// sessionTemplate is a parsed session template of a requestor.
+type sessionTemplate struct {
+	request    interface{}     // session request in JSON form, containing placeholders
+	parameters map[string]bool // names of the placeholders in the session request
+}
+
+// readSessionTemplates parses the session templates of the requestors, and checks that the
+// requestors are permitted to start the sessions they describe.
+func (conf *Configuration) readSessionTemplates() error {
+	conf.sessionTemplates = map[string]map[string]*sessionTemplate{}
+	for name, requestor := range conf.Requestors {
+		if len(requestor.SessionTemplates) == 0 {
+			continue
+		}
+		templates := map[string]*sessionTemplate{}
+		for tname, t := range requestor.SessionTemplates {
+			prefix := fmt.Sprintf("Requestor %s session template %s: ", name, tname)
+			if !regexp.MustCompile("^[a-zA-Z0-9_]+$").MatchString(tname) {
+				return errors.New(prefix + "name not allowed, must be alphanumeric")
+			}
+			template := &sessionTemplate{parameters: map[string]bool{}}
+			template.request = walkTemplate(t, func(s string) string {
+				for _, match := range templatePlaceholder.FindAllStringSubmatch(s, -1) {
+					template.parameters[match[1]] = true
+				}
+				return s
+			})
+			rrequest, err := template.parse(nil)
+			if err != nil {
+				return errors.WrapPrefix(err, prefix, 0)
+			}
+			if err = conf.checkTemplatePermissions(name, rrequest); err != nil {
+				return errors.New(prefix + err.Error())
+			}
+			templates[tname] = template
+		}
+		conf.sessionTemplates[name] = templates
+	}
+	return nil
+}
+
+// checkTemplatePermissions checks that the requestor may issue and verify the attributes of the
+// session template. Requested attribute values that contain placeholders are checked only when
+// the template is filled in, when the session request is authorized as usual.
+func (conf *Configuration) checkTemplatePermissions(requestor string, rrequest irma.RequestorRequest) error {
+	request := rrequest.SessionRequest()
+	if request.Action() == irma.ActionIssuing {
+		if allowed, reason := conf.CanIssue(requestor, request.(*irma.IssuanceRequest).Credentials); !allowed {
+			return errors.Errorf("not permitted to issue %s", reason)
+		}
+	}
+	condiscon := request.Disclosure().Disclose
+	_ = condiscon.Iterate(func(attr *irma.AttributeRequest) error {
+		if attr.Value != nil && templatePlaceholder.MatchString(*attr.Value) {
+			attr.Value = nil
+		}
+		return nil
+	})
+	if len(condiscon) > 0 {
+		if allowed, reason := conf.CanVerifyOrSign(requestor, request.Action(), condiscon); !allowed {
+			return errors.Errorf("not permitted to verify %s", reason)
+		}
+	}
+	return nil
+}
+
+// parse parses the session template into a session request, with the specified parameters
+// filled in (or with its placeholders left in place if parameters is nil).
+func (template *sessionTemplate) parse(parameters map[string]string) (irma.RequestorRequest, error) {
+	request := template.request
+	if parameters != nil {
+		request = walkTemplate(request, func(s string) string {
+			return templatePlaceholder.ReplaceAllStringFunc(s, func(placeholder string) string {
+				return parameters[templatePlaceholder.FindStringSubmatch(placeholder)[1]]
+			})
+		})
+	}
+	j, err := json.Marshal(request)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "failed to parse session request", 0)
+	}
+	rrequest, err := server.ParseSessionRequest(j)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "failed to parse session request", 0)
+	}
+	return rrequest, nil
+}
+
+// parseRequestorRequest parses the body of a session request that is not a JWT. Unlike
+// server.ParseSessionRequest, which is used for session requests from all other sources,
+// it also accepts references to session templates, which it returns separately.
+func parseRequestorRequest(body []byte) (irma.RequestorRequest, *TemplateRequest, error) {
+	tr := &TemplateRequest{}
+	if err := irma.UnmarshalValidate(body, tr); err == nil {
+		return nil, tr, nil
+	}
+	rrequest, err := server.ParseSessionRequest(body)
+	return rrequest, nil, err
+}
+
+// parseTemplateJwt parses the contents of a JWT referring to a session template.
+// Note: this function does not verify the signature! Do that elsewhere.
+func parseTemplateJwt(requestorJwt string) (*TemplateRequest, error) {
+	claims := &templateJwt{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(requestorJwt, claims); err != nil {
+		return nil, err
+	}
+	if claims.Request == nil {
+		return nil, errors.New("Invalid JWT body: missing templaterequest")
+	}
+	if err := claims.Request.Validate(); err != nil {
+		return nil, errors.WrapPrefix(err, "Invalid JWT body", 0)
+	}
+	return claims.Request, nil
+}
+
+// fillSessionTemplate returns the session request described by the session template of the
+// requestor, with the parameters filled in. All parameters of the template must be specified.
+func (conf *Configuration) fillSessionTemplate(requestor string, tr *TemplateRequest) (irma.RequestorRequest, error) {
+	template := conf.sessionTemplates[requestor][tr.Template]
+	if template == nil {
+		return nil, errors.Errorf("unknown session template %s", tr.Template)
+	}
+	var unknown, missing []string
+	for name := range tr.Parameters {
+		if !template.parameters[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	for name := range template.parameters {
+		if _, ok := tr.Parameters[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, errors.Errorf("unknown parameters for session template %s: %s", tr.Template, strings.Join(unknown, ", "))
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, errors.Errorf("missing parameters for session template %s: %s", tr.Template, strings.Join(missing, ", "))
+	}
+	return template.parse(tr.Parameters)
+}
+
+// walkTemplate returns a copy of the specified JSON-like value (as parsed from the configuration)
+// in which f is applied to all strings except map keys.
+func walkTemplate(v interface{}, f func(string) string) interface{} {
+	switch val := v.(type) {
+	case string:
+		return f(val)
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(val))
+		for k, e := range val {
+			m[k] = walkTemplate(e, f)
+		}
+		return m
+	case map[interface{}]interface{}: // as produced by YAML parsers
+		m := make(map[string]interface{}, len(val))
+		for k, e := range val {
+			m[fmt.Sprint(k)] = walkTemplate(e, f)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(val))
+		for i, e := range val {
+			s[i] = walkTemplate(e, f)
+		}
+		return s
+	default:
+		return val
+	}
+}
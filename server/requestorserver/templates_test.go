@@ -0,0 +1,100 @@
+package requestorserver
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionTemplates(t *testing.T) {
+	var templates map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"sign": {
+			"callbackUrl": "{{callback}}",
+			"request": {
+				"@context": "https://irma.app/ld/request/signature/v2",
+				"message": "I agree to {{subject}}",
+				"disclose": [[["irma-demo.RU.studentCard.studentID"]]]
+			}
+		},
+		"issue": {
+			"request": {
+				"@context": "https://irma.app/ld/request/issuance/v2",
+				"credentials": [{
+					"credential": "irma-demo.MijnOverheid.fullName",
+					"attributes": {"firstname": "{{firstname}}", "familyname": "{{familyname}}"}
+				}]
+			}
+		}
+	}`), &templates))
+
+	conf := &Configuration{
+		Requestors: map[string]Requestor{
+			"requestor": {
+				Permissions: Permissions{
+					Signing: []string{"irma-demo.RU.studentCard.*"},
+					Issuing: []string{"irma-demo.MijnOverheid.fullName"},
+				},
+				SessionTemplates: templates,
+			},
+		},
+	}
+	require.NoError(t, conf.readSessionTemplates())
+
+	rrequest, err := conf.fillSessionTemplate("requestor", &TemplateRequest{
+		Template:   "sign",
+		Parameters: map[string]string{"callback": "https://example.com/callback", "subject": `the "terms"`},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "https://example.com/callback", rrequest.Base().CallbackURL)
+	require.Equal(t, `I agree to the "terms"`, rrequest.SessionRequest().(*irma.SignatureRequest).Message)
+
+	rrequest, err = conf.fillSessionTemplate("requestor", &TemplateRequest{
+		Template:   "issue",
+		Parameters: map[string]string{"firstname": "Alice", "familyname": "Smith"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "Alice", rrequest.SessionRequest().(*irma.IssuanceRequest).Credentials[0].Attributes["firstname"])
+
+	// Unknown templates, and missing or unknown parameters
+	for _, tr := range []*TemplateRequest{
+		{Template: "issue", Parameters: map[string]string{"firstname": "Alice"}},
+		{Template: "issue", Parameters: map[string]string{"firstname": "Alice", "familyname": "Smith", "other": ""}},
+		{Template: "unknown"},
+	} {
+		_, err = conf.fillSessionTemplate("requestor", tr)
+		require.Error(t, err)
+	}
+	_, err = conf.fillSessionTemplate("other", &TemplateRequest{Template: "sign"})
+	require.Error(t, err)
+
+	// Only session requests sent to handleCreate may refer to session templates
+	rrequest, tr, err := parseRequestorRequest([]byte(`{"template": "sign"}`))
+	require.NoError(t, err)
+	require.Nil(t, rrequest)
+	require.Equal(t, "sign", tr.Template)
+	_, err = server.ParseSessionRequest([]byte(`{"template": "sign"}`))
+	require.Error(t, err)
+	j, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &templateJwt{
+		ServerJwt: irma.ServerJwt{Type: "template_request", IssuedAt: irma.Timestamp(time.Now())},
+		Request:   &TemplateRequest{Template: "sign"},
+	}).SignedString([]byte("key"))
+	require.NoError(t, err)
+	tr, err = parseTemplateJwt(j)
+	require.NoError(t, err)
+	require.Equal(t, "sign", tr.Template)
+	templates["nested"] = map[string]interface{}{"template": "sign"}
+	require.Error(t, conf.readSessionTemplates())
+	delete(templates, "nested")
+
+	// Permissions are checked when loading the templates
+	requestor := conf.Requestors["requestor"]
+	requestor.Issuing = nil
+	conf.Requestors["requestor"] = requestor
+	require.Error(t, conf.readSessionTemplates())
+}
@@ -0,0 +1,244 @@
+package requestorserver
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/go-errors/errors"
+)
+
+// Tenant is a tenant hosted by the server alongside the default tenant, which is configured by
+// the rest of the configuration. Requests are handled by a tenant if they match its host and path
+// prefix (of which at least one must be specified). Tenants share the parsed schemes, the session
+// store and all settings not listed here with the default tenant, but not its sessions.
+type Tenant struct {
+	// Host header (e.g. "irma.example.com") of the requests for this tenant
+	Host string `json:"host" mapstructure:"host"`
+	// Path prefix (e.g. "/example") of the requests for this tenant, which is stripped before handling them
+	PathPrefix string `json:"path_prefix" mapstructure:"path_prefix"`
+
+	// URL at which the IRMA app can reach this tenant during sessions (default: url with the host
+	// and path prefix of the tenant applied)
+	URL string `json:"url" mapstructure:"url"`
+	// Path to the issuer private keys of this tenant
+	IssuerPrivateKeysPath string `json:"privkeys" mapstructure:"privkeys"`
+
+	// Disclosing, signing or issuance permissions that apply to all requestors of this tenant
+	Permissions `mapstructure:",squash"`
+	// Requestor-specific permission and authentication configuration
+	Requestors map[string]Requestor `json:"requestors" mapstructure:"requestors"`
+
+	// Used in the "iss" field of the JWTs of this tenant (default: jwt_issuer)
+	JwtIssuer string `json:"jwt_issuer" mapstructure:"jwt_issuer"`
+	// Private key with which the JWTs of this tenant are signed, like jwt_privkey
+	JwtPrivateKey     string `json:"jwt_privkey" mapstructure:"jwt_privkey"`
+	JwtPrivateKeyFile string `json:"jwt_privkey_file" mapstructure:"jwt_privkey_file"`
+
+	// Key (base64 encoded) with which result callbacks to the requestors of this tenant are signed
+	// using HMAC-SHA256, for requestors that have no callback key of their own, like callback_key
+	CallbackKey     string `json:"callback_key" mapstructure:"callback_key"`
+	CallbackKeyFile string `json:"callback_key_file" mapstructure:"callback_key_file"`
+
+	StaticSessions map[string]interface{} `json:"static_sessions" mapstructure:"static_sessions"`
+}
+
+// readTenants validates the tenants and derives their configurations from the configuration of
+// the default tenant.
+func (conf *Configuration) readTenants() error {
+	running := conf.tenants
+	conf.tenants = map[string]*Configuration{}
+	routes := map[string]string{}
+	for name, t := range conf.Tenants {
+		if t == nil {
+			return errors.Errorf("Tenant %s has no configuration", name)
+		}
+		if t.Host == "" && t.PathPrefix == "" {
+			return errors.Errorf("Tenant %s must have a host or a path_prefix", name)
+		}
+		if t.PathPrefix != "" && (t.PathPrefix[0] != '/' || strings.HasSuffix(t.PathPrefix, "/")) {
+			return errors.Errorf("Tenant %s: path_prefix must start and must not end with a slash, was %s", name, t.PathPrefix)
+		}
+		route := strings.ToLower(t.Host) + t.PathPrefix
+		if other, ok := routes[route]; ok {
+			return errors.Errorf("Tenants %s and %s have the same host and path_prefix", name, other)
+		}
+		routes[route] = name
+
+		tconf, err := conf.tenantConfiguration(t)
+		if err != nil {
+			return errors.WrapPrefix(err, "Tenant "+name, 0)
+		}
+		if r := running[name]; r != nil { // keep remembering used JWTs after a reload
+			tconf.jwtReplayCache = r.jwtReplayCache
+		}
+		if err = tconf.initialize(); err != nil {
+			return errors.WrapPrefix(err, "Tenant "+name, 0)
+		}
+		conf.tenants[name] = tconf
+	}
+	return nil
+}
+
+// tenantConfiguration returns the configuration of the tenant: a copy of the configuration of the
+// default tenant, with the settings of the tenant replacing their counterparts. The keys and JWT
+// replay cache of the default tenant are not copied, so that each tenant has its own.
+func (conf *Configuration) tenantConfiguration(t *Tenant) (*Configuration, error) {
+	sconf := *conf.Configuration
+	sconf.URL = t.URL
+	if sconf.URL == "" && conf.URL != "" {
+		u, err := url.Parse(conf.URL)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "failed to derive url", 0)
+		}
+		if t.Host != "" {
+			if port := u.Port(); port != "" {
+				u.Host = net.JoinHostPort(t.Host, port)
+			} else {
+				u.Host = t.Host
+			}
+		}
+		u.Path = t.PathPrefix + u.Path
+		sconf.URL = u.String()
+	}
+	sconf.IssuerPrivateKeysPath = t.IssuerPrivateKeysPath
+	sconf.IssuerPrivateKeys = nil
+
+	tconf := &Configuration{}
+	*tconf = *conf
+	tconf.Configuration = &sconf
+	tconf.Permissions = t.Permissions
+	tconf.Requestors = t.Requestors
+	tconf.RequestorsString = ""
+	if t.JwtIssuer != "" {
+		tconf.JwtIssuer = t.JwtIssuer
+	}
+	tconf.JwtPrivateKey = t.JwtPrivateKey
+	tconf.JwtPrivateKeyFile = t.JwtPrivateKeyFile
+	tconf.JwtKeyID = ""
+	tconf.JwtVerificationKeys = nil
+	tconf.jwtPrivateKey, tconf.jwtSigningMethod = nil, nil
+	tconf.jwtReplayCache = nil
+	tconf.CallbackKey = t.CallbackKey
+	tconf.CallbackKeyFile = t.CallbackKeyFile
+	tconf.callbackKeys = nil
+	tconf.StaticSessions = t.StaticSessions
+	tconf.OidcClients = nil
+	tconf.AdminPort = 0
+	tconf.ReadConfiguration = nil
+	tconf.Tenants, tconf.tenants = nil, nil
+	return tconf, nil
+}
+
+// tenant returns the configuration of the named tenant, or conf itself for the default tenant
+// (which has the empty name).
+func (conf *Configuration) tenant(name string) *Configuration {
+	if name == "" {
+		return conf
+	}
+	return conf.tenants[name]
+}
+
+// matchTenant returns the name of the tenant by which the request is to be handled, along with its
+// path prefix. If the request matches several tenants, the one with the longest path prefix is
+// taken, preferring one whose host is specified.
+func (conf *Configuration) matchTenant(r *http.Request) (string, string) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	var match string
+	best := -1
+	for name, t := range conf.Tenants {
+		if t.Host != "" && !strings.EqualFold(t.Host, host) {
+			continue
+		}
+		if t.PathPrefix != "" && r.URL.Path != t.PathPrefix && !strings.HasPrefix(r.URL.Path, t.PathPrefix+"/") {
+			continue
+		}
+		score := 2 * len(t.PathPrefix)
+		if t.Host != "" {
+			score++
+		}
+		if score > best {
+			match, best = name, score
+		}
+	}
+	if match == "" {
+		return "", ""
+	}
+	return match, conf.Tenants[match].PathPrefix
+}
+
+// newTenants creates the servers of the tenants, which share the session store, session result
+// handlers and callback outbox of s.
+func (s *Server) newTenants() error {
+	conf := s.config()
+	s.tenants = map[string]*Server{}
+	for name, tconf := range conf.tenants {
+		irmaserv, err := s.irmaserv.NewTenant(name, tconf.Configuration)
+		if err != nil {
+			return errors.WrapPrefix(err, "Tenant "+name, 0)
+		}
+		s.tenants[name] = &Server{
+			tenant:    name,
+			parent:    s,
+			irmaserv:  irmaserv,
+			callbacks: s.callbacks,
+			limiter:   newRateLimiter(),
+			oidc:      newOidcProvider(),
+		}
+	}
+	return nil
+}
+
+// servers returns the server of the default tenant followed by those of the other tenants,
+// sorted by name.
+func (s *Server) servers() []*Server {
+	names := make([]string, 0, len(s.tenants))
+	for name := range s.tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	servers := []*Server{s}
+	for _, name := range names {
+		servers = append(servers, s.tenants[name])
+	}
+	return servers
+}
+
+// tenantHandler returns a http.Handler that passes requests for a tenant to the handler of
+// that tenant as returned by handler (with its path prefix stripped), and other requests to def.
+func (s *Server) tenantHandler(def http.Handler, handler func(*Server) http.Handler) http.Handler {
+	if len(s.tenants) == 0 {
+		return def
+	}
+	handlers := map[string]http.Handler{}
+	for name, t := range s.tenants {
+		handlers[name] = handler(t)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, prefix := s.config().matchTenant(r)
+		h := handlers[name]
+		if h == nil {
+			def.ServeHTTP(w, r)
+			return
+		}
+		if prefix != "" {
+			h = http.StripPrefix(prefix, h)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// sessionServer returns the server of the tenant of the specified session, if any.
+func (s *Server) sessionServer(token string) *Server {
+	for _, serv := range s.servers() {
+		if serv.irmaserv.SessionInfo(token) != nil {
+			return serv
+		}
+	}
+	return nil
+}
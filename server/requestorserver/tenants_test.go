@@ -0,0 +1,58 @@
+package requestorserver
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/privacybydesign/irmago/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTenants(t *testing.T) {
+	conf := &Configuration{
+		Configuration: &server.Configuration{URL: "https://example.com:8088/irma"},
+		CallbackKey:   "c2VjcmV0",
+		Tenants: map[string]*Tenant{
+			"host":   {Host: "irma.example.org"},
+			"prefix": {PathPrefix: "/prefix"},
+			"both":   {Host: "irma.example.org", PathPrefix: "/prefix"},
+			"url":    {PathPrefix: "/url", URL: "https://url.example.com/irma"},
+		},
+	}
+	for name, expected := range map[string]string{
+		"host":   "https://irma.example.org:8088/irma",
+		"prefix": "https://example.com:8088/prefix/irma",
+		"both":   "https://irma.example.org:8088/prefix/irma",
+		"url":    "https://url.example.com/irma",
+	} {
+		tconf, err := conf.tenantConfiguration(conf.Tenants[name])
+		require.NoError(t, err)
+		require.Equal(t, expected, tconf.URL)
+		require.Empty(t, tconf.CallbackKey, "tenants should not share the callback key of the default tenant")
+	}
+
+	for target, expected := range map[string][2]string{
+		"https://example.com/session":                   {"", ""},
+		"https://example.com/prefixes/session":          {"", ""},
+		"https://example.com/prefix/session":            {"prefix", "/prefix"},
+		"https://irma.example.org:8088/session":         {"host", ""},
+		"https://IRMA.example.org/prefix/session":       {"both", "/prefix"},
+		"https://irma.example.org/url/session":          {"url", "/url"},
+		"https://other.example.org/prefix/irma/session": {"prefix", "/prefix"},
+	} {
+		name, prefix := conf.matchTenant(httptest.NewRequest("GET", target, nil))
+		require.Equal(t, expected, [2]string{name, prefix}, target)
+	}
+
+	// Tenants must be unambiguously routable
+	for _, tenants := range []map[string]*Tenant{
+		{"tenant": nil},
+		{"tenant": {}},
+		{"tenant": {PathPrefix: "prefix"}},
+		{"tenant": {PathPrefix: "/prefix/"}},
+		{"tenant": {Host: "example.com"}, "other": {Host: "EXAMPLE.com"}},
+	} {
+		conf.Tenants = tenants
+		require.Error(t, conf.readTenants())
+	}
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/irmago"
+)
+
+// SessionStore keeps the state of the sessions of the IRMA server. The server looks up the state
+// of a session in the store whenever it handles the session, and writes it back whenever the
+// session changes, so that several servers sharing a store (e.g. replicas of irmad behind a load
+// balancer) can handle each other's sessions. Its methods may be called concurrently.
+//
+// The irmaserver library uses the store selected by the SessionStore option of the Configuration,
+// unless a store is provided in its CustomSessionStore option.
+type SessionStore interface {
+	// Add stores a new session.
+	Add(session *SessionData) error
+	// Get returns the session with the specified requestor token, or nil if there is none.
+	Get(token string) (*SessionData, error)
+	// ClientGet returns the session with the specified client token, or nil if there is none.
+	ClientGet(clientToken string) (*SessionData, error)
+	// Update replaces the state of an existing session.
+	Update(session *SessionData) error
+	// Delete deletes the session with the specified requestor token.
+	Delete(token string) error
+	// List returns all sessions.
+	List() ([]*SessionData, error)
+	// Lock obtains exclusive access to the session with the specified requestor token for the
+	// calling server, until the returned function is called. Stores used by only one server may
+	// return a function that does nothing, as the server also locks its sessions internally.
+	Lock(token string) (unlock func(), err error)
+}
+
+// SessionData is the state of a session as kept in a SessionStore. It is serializable to JSON.
+type SessionData struct {
+	Action           irma.Action
+	Token            string
+	ClientToken      string
+	Tenant           string `json:",omitempty"`
+	Requestor        string
+	Version          *irma.ProtocolVersion `json:",omitempty"`
+	Rrequest         json.RawMessage
+	LegacyCompatible bool
+	LegacySession    bool
+
+	Status        Status
+	PrevStatus    Status
+	ResponseCache struct {
+		Message       []byte
+		Response      []byte
+		Status        int
+		SessionStatus Status
+	}
+
+	Created    time.Time
+	LastActive time.Time
+	Result     *SessionResult
+
+	KssProofs map[irma.SchemeManagerIdentifier]*gabi.ProofP `json:",omitempty"`
+
+	// Incremented by the server whenever it updates the session, so that servers sharing the
+	// store can tell whether the session was changed by another server
+	Revision int `json:",omitempty"`
+}
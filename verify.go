@@ -1,7 +1,7 @@
 package irma
 
 import (
-	"crypto/rsa"
+	"crypto"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
@@ -359,7 +359,7 @@ func (e ExpiredError) Error() string {
 }
 
 // ParseApiServerJwt verifies and parses a JWT as returned by an irma_api_server after a disclosure request into a key-value pair.
-func ParseApiServerJwt(inputJwt string, signingKey *rsa.PublicKey) (map[AttributeTypeIdentifier]*DisclosedAttribute, error) {
+func ParseApiServerJwt(inputJwt string, signingKey crypto.PublicKey) (map[AttributeTypeIdentifier]*DisclosedAttribute, error) {
 	claims := struct {
 		jwt.StandardClaims
 		Attributes map[AttributeTypeIdentifier]string `json:"attributes"`